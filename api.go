@@ -1,6 +1,7 @@
 package api
 
 import (
+	"net/http"
 	"reflect"
 	"time"
 
@@ -23,6 +24,48 @@ type Options struct {
 	// For debugging. Adds this number of milliseconds latency to every api request so you can check your
 	// app remains responsive. Will be ignored if martini.Env==martini.Prod (ie. in production environment)
 	HttpLatency int
+
+	// Where APIKeyAuth looks for an API key. Defaults to the X-API-Key header,
+	// or failing that the api_key query parameter.
+	APIKeyHeader string
+	APIKeyParam  string
+
+	// If set, the login route also sets a session cookie of this name, which
+	// can be checked with CookieStrategy. SessionCookieSecure marks it Secure.
+	// SessionCookieSameSite defaults to http.SameSiteLaxMode. Browsers only
+	// accept http.SameSiteNoneMode, which a front end on another site needs,
+	// with SessionCookieSecure.
+	SessionCookie         string
+	SessionCookieSecure   bool
+	SessionCookieSameSite http.SameSite
+	// Isolate tenants sharing the database. See Tenancy.
+	Tenancy *Tenancy
+	// Throttle failed logins at the route added by SetAuth. See LoginThrottle.
+	LoginThrottle *LoginThrottle
+	// Issuer shown by authenticator apps for AddTwoFactorRoutes. Defaults to "api".
+	TwoFactorIssuer string
+	// Title and version of the API in the document returned by OpenAPI().
+	// Default to "API" and "1.0".
+	APITitle   string
+	APIVersion string
+	// Allow browsers on other origins to use the API. See CORS.
+	CORS *CORS
+	// Answer requests for a known path with another method with 405 Method
+	// Not Allowed, instead of a 404. This sets martini's NotFound handler,
+	// replacing any set before New.
+	MethodNotAllowed bool
+	// Limit how often each client may use the model routes. See RateLimit.
+	RateLimit *RateLimit
+	// Largest request body accepted, in bytes. Larger bodies get 413 Payload
+	// Too Large. Defaults to DefaultMaxBodyBytes (1MiB).
+	MaxBodyBytes int64
+	// Record every change made by the default routes. See Audit.
+	Audit *Audit
+	// Send changes made by the default routes to subscribers. See Webhooks.
+	Webhooks *Webhooks
+	// Deadline for each request. Requests still running get 503 Service
+	// Unavailable. See Request.Context(). Defaults to none.
+	Timeout time.Duration
 }
 
 // RouteOptions can be applied to a single route or to a model. Pass them as
@@ -41,8 +84,8 @@ type RouteOptions struct {
 
 	// Handlers. If present these will be added in the following order. They will all
 	// have access to a Request object containing the database handle, and can modify
-	// this as required
-	Authenticate interface{}     // Use to authenticate. Either a boolean 'true/false', or martini.Handler
+	// this as required. Each may be a Hook instead of a martini.Handler.
+	Authenticate interface{}     // Use to authenticate. Either a boolean 'true/false', an AuthStrategy, a Hook, or martini.Handler
 	Authorize    martini.Handler // Use to authorize (if this can be done on route alone).
 	Query        martini.Handler // Use to edit the db object (eg. add a Where or Preload)
 	// Now the DB query will be carried out.
@@ -52,11 +95,62 @@ type RouteOptions struct {
 	// from gorm, or the edited/deleted object. By default it will be marshalled and sent
 	// back to the user. You can change that behaviour here.
 	EditResult martini.Handler
+
+	// Per action access requirements, eg. Policy{"index": "any", "delete": "role:admin"}.
+	// These override any Policy declared by the model. See Policy.
+	Policy Policy
+
+	// Restrict users to rows they own. See Ownership.
+	Ownership *Ownership
+
+	// Scopes a scoped token or API key must have been granted to use the
+	// route, or 403 insufficient_scope is returned. Unscoped tokens may use
+	// any route. Model routes default to "<plural_camel_name>:read" for index
+	// and get, and "<plural_camel_name>:write" otherwise. Set an empty slice
+	// to require none.
+	RequiredScopes []string
+
+	// Refuse requests from users being impersonated (see AddImpersonationRoute)
+	// with a 403.
+	RefuseImpersonation bool
+
+	// Replaces Options.CORS for the route.
+	CORS *CORS
+
+	// Replaces Options.RateLimit for the route.
+	RateLimit *RateLimit
+
+	// Replaces Options.MaxBodyBytes for the route.
+	MaxBodyBytes int64
+
+	// Replaces Options.Timeout for the route.
+	Timeout time.Duration
+
+	// POST/PATCH only. Reject bodies with unknown fields, duplicate keys or
+	// values of the wrong type with a 422 listing every problem by JSON
+	// pointer, eg. {"errors":{"/items/3/price":"expected number"}}.
+	StrictBody bool
+
+	// POST/PATCH only. Validate bodies against the model's Schema() before
+	// decoding them, with a 422 listing every problem by JSON pointer as for
+	// StrictBody. Required fields may be left out of PATCH bodies.
+	ValidateSchema bool
+
+	// requirement is the effective Policy requirement for the route being added.
+	requirement string
+	// ownerQuery and ownerUpload enforce Ownership. They run before Query and CheckUpload.
+	ownerQuery  martini.Handler
+	ownerUpload martini.Handler
 }
 
 type API interface {
 	// Getters
 	Martini() *martini.ClassicMartini
+	// Handler returns the API as an http.Handler, to be served by
+	// http.ListenAndServe or mounted in any router. Requests must reach it
+	// with their full path, so don't wrap it in http.StripPrefix. It matches
+	// the routes itself; the middleware of the martini instance isn't run.
+	Handler() http.Handler
 	DB() *gorm.DB
 
 	// Add rest routes for model at path. We will add by defult index, GET,
@@ -73,15 +167,115 @@ type API interface {
 
 	// Set the model used for logging in (eg. User). Path will be added as a
 	// POST route to this model, with the LoginModel's AuthenticateJson method
-	// called in the handler to determine if authentication passes.
+	// called in the handler to determine if authentication passes. Users with
+	// two factor authentication on finish logging in at path/verify. A
+	// logged in user can POST a list of scopes to path/scoped for a token
+	// restricted to them (see GetScopedToken), or POST to path/refresh for a
+	// new token.
 	SetAuth(model LoginModel, path string)
 
 	// Get a signed JWT token for user id.
 	GetJWTToken(id uint) string
 
+	// Get a signed JWT token for user id which can only use routes whose
+	// RequiredScopes are all in scopes, eg. "widgets:read".
+	GetScopedToken(id uint, scopes []string) string
+
 	// Returns a middleware handler for authentication.
 	IsAuthenticated() interface{}
 
+	// Returns a middleware handler for authentication by API key. It can be
+	// used as RouteOptions.Authenticate. The key's owner is looked up with the
+	// LoginModel passed to SetAuth.
+	APIKeyAuth() martini.Handler
+
+	// Add routes to manage API keys at path. GET lists keys, POST creates
+	// one, POST path/:id/rotate replaces a key's secret, and DELETE path/:id
+	// revokes it. options are applied as in AddDefaultRoutes. By default only
+	// users with the admin role may use them.
+	AddAPIKeyRoutes(path string, options ...RouteOptions)
+
+	// Add routes for users of a PasswordLoginModel to manage their password.
+	// POST path/change takes old_password and new_password from the logged in
+	// user. POST path/reset_request sends a reset token with
+	// passwords.SendResetToken, and POST path/reset takes the token and
+	// new_password. options apply to the change route.
+	AddPasswordRoutes(path string, passwords *PasswordLoginModel, options ...RouteOptions)
+
+	// Add routes for the logged in user to turn on two factor authentication.
+	// POST path/enroll returns a new TOTP secret, its otpauth_uri and an
+	// enroll_token. POST path/confirm takes the enroll_token and a code from
+	// the authenticator app, turns two factor authentication on and returns
+	// the user's recovery codes. The user must implement TwoFactorModel.
+	AddTwoFactorRoutes(path string, options ...RouteOptions)
+
+	// Add a POST route at path/:id for support staff to impersonate user id.
+	// It returns a token for the user with an "act" claim naming the real
+	// user, who is mapped into the context as an *Impersonator. By default
+	// only users with the admin role may use it. Impersonated users can't
+	// change passwords, two factor settings or mint tokens.
+	AddImpersonationRoute(path string, options ...RouteOptions)
+
+	// Add a GET route at path listing the effective Policy requirement of
+	// every route, for auditing.
+	AddPermissionsRoute(path string, options ...RouteOptions)
+
+	// Add read only routes for the changes recorded by Options.Audit. GET
+	// path lists entries, newest first, filtered by the model, item_id,
+	// actor_id, action, request_id, since and until (RFC 3339) parameters and
+	// paged by limit (default 100) and offset. GET path/:id returns one. By
+	// default only users with the admin role may use them.
+	AddAuditRoutes(path string, options ...RouteOptions)
+
+	// Add routes to manage webhook subscriptions at path. Options.Webhooks
+	// must be set. GET lists subscriptions, POST creates one from a url, an
+	// optional model (eg. "widgets") and optional events (created, updated,
+	// deleted), returning its signing secret. DELETE path/:id removes one,
+	// and GET path/:id/deliveries lists its latest deliveries. By default
+	// only users with the admin role may use them.
+	AddWebhookRoutes(path string, options ...RouteOptions)
+
+	// Returns the permission matrix used by AddPermissionsRoute.
+	Permissions() []Permission
+
+	// Returns a description of every route added so far, in the order they
+	// were added.
+	Routes() []RouteInfo
+
+	// Add a GET route at /api/_routes listing Routes(), as JSON or as a page
+	// for browsers. For development: it isn't added if martini.Env is
+	// martini.Prod.
+	AddRoutesRoute(options ...RouteOptions)
+
+	// Returns an OpenAPI 3.1 document describing every route added so far,
+	// with a schema for each model built from its json tags.
+	OpenAPI() map[string]interface{}
+
+	// Add a GET route at path serving the document returned by OpenAPI(), and
+	// one at path/ui serving a page for reading it.
+	AddOpenAPIRoute(path string, options ...RouteOptions)
+
+	// Returns a JSON Schema (draft 2020-12) for a model, built from its json
+	// tags and the validation options in its api tags: required, readonly,
+	// min=, max=, enum=a|b, format= and pattern= (which must come last), eg.
+	// `api:"required,max=50"`.
+	Schema(modelPtr interface{}) map[string]interface{}
+
+	// Add a GET route at /api/_schema/:name serving the Schema() of the model
+	// whose routes are at /api/:name.
+	AddSchemaRoute(options ...RouteOptions)
+
+	// Returns the source of a Go package named pkg with a typed client for
+	// every model route added so far, eg. client.Widgets.Get(ctx, id), and
+	// for the login routes added by SetAuth. Call it from a program run by
+	// go generate after adding the routes.
+	GoClient(pkg string) ([]byte, error)
+
+	// Returns TypeScript interfaces (for a models.d.ts) for the models used
+	// by the routes added so far, and a fetch based client (for a client.ts
+	// importing them from "./models") with a function for each route.
+	TypeScript() (declarations []byte, client []byte)
+
 	// For debugging - FIXME it's ugly exposing this
 	SleepHandler() martini.Handler
 }
@@ -93,10 +287,26 @@ type NeedsValidation interface {
 }
 
 type apiServer struct {
-	db         *gorm.DB
-	martini    *martini.ClassicMartini
-	loginModel LoginModel
-	options    *Options
+	db          *gorm.DB
+	martini     *martini.ClassicMartini
+	loginModel  LoginModel
+	loginPath   string
+	options     *Options
+	routes      []*route
+	totpReplay  totpReplay
+	mfaThrottle *LoginThrottle     // Options.LoginThrottle, or a default one, so two factor codes are always throttled
+	webhooks    *webhookDispatcher // nil unless Options.Webhooks is set
+}
+
+// route records a route added to martini by the API.
+type route struct {
+	method   string
+	path     string
+	action   string       // One of the ACTION_ constants, or "" for routes not operating on a model.
+	model    reflect.Type // nil for routes not operating on a model.
+	options  RouteOptions
+	implicit bool              // true for the HEAD and OPTIONS routes added by addRoute.
+	handlers []martini.Handler // What Handler() runs for the route. nil for HEAD, which runs the GET route.
 }
 
 //New returns a new API, initialised with martini and db. It
@@ -112,11 +322,27 @@ func New(options Options) API {
 	if options.Db == nil {
 		panic("Can't start API server without a database. Please pass a gorm DB object  (eg. api.New(api.Options{Db: XXX}) )")
 	}
-	api := apiServer{db: options.Db, martini: m, options: &options}
+	api := apiServer{db: options.Db, martini: m, options: &options, mfaThrottle: options.LoginThrottle}
+	if api.mfaThrottle == nil {
+		api.mfaThrottle = &LoginThrottle{}
+	}
+	if options.CORS != nil {
+		options.CORS.check()
+	}
+	registerContextCallbacks(options.Db)
+	if options.Audit != nil {
+		api.ensureAuditTable()
+	}
+	if options.Webhooks != nil {
+		api.webhooks = newWebhookDispatcher(options.Db, *options.Webhooks)
+	}
 
 	api.martini.Use(func(c martini.Context) {
 		c.Map(&api)
 	})
+	if options.MethodNotAllowed {
+		api.martini.NotFound(api.methodNotAllowed)
+	}
 	return &api
 }
 
@@ -145,50 +371,87 @@ const (
 	ROUTE_DELETE = iota
 )
 
+// The action carried out by each default route. These are the keys of a Policy.
+const (
+	ACTION_INDEX  = "index"
+	ACTION_GET    = "get"
+	ACTION_CREATE = "create"
+	ACTION_UPDATE = "update"
+	ACTION_DELETE = "delete"
+)
+
+// prepareOptions returns options with the handlers derived from its settings
+// (eg. Policy and Ownership) for action on modelP filled in.
+func prepareOptions(modelP interface{}, action string, options RouteOptions) RouteOptions {
+	return applyScopes(modelP, action, applyOwnership(modelP, applyPolicy(modelP, action, options)))
+}
+
+// addRoute adds handlers to martini at method and path, and records the route
+// for Handler().
+// CORS headers are added first, if configured, then the Timeout and the body size limit. A new path gets an OPTIONS
+// route.
+func (api *apiServer) addRoute(method string, path string, action string, modelType reflect.Type, options RouteOptions, handlers []martini.Handler) {
+	newPath := len(api.pathMethods(path)) == 0
+	rt := &route{method: method, path: path, action: action, model: modelType, options: options}
+	api.routes = append(api.routes, rt)
+	if limit := api.bodyLimitHandler(method, options); limit != nil {
+		handlers = append([]martini.Handler{limit}, handlers...)
+	}
+	if timeout := api.timeoutHandler(options); timeout != nil {
+		handlers = append([]martini.Handler{timeout}, handlers...)
+	}
+	if cors := api.corsHandler(options); cors != nil && method != "OPTIONS" {
+		handlers = append([]martini.Handler{cors}, handlers...)
+	}
+	rt.handlers = handlers
+	api.martini.AddRoute(method, path, handlers...)
+	api.addImplicitRoutes(method, path, newPath, options)
+}
+
 //Implements API interface for AddIndexRoute()
 func (api *apiServer) AddIndexRoute(modelP interface{}, _options ...RouteOptions) {
-	options := getOptions(_options, ROUTE_READ)
+	options := prepareOptions(modelP, ACTION_INDEX, getOptions(_options, ROUTE_READ))
 	finalPath := makePath(modelP, api.options, options)
 	modelType := reflect.TypeOf(modelP).Elem()
 	sliceType := reflect.SliceOf(modelType)
 	log.WithFields(log.Fields{"Model": modelType, "path": finalPath}).Info("Adding INDEX route")
-	api.martini.Get(finalPath, api.indexHandlers(sliceType, options)...)
+	api.addRoute("GET", finalPath, ACTION_INDEX, modelType, options, api.indexHandlers(sliceType, options))
 }
 
 //Implements API interface for AddGetRoute()
 func (api *apiServer) AddGetRoute(modelP interface{}, _options ...RouteOptions) {
-	options := getOptions(_options, ROUTE_READ)
+	options := prepareOptions(modelP, ACTION_GET, getOptions(_options, ROUTE_READ))
 	finalPath := makePath(modelP, api.options, options) + "/:id"
 	modelType := reflect.TypeOf(modelP).Elem()
 	log.WithFields(log.Fields{"Model": modelType, "path": finalPath}).Info("Adding GET route")
-	api.martini.Get(finalPath, api.itemHandlers(modelType, options)...)
+	api.addRoute("GET", finalPath, ACTION_GET, modelType, options, api.itemHandlers(modelType, options))
 }
 
 //Implements API interface for AddPostRoute()
 func (api *apiServer) AddPostRoute(modelP interface{}, _options ...RouteOptions) {
-	options := getOptions(_options, ROUTE_WRITE)
+	options := prepareOptions(modelP, ACTION_CREATE, getOptions(_options, ROUTE_WRITE))
 	finalPath := makePath(modelP, api.options, options)
 	modelType := reflect.TypeOf(modelP).Elem()
 	log.WithFields(log.Fields{"Model": modelType, "path": finalPath}).Info("Adding POST route")
-	api.martini.Post(finalPath, api.postHandlers(modelType, options)...)
+	api.addRoute("POST", finalPath, ACTION_CREATE, modelType, options, api.postHandlers(modelType, options))
 }
 
 //Implements API interface for AddPatchRoute()
 func (api *apiServer) AddPatchRoute(modelP interface{}, _options ...RouteOptions) {
-	options := getOptions(_options, ROUTE_WRITE)
+	options := prepareOptions(modelP, ACTION_UPDATE, getOptions(_options, ROUTE_WRITE))
 	finalPath := makePath(modelP, api.options, options) + "/:id"
 	modelType := reflect.TypeOf(modelP).Elem()
 	log.WithFields(log.Fields{"Model": modelType, "path": finalPath}).Info("Adding PATCH route")
-	api.martini.Patch(finalPath, api.patchHandlers(modelType, options)...)
+	api.addRoute("PATCH", finalPath, ACTION_UPDATE, modelType, options, api.patchHandlers(modelType, options))
 }
 
 //Implements API interface for AddDeleteRoute()
 func (api *apiServer) AddDeleteRoute(modelP interface{}, _options ...RouteOptions) {
-	options := getOptions(_options, ROUTE_DELETE)
+	options := prepareOptions(modelP, ACTION_DELETE, getOptions(_options, ROUTE_DELETE))
 	finalPath := makePath(modelP, api.options, options) + "/:id"
 	modelType := reflect.TypeOf(modelP).Elem()
 	log.WithFields(log.Fields{"Model": modelType, "path": finalPath}).Info("Adding DELETE route")
-	api.martini.Delete(finalPath, api.deleteHandlers(modelType, options)...)
+	api.addRoute("DELETE", finalPath, ACTION_DELETE, modelType, options, api.deleteHandlers(modelType, options))
 }
 
 //Implements API interface for SetAuth()
@@ -197,8 +460,12 @@ func (api *apiServer) SetAuth(model LoginModel, path string) {
 		panic("Can't do authorisation safely unless you provide a random secret string as JwtKey parameter of api.New()")
 	}
 	api.loginModel = model
+	api.loginPath = path
 
-	api.martini.Post(path, ParseJsonBody, api.getLoginHandler())
+	api.addRoute("POST", path, "", nil, RouteOptions{}, []martini.Handler{ParseJsonBody, api.getLoginHandler()})
+	api.addRoute("POST", path+"/verify", "", nil, RouteOptions{}, []martini.Handler{ParseJsonBody, api.getVerifyHandler()})
+	api.addRoute("POST", path+"/scoped", "", nil, RouteOptions{Authenticate: true}, []martini.Handler{api.IsAuthenticated(), impersonationHandler(true), ParseJsonBody, api.getScopedTokenHandler()})
+	api.addRoute("POST", path+"/refresh", "", nil, RouteOptions{Authenticate: true}, []martini.Handler{api.IsAuthenticated(), impersonationHandler(true), api.getRefreshHandler()})
 }
 
 // Extract options from slice
@@ -227,15 +494,19 @@ func getOptions(options []RouteOptions, routeType int) RouteOptions {
 	panic("unknown route type")
 }
 
+// uriPrefix returns the path all model routes start with.
+func uriPrefix(apiOptions *Options) string {
+	if len(apiOptions.UriPrefix) != 0 {
+		return "/" + apiOptions.UriPrefix
+	}
+	return "/api"
+}
+
 // makePath returns the path for the item, modidified as required by any options.
 func makePath(modelP interface{}, apiOptions *Options, routeOptions RouteOptions) string {
 	path := routeOptions.UriModelName
-	prefix := "/api"
-	if len(apiOptions.UriPrefix) != 0 {
-		prefix = "/" + apiOptions.UriPrefix
-	}
 	if len(path) == 0 {
 		path = pluralCamelName(modelP)
 	}
-	return prefix + routeOptions.Prefix + "/" + path
+	return uriPrefix(apiOptions) + routeOptions.Prefix + "/" + path
 }
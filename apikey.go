@@ -0,0 +1,298 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-martini/martini"
+)
+
+// APIKey is a long lived credential for service to service calls. Only a
+// sha256 hash of the key is stored, so the plaintext key is returned exactly
+// once, when it is created or rotated. Keys are stored in the api_keys table.
+type APIKey struct {
+	ID        uint       `gorm:"primary_key" json:"id"`
+	OwnerID   uint       `json:"owner_id"`                     // id of the LoginModel this key authenticates as
+	Tenant    string     `json:"tenant,omitempty" sql:"index"` // tenant the key was created for, if Options.Tenancy is set
+	Name      string     `json:"name"`
+	Prefix    string     `json:"prefix"` // first few characters of the key, to help identify it
+	Hash      string     `json:"-" sql:"unique_index"`
+	Scopes    string     `json:"scopes"` // space separated list of scopes
+	ExpiresAt *time.Time `json:"expires_at"`
+	RevokedAt *time.Time `json:"revoked_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// apiKeyPrefixLength is the number of characters of the key stored in clear.
+const apiKeyPrefixLength = 8
+
+// ScopeList returns the scopes of the key as a slice.
+func (k *APIKey) ScopeList() []string {
+	return strings.Fields(k.Scopes)
+}
+
+// HasScope returns true if the key was granted scope.
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.ScopeList() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Valid returns false if the key has been revoked or has expired.
+func (k *APIKey) Valid() bool {
+	if k.RevokedAt != nil {
+		return false
+	}
+	return k.ExpiresAt == nil || k.ExpiresAt.After(time.Now())
+}
+
+// apiKeyUpload is the body accepted when creating a key.
+type apiKeyUpload struct {
+	OwnerID   uint       `json:"owner_id"`
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// apiKeyResult is returned when a key is created or rotated. It is the only
+// time the plaintext key is available.
+type apiKeyResult struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+// hashAPIKey returns the hex encoded sha256 hash of key. Keys are random and
+// long, so a fast hash is sufficient.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIKeySecret returns a new random key.
+func newAPIKeySecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// setSecret generates a new secret for k, storing its hash and prefix, and
+// returns the plaintext key.
+func (k *APIKey) setSecret() (string, error) {
+	key, err := newAPIKeySecret()
+	if err != nil {
+		return "", err
+	}
+	k.Prefix = key[:apiKeyPrefixLength]
+	k.Hash = hashAPIKey(key)
+	return key, nil
+}
+
+// ensureAPIKeyTable creates the api_keys table if it doesn't exist.
+func (api *apiServer) ensureAPIKeyTable() {
+	if err := api.db.AutoMigrate(&APIKey{}).Error; err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Can't create api_keys table")
+	}
+}
+
+// apiKeyHeader returns the header holding API keys. Defaults to X-API-Key.
+func (api *apiServer) apiKeyHeader() string {
+	if api.options.APIKeyHeader == "" {
+		return "X-API-Key"
+	}
+	return api.options.APIKeyHeader
+}
+
+// apiKeyFromRequest returns the key passed in the request header, or failing
+// that in the query string.
+func (api *apiServer) apiKeyFromRequest(r *http.Request) string {
+	header := api.apiKeyHeader()
+	param := api.options.APIKeyParam
+	if param == "" {
+		param = "api_key"
+	}
+	if key := r.Header.Get(header); key != "" {
+		return key
+	}
+	return r.URL.Query().Get(param)
+}
+
+// findAPIKey looks up a valid key by its plaintext value.
+func (api *apiServer) findAPIKey(key string) (*APIKey, error) {
+	apiKey := APIKey{}
+	if key == "" {
+		return nil, fmt.Errorf("No API key in request")
+	}
+	if api.db.Where("hash = ?", hashAPIKey(key)).Find(&apiKey).RecordNotFound() {
+		return nil, fmt.Errorf("Unknown API key")
+	}
+	if !apiKey.Valid() {
+		return nil, fmt.Errorf("API key revoked or expired")
+	}
+	return &apiKey, nil
+}
+
+// APIKeyAuth returns a middleware handler which can be used as
+// RouteOptions.Authenticate. It reads an API key from the request, and either
+// returns a 401 Unauthorized, or continues after mapping the key's owner (as
+// LoginModel) and the *APIKey into the request context.
+func (api *apiServer) APIKeyAuth() martini.Handler {
+	api.ensureAPIKeyTable()
+	return AnyOf(APIKeyStrategy())
+}
+
+// AddAPIKeyRoutes implements API interface for AddAPIKeyRoutes()
+func (api *apiServer) AddAPIKeyRoutes(path string, options ...RouteOptions) {
+	api.ensureAPIKeyTable()
+	readOptions := adminOptions(withScopes(applyPolicy(nil, ACTION_INDEX, getOptions(options, ROUTE_READ)), "api_keys:read"))
+	createOptions := adminOptions(withScopes(applyPolicy(nil, ACTION_CREATE, getOptions(options, ROUTE_WRITE)), "api_keys:write"))
+	writeOptions := adminOptions(withScopes(applyPolicy(nil, ACTION_UPDATE, getOptions(options, ROUTE_WRITE)), "api_keys:write"))
+	deleteOptions := adminOptions(withScopes(applyPolicy(nil, ACTION_DELETE, getOptions(options, ROUTE_DELETE)), "api_keys:write"))
+	log.WithFields(log.Fields{"path": path}).Info("Adding API key routes")
+
+	api.addRoute("GET", path, "", nil, readOptions, api.handlerList(
+		api.bindRequestHandler("GET", nil),
+		api.ownTenantHandler(),
+		api.getAuthenticateHandler(readOptions.Authenticate),
+		scopeHandler(readOptions.RequiredScopes),
+		api.impersonationStep(readOptions),
+		api.tenantMemberStep(readOptions),
+		requirementHandler(readOptions.requirement),
+		readOptions.Authorize,
+		readOptions.Query,
+		func(req *Request) {
+			keys := []APIKey{}
+			req.DB.Order("id").Find(&keys)
+			req.Result = &keys
+		},
+		readOptions.EditResult,
+		sendResult))
+
+	api.addRoute("POST", path, "", nil, createOptions, api.handlerList(
+		api.bindRequestHandler("POST", nil),
+		api.ownTenantHandler(),
+		api.getAuthenticateHandler(createOptions.Authenticate),
+		scopeHandler(createOptions.RequiredScopes),
+		api.impersonationStep(createOptions),
+		api.tenantMemberStep(createOptions),
+		requirementHandler(createOptions.requirement),
+		createOptions.Authorize,
+		parseAPIKeyUpload,
+		createOptions.CheckUpload,
+		api.createAPIKeyHandler(),
+		createOptions.EditResult,
+		sendResult))
+
+	api.addRoute("POST", path+"/:id/rotate", "", nil, writeOptions, api.handlerList(
+		api.bindRequestHandler("POST", nil),
+		api.ownTenantHandler(),
+		api.getAuthenticateHandler(writeOptions.Authenticate),
+		scopeHandler(writeOptions.RequiredScopes),
+		api.impersonationStep(writeOptions),
+		api.tenantMemberStep(writeOptions),
+		requirementHandler(writeOptions.requirement),
+		writeOptions.Authorize,
+		writeOptions.Query,
+		getItemHandler(reflect.TypeOf(APIKey{})),
+		api.rotateAPIKeyHandler(),
+		writeOptions.EditResult,
+		sendResult))
+
+	api.addRoute("DELETE", path+"/:id", "", nil, deleteOptions, api.handlerList(
+		api.bindRequestHandler("DELETE", nil),
+		api.ownTenantHandler(),
+		api.getAuthenticateHandler(deleteOptions.Authenticate),
+		scopeHandler(deleteOptions.RequiredScopes),
+		api.impersonationStep(deleteOptions),
+		api.tenantMemberStep(deleteOptions),
+		requirementHandler(deleteOptions.requirement),
+		deleteOptions.Authorize,
+		deleteOptions.Query,
+		getItemHandler(reflect.TypeOf(APIKey{})),
+		api.revokeAPIKeyHandler(),
+		deleteOptions.EditResult,
+		sendResult))
+}
+
+// parseAPIKeyUpload binds the body of a create request to req.Uploaded.
+func parseAPIKeyUpload(req *Request, w http.ResponseWriter, r *http.Request, c martini.Context) {
+	upload := apiKeyUpload{}
+	if !decodeBody(w, r, c, &upload) {
+		return
+	}
+	if upload.OwnerID == 0 {
+		w.WriteHeader(422)
+		w.Write([]byte(`{"errors":{"owner_id":"is required"}}`))
+		return
+	}
+	req.Uploaded = &upload
+}
+
+// createAPIKeyHandler stores a new key for the uploaded owner.
+func (api *apiServer) createAPIKeyHandler() martini.Handler {
+	return func(req *Request, w http.ResponseWriter) {
+		upload := req.Uploaded.(*apiKeyUpload)
+		apiKey := APIKey{OwnerID: upload.OwnerID, Tenant: req.Tenant, Name: upload.Name,
+			Scopes: strings.Join(upload.Scopes, " "), ExpiresAt: upload.ExpiresAt}
+		key, err := apiKey.setSecret()
+		if err == nil {
+			err = api.db.Create(&apiKey).Error
+		}
+		if err != nil {
+			log.Warn("Error creating API key: ", err)
+			w.WriteHeader(500)
+			return
+		}
+		req.Result = &apiKeyResult{APIKey: apiKey, Key: key}
+	}
+}
+
+// rotateAPIKeyHandler replaces the secret of the key at req.Result. The old
+// key stops working immediately.
+func (api *apiServer) rotateAPIKeyHandler() martini.Handler {
+	return func(req *Request, w http.ResponseWriter) {
+		apiKey := req.Result.(*APIKey)
+		if apiKey.RevokedAt != nil {
+			w.WriteHeader(409)
+			w.Write([]byte(`{"error":"API key has been revoked"}`))
+			return
+		}
+		key, err := apiKey.setSecret()
+		if err == nil {
+			err = api.db.Save(apiKey).Error
+		}
+		if err != nil {
+			log.Warn("Error rotating API key: ", err)
+			w.WriteHeader(500)
+			return
+		}
+		req.Result = &apiKeyResult{APIKey: *apiKey, Key: key}
+	}
+}
+
+// revokeAPIKeyHandler marks the key at req.Result as revoked. Revoked keys are
+// kept so they remain visible in the list.
+func (api *apiServer) revokeAPIKeyHandler() martini.Handler {
+	return func(req *Request, w http.ResponseWriter) {
+		apiKey := req.Result.(*APIKey)
+		if apiKey.RevokedAt == nil {
+			now := time.Now()
+			apiKey.RevokedAt = &now
+			if err := api.db.Save(apiKey).Error; err != nil {
+				log.Warn("Error revoking API key: ", err)
+				w.WriteHeader(500)
+			}
+		}
+	}
+}
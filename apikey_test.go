@@ -0,0 +1,49 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// Create, use, list, rotate and revoke an API key.
+func TestAPIKeyAuth(t *testing.T) {
+	a := getTestApi()
+	a.AddAPIKeyRoutes("/api/api_keys")
+	a.AddIndexRoute(&Widget{}, RouteOptions{UriModelName: "apikey_widgets", Authenticate: a.APIKeyAuth()})
+
+	testReq(t, "CreateKey(No token)", "POST", "/api/api_keys", `{"owner_id":1,"name":"batch"}`, 401)
+	adminq := "?access_token=" + getToken(testReq(t, "Login(admin)", "POST", "/auth", `{"name": "admin", "password": "password"}`, 200))
+
+	testReq(t, "CreateKey(No owner)", "POST", "/api/api_keys"+adminq, `{"name":"batch"}`, 422)
+	body := testReq(t, "CreateKey", "POST", "/api/api_keys"+adminq, `{"owner_id":1,"name":"batch","scopes":["widgets:read"]}`, 200)
+	created := apiKeyResult{}
+	json.Unmarshal([]byte(body), &created)
+	if len(created.Key) == 0 || created.Prefix != created.Key[:apiKeyPrefixLength] || !created.HasScope("widgets:read") {
+		t.Errorf("Didn't receive a new API key: %s", body)
+	}
+
+	testReq(t, "APIKey(No key)", "GET", "/api/apikey_widgets", "", 401)
+	testReq(t, "APIKey(Wrong key)", "GET", "/api/apikey_widgets?api_key=PleaseLetMeIn", "", 401)
+	testReq(t, "APIKey(Valid key)", "GET", "/api/apikey_widgets?api_key="+created.Key, "", 200)
+
+	list := testReq(t, "ListKeys", "GET", "/api/api_keys"+adminq, "", 200)
+	var keys []map[string]interface{}
+	json.Unmarshal([]byte(list), &keys)
+	for _, k := range keys {
+		if _, ok := k["hash"]; ok {
+			t.Errorf("Key list exposes key hash: %s", list)
+		}
+	}
+
+	body = testReq(t, "RotateKey", "POST", fmt.Sprintf("/api/api_keys/%d/rotate%s", created.ID, adminq), "", 200)
+	rotated := apiKeyResult{}
+	json.Unmarshal([]byte(body), &rotated)
+	testReq(t, "APIKey(Rotated old key)", "GET", "/api/apikey_widgets?api_key="+created.Key, "", 401)
+	testReq(t, "APIKey(Rotated new key)", "GET", "/api/apikey_widgets?api_key="+rotated.Key, "", 200)
+
+	testReq(t, "RevokeKey", "DELETE", fmt.Sprintf("/api/api_keys/%d%s", created.ID, adminq), "", 200)
+	testReq(t, "APIKey(Revoked key)", "GET", "/api/apikey_widgets?api_key="+rotated.Key, "", 401)
+	testReq(t, "RotateKey(Revoked)", "POST", fmt.Sprintf("/api/api_keys/%d/rotate%s", created.ID, adminq), "", 409)
+	testReq(t, "RevokeKey(Doesn't exist)", "DELETE", "/api/api_keys/4242"+adminq, "", 404)
+}
@@ -0,0 +1,296 @@
+package api
+
+import (
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-martini/martini"
+	"github.com/jinzhu/gorm"
+)
+
+// Audit records every create, update and delete made by the default model
+// routes in the audit_entries table, in the same transaction as the change.
+// Set Options.Audit to turn it on, and use AddAuditRoutes to read it.
+type Audit struct {
+	// Header holding the id of the request, eg. as set by a load balancer.
+	// If it's missing a random id is used, and returned in the same header.
+	// Defaults to X-Request-ID.
+	RequestIDHeader string
+	// json names of fields whose values aren't recorded, eg. "password".
+	// Changes to them are recorded as "[redacted]". Fields tagged json:"-"
+	// are never recorded.
+	Redact []string
+}
+
+// AuditEntry is one change recorded by Audit.
+type AuditEntry struct {
+	ID             uint         `gorm:"primary_key" json:"id"`
+	ActorID        uint         `json:"actor_id" sql:"index"`         // id of the logged in user, or 0
+	ImpersonatorID uint         `json:"impersonator_id,omitempty"`    // id of the real user, if the actor was impersonated
+	Tenant         string       `json:"tenant,omitempty" sql:"index"` // tenant of the request, if Options.Tenancy is set
+	Model          string       `json:"model" sql:"index"`            // plural camel name, eg. "user_types"
+	ItemID         string       `json:"item_id" sql:"index"`
+	Action         string       `json:"action"` // ACTION_CREATE, ACTION_UPDATE or ACTION_DELETE
+	Changes        AuditChanges `json:"changes" sql:"type:text"`
+	ClientIP       string       `json:"client_ip"`
+	RequestID      string       `json:"request_id" sql:"index"`
+	CreatedAt      time.Time    `json:"created_at" sql:"index"`
+}
+
+// AuditChange is the value of a field before and after a change. Before is
+// nil for a create, and After for a delete.
+type AuditChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// AuditChanges are the fields changed by a write, by json name. They are
+// stored as JSON.
+type AuditChanges map[string]AuditChange
+
+// Value implements driver.Valuer.
+func (c AuditChanges) Value() (driver.Value, error) {
+	j, err := json.Marshal(c)
+	return string(j), err
+}
+
+// Scan implements sql.Scanner.
+func (c *AuditChanges) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*c = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, c)
+	case string:
+		return json.Unmarshal([]byte(v), c)
+	}
+	return fmt.Errorf("Can't scan %T into AuditChanges", value)
+}
+
+// auditRedacted replaces the values of Audit.Redact fields.
+const auditRedacted = "[redacted]"
+
+// auditFields returns the fields of item by json name, or nil for nil.
+func auditFields(item interface{}) map[string]interface{} {
+	if item == nil {
+		return nil
+	}
+	fields := map[string]interface{}{}
+	j, _ := json.Marshal(item)
+	json.Unmarshal(j, &fields)
+	return fields
+}
+
+// changes returns the fields which differ between before and after, either
+// of which may be nil.
+func (a *Audit) changes(before interface{}, after interface{}) AuditChanges {
+	b, f := auditFields(before), auditFields(after)
+	changes := AuditChanges{}
+	add := func(name string) {
+		if _, ok := changes[name]; ok || reflect.DeepEqual(b[name], f[name]) {
+			return
+		}
+		change := AuditChange{Before: b[name], After: f[name]}
+		for _, r := range a.Redact {
+			if r == name {
+				change = AuditChange{Before: redact(change.Before), After: redact(change.After)}
+			}
+		}
+		changes[name] = change
+	}
+	for name := range b {
+		add(name)
+	}
+	for name := range f {
+		add(name)
+	}
+	return changes
+}
+
+// redact returns auditRedacted, or nil for nil.
+func redact(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	return auditRedacted
+}
+
+// requestIDHeader returns Audit.RequestIDHeader, or its default.
+func (a *Audit) requestIDHeader() string {
+	if a.RequestIDHeader == "" {
+		return "X-Request-ID"
+	}
+	return a.RequestIDHeader
+}
+
+// requestID returns the id of request r, making one up and returning it in
+// the response header if there isn't one.
+func (a *Audit) requestID(w http.ResponseWriter, r *http.Request) string {
+	header := a.requestIDHeader()
+	if id := r.Header.Get(header); id != "" {
+		return id
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	id := hex.EncodeToString(b)
+	w.Header().Set(header, id)
+	return id
+}
+
+// ensureAuditTable creates the audit_entries table if it doesn't exist.
+func (api *apiServer) ensureAuditTable() {
+	if err := api.db.AutoMigrate(&AuditEntry{}).Error; err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Can't create audit_entries table")
+	}
+}
+
+// auditedWrite makes a change to the database with write. If Options.Audit
+// is set an AuditEntry for it is created in the same transaction, and
+// neither is kept if either fails. before is the item before the change, and
+// after the item afterwards, or nil for a create and delete respectively.
+func (api *apiServer) auditedWrite(req *Request, w http.ResponseWriter, r *http.Request, c martini.Context, action string, before interface{}, after interface{}, write func(db *gorm.DB) *gorm.DB) error {
+	db := withContext(api.db, req.Context())
+	audit := api.options.Audit
+	if audit == nil {
+		return write(db).Error
+	}
+	tx := db.Begin()
+	if err := write(tx).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	item := after
+	if item == nil {
+		item = before
+	}
+	id, _ := getID(item)
+	entry := AuditEntry{Model: pluralCamelName(item), ItemID: fmt.Sprint(id), Action: action, Tenant: req.Tenant,
+		Changes: audit.changes(before, after), ClientIP: clientIP(r), RequestID: audit.requestID(w, r)}
+	if user := c.Get(loginModelType); user.IsValid() {
+		entry.ActorID, _ = userID(user.Interface())
+	}
+	if req.Impersonator != nil {
+		entry.ImpersonatorID = req.Impersonator.ID
+	}
+	if err := tx.Create(&entry).Error; err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Can't create audit entry")
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// writeFailed writes the response for an error from commitWrite.
+func writeFailed(w http.ResponseWriter, r *http.Request, req *Request, err error) {
+	if writeCancelled(w, r, req.Context().Err()) {
+		return
+	}
+	log.WithFields(log.Fields{"error": err}).Warn("Database write failed")
+	writeJSONError(w, 500, "Internal Server Error")
+}
+
+// auditQuery scopes db to the entries matching the query string of r, or
+// returns an error for a bad parameter.
+func auditQuery(db *gorm.DB, r *http.Request) (*gorm.DB, error) {
+	q := r.URL.Query()
+	for _, p := range []string{"model", "item_id", "action", "request_id"} {
+		if v := q.Get(p); v != "" {
+			db = db.Where(p+" = ?", v)
+		}
+	}
+	if v := q.Get("actor_id"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("actor_id must be a number")
+		}
+		db = db.Where("actor_id = ?", id)
+	}
+	for p, op := range map[string]string{"since": ">=", "until": "<"} {
+		if v := q.Get(p); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be an RFC 3339 time", p)
+			}
+			db = db.Where("created_at "+op+" ?", t)
+		}
+	}
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			return nil, fmt.Errorf("limit must be from 1 to 1000")
+		}
+		limit = n
+	}
+	offset := 0
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("offset must be a number")
+		}
+		offset = n
+	}
+	return db.Order("id desc").Limit(limit).Offset(offset), nil
+}
+
+// AddAuditRoutes implements API interface for AddAuditRoutes().
+func (api *apiServer) AddAuditRoutes(path string, options ...RouteOptions) {
+	api.ensureAuditTable()
+	readOptions := adminOptions(withScopes(applyPolicy(nil, ACTION_INDEX, getOptions(options, ROUTE_READ)), "audit:read"))
+	log.WithFields(log.Fields{"path": path}).Info("Adding audit routes")
+
+	api.addRoute("GET", path, "", nil, readOptions, api.handlerList(
+		api.bindRequestHandler("GET", nil),
+		api.ownTenantHandler(),
+		api.getAuthenticateHandler(readOptions.Authenticate),
+		scopeHandler(readOptions.RequiredScopes),
+		api.impersonationStep(readOptions),
+		api.tenantMemberStep(readOptions),
+		requirementHandler(readOptions.requirement),
+		readOptions.Authorize,
+		readOptions.Query,
+		func(req *Request, w http.ResponseWriter, r *http.Request) {
+			db, err := auditQuery(req.DB, r)
+			if err != nil {
+				writeJSONError(w, 400, err.Error())
+				return
+			}
+			entries := []AuditEntry{}
+			if err := db.Find(&entries).Error; err != nil {
+				if writeCancelled(w, r, req.Context().Err()) {
+					return
+				}
+				log.WithFields(log.Fields{"error": err}).Error("Can't read audit log")
+				writeJSONError(w, 500, "Internal Server Error")
+				return
+			}
+			req.Result = &entries
+		},
+		readOptions.EditResult,
+		sendResult))
+
+	api.addRoute("GET", path+"/:id", "", nil, readOptions, api.handlerList(
+		api.bindRequestHandler("GET", nil),
+		api.ownTenantHandler(),
+		api.getAuthenticateHandler(readOptions.Authenticate),
+		scopeHandler(readOptions.RequiredScopes),
+		api.impersonationStep(readOptions),
+		api.tenantMemberStep(readOptions),
+		requirementHandler(readOptions.requirement),
+		readOptions.Authorize,
+		readOptions.Query,
+		getItemHandler(reflect.TypeOf(AuditEntry{})),
+		readOptions.EditResult,
+		sendResult))
+}
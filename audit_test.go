@@ -0,0 +1,126 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+type AuditWidget struct {
+	ID     uint    `gorm:"primary_key" json:"id"`
+	Name   string  `json:"name"`
+	Secret string  `json:"secret"`
+	Note   string  `json:"-"`
+	Colour *string `json:"colour"`
+}
+
+func TestAuditChanges(t *testing.T) {
+	audit := &Audit{Redact: []string{"secret"}}
+	before := &AuditWidget{ID: 1, Name: "Old", Secret: "a", Note: "x"}
+	after := &AuditWidget{ID: 1, Name: "New", Secret: "b", Note: "y"}
+	for _, c := range []struct {
+		name          string
+		before, after interface{}
+		expected      AuditChanges
+	}{
+		{"create", nil, after, AuditChanges{
+			"id":     {nil, float64(1)},
+			"name":   {nil, "New"},
+			"secret": {nil, auditRedacted},
+		}},
+		{"update", before, after, AuditChanges{
+			"name":   {"Old", "New"},
+			"secret": {auditRedacted, auditRedacted},
+		}},
+		{"unchanged", before, before, AuditChanges{}},
+		{"delete", before, nil, AuditChanges{
+			"id":     {float64(1), nil},
+			"name":   {"Old", nil},
+			"secret": {auditRedacted, nil},
+		}},
+	} {
+		if changes := audit.changes(c.before, c.after); !reflect.DeepEqual(changes, c.expected) {
+			t.Errorf("%s: expected changes %v, got %v", c.name, c.expected, changes)
+		}
+	}
+}
+
+func TestAuditChangesScan(t *testing.T) {
+	changes := AuditChanges{"name": {"Old", "New"}}
+	v, err := changes.Value()
+	if err != nil {
+		t.Fatalf("Value() failed: %v", err)
+	}
+	for _, stored := range []interface{}{v, []byte(v.(string))} {
+		scanned := AuditChanges{}
+		if err := scanned.Scan(stored); err != nil || !reflect.DeepEqual(scanned, changes) {
+			t.Errorf("Scan(%T) should return %v, got %v (%v)", stored, changes, scanned, err)
+		}
+	}
+	if err := (&AuditChanges{}).Scan(42); err == nil {
+		t.Errorf("Scan of an int should fail")
+	}
+}
+
+func TestAudit(t *testing.T) {
+	db := getTestDb()
+	db.DropTable(&AuditEntry{})
+	db.DropTable(&AuditWidget{})
+	db.CreateTable(&AuditWidget{})
+	a := New(Options{JwtKey: "RandomString", Db: db, Martini: getSilentMartini(), Audit: &Audit{Redact: []string{"secret"}}})
+	a.SetAuth(&User{}, "/auth")
+	a.AddDefaultRoutes(&AuditWidget{}, RouteOptions{Authenticate: true})
+	a.AddAuditRoutes("/api/audit")
+
+	admin := User{}
+	db.Where("name = ?", "admin").First(&admin)
+	reader := User{Name: "audit_reader", Password: "password"}
+	db.Create(&reader)
+	defer db.Delete(&reader)
+	login := func(name string) string {
+		body := testApiReq(t, a, "Login("+name+")", "POST", "/auth", fmt.Sprintf(`{"name": %q, "password": "password"}`, name), nil, 200).Body.String()
+		return "?access_token=" + getToken(body)
+	}
+	adminq, readerq := login("admin"), login("audit_reader")
+
+	body := testApiReq(t, a, "Audit(POST)", "POST", "/api/audit_widgets"+adminq, `{"name":"One","secret":"shh","colour":"red"}`, map[string]string{"X-Request-ID": "req-1"}, 200).Body.String()
+	widget := AuditWidget{}
+	json.Unmarshal([]byte(body), &widget)
+	item := fmt.Sprintf("/api/audit_widgets/%d", widget.ID)
+	patch := testApiReq(t, a, "Audit(PATCH)", "PATCH", item+adminq, `{"name":"Two","colour":"blue"}`, nil, 200)
+	if patch.Header().Get("X-Request-ID") == "" {
+		t.Errorf("Expected a request id to be made up and returned")
+	}
+	testApiReq(t, a, "Audit(DELETE)", "DELETE", item+adminq, "", nil, 200)
+
+	testApiReq(t, a, "Audit(No token)", "GET", "/api/audit", "", nil, 401)
+	testApiReq(t, a, "Audit(Not admin)", "GET", "/api/audit"+readerq, "", nil, 403)
+	testApiReq(t, a, "Audit(Bad since)", "GET", "/api/audit"+adminq+"&since=yesterday", "", nil, 400)
+
+	entries := []AuditEntry{}
+	body = testApiReq(t, a, "Audit(Index)", "GET", "/api/audit"+adminq+"&model=audit_widgets", "", nil, 200).Body.String()
+	json.Unmarshal([]byte(body), &entries)
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 audit entries, got %s", body)
+	}
+	for i, action := range []string{ACTION_DELETE, ACTION_UPDATE, ACTION_CREATE} {
+		e := entries[i]
+		if e.Action != action || e.ActorID != admin.ID || e.ItemID != fmt.Sprint(widget.ID) || e.ClientIP != "192.0.2.1" {
+			t.Errorf("Unexpected %s audit entry %+v", action, e)
+		}
+	}
+	if entries[2].RequestID != "req-1" || entries[2].Changes["secret"].After != auditRedacted {
+		t.Errorf("Unexpected create entry %+v", entries[2])
+	}
+	if !reflect.DeepEqual(entries[1].Changes, AuditChanges{"name": {"One", "Two"}, "colour": {"red", "blue"}}) {
+		t.Errorf("Update entry should only record the name and colour changes: %v", entries[1].Changes)
+	}
+
+	body = testApiReq(t, a, "Audit(Filtered)", "GET", "/api/audit"+adminq+"&action=create&limit=1", "", nil, 200).Body.String()
+	json.Unmarshal([]byte(body), &entries)
+	if len(entries) != 1 || entries[0].Action != ACTION_CREATE {
+		t.Errorf("Expected the create entry, got %s", body)
+	}
+	testApiReq(t, a, "Audit(GET)", "GET", fmt.Sprintf("/api/audit/%d%s", entries[0].ID, adminq), "", nil, 200)
+}
@@ -1,8 +1,11 @@
 package api
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"reflect"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -18,71 +21,181 @@ type LoginModel interface {
 	GetById(id uint) (interface{}, error)
 }
 
+// errLoginThrottled is returned by checkLogin while a username or client IP
+// is locked out by Options.LoginThrottle.
+var errLoginThrottled = errors.New("Too many failed logins")
+
+// checkLogin checks login details with the LoginModel. If
+// Options.LoginThrottle is set, failures are throttled per username and per
+// client IP, and errLoginThrottled is returned while either is locked out.
+func (api *apiServer) checkLogin(details map[string]interface{}, username string, ip string) (uint, error) {
+	throttle := api.options.LoginThrottle
+	if throttle != nil && throttle.retryAfter(username, ip) > 0 {
+		return 0, errLoginThrottled
+	}
+	user_id, err := api.loginModel.CheckLoginDetails(&details)
+	if throttle != nil {
+		if err != nil {
+			throttle.recordFailure(username, ip)
+		} else {
+			throttle.recordSuccess(username)
+		}
+	}
+	return user_id, err
+}
+
 // getLoginHandler() returns the handler function to respond to the login request.
 // The handler defers checking the logindetails to loginModel's CheckLoginDetails.
-// On success we create a JWT web token using user_id
-func (api *apiServer) getLoginHandler() func(*JsonBody, http.ResponseWriter, martini.Context) []byte {
-	return func(j *JsonBody, w http.ResponseWriter, c martini.Context) []byte {
+// On success we create a JWT web token using user_id, or an mfa_token if the
+// user has two factor authentication on (see TwoFactorModel). If
+// Options.LoginThrottle is set, failed logins are throttled per username and
+// per client IP.
+func (api *apiServer) getLoginHandler() func(*JsonBody, http.ResponseWriter, *http.Request, martini.Context) []byte {
+	throttle := api.options.LoginThrottle
+	return func(j *JsonBody, w http.ResponseWriter, r *http.Request, c martini.Context) []byte {
 		msi := map[string]interface{}(*j)
-		user_id, err := api.loginModel.CheckLoginDetails(&msi)
+		username, ip := "", clientIP(r)
+		if throttle != nil {
+			throttle.init()
+			username, _ = msi[throttle.UsernameField].(string)
+			if throttle.throttled(w, username, ip) {
+				return nil
+			}
+		}
+		user_id, err := api.checkLogin(msi, username, ip)
 		if err != nil {
 			log.Println("Login failed", err)
 			w.WriteHeader(403)
 			return []byte("Login failed")
 		} else {
 			log.Println("Logged in user", user_id)
+			if _, ok := api.twoFactorUser(user_id); ok {
+				mfaToken := api.signToken(map[string]interface{}{"id": user_id, "mfa": mfaPending}, 5*time.Minute)
+				return []byte("{\"mfa_required\":true,\"mfa_token\":\"" + mfaToken + "\"}")
+			}
 			token := api.GetJWTToken(user_id)
+			if api.options.SessionCookie != "" {
+				api.setSessionCookie(w, token)
+			}
 			return []byte("{\"token\":\"" + token + "\"}")
 		}
 	}
 }
 
+// getRefreshHandler returns the handler giving the logged in user a new token,
+// expiring a full JwtExpiry from now. Scoped and impersonation tokens can't be
+// refreshed, so they can't outlive the token they were minted from.
+func (api *apiServer) getRefreshHandler() func(http.ResponseWriter, martini.Context) []byte {
+	return func(w http.ResponseWriter, c martini.Context) []byte {
+		if _, scoped := requestScopes(c); scoped {
+			writeInsufficientScope(w, nil)
+			return nil
+		}
+		id, ok := tokenUserID(c)
+		if !ok {
+			writeJSONError(w, 401, "Only a token can be refreshed")
+			return nil
+		}
+		token := api.GetJWTToken(id)
+		if api.options.SessionCookie != "" {
+			api.setSessionCookie(w, token)
+		}
+		return []byte("{\"token\":\"" + token + "\"}")
+	}
+}
+
 // IsAuthenticated middleware function checks for a jwt token in the request object, and
 // either returns a 401 Unauthorized, or continues after mapping  the LoginModel object into
 // the request context
 func (api *apiServer) IsAuthenticated() interface{} {
-	return func(w http.ResponseWriter, r *http.Request, c martini.Context) {
-		token, tokerr := jwt.ParseFromRequest(r, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				log.WithFields(log.Fields{"method": token.Header["alg"]}).Warn("JWT Auth: Unexpected signing method.")
-				return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-			}
-			return []byte(api.options.JwtKey), nil
-		})
-		if token != nil && token.Valid {
-			guser, err := api.loginModel.GetById(uint(token.Claims["id"].(float64)))
-			if err != nil {
-				w.WriteHeader(401)
-				fmt.Fprintf(w, "Unauthorized")
-				log.WithFields(log.Fields{"id": token.Claims["id"]}).Warn("Cannot find logged in user")
-				return
-			}
-			user := guser.(LoginModel)
-			c.Map(user)
-		} else {
-			log.WithFields(log.Fields{"error": tokerr}).Warn("Auth: JWT token did not validate")
-			w.WriteHeader(401)
-			fmt.Fprintf(w, "Unauthorized")
-		}
+	return AnyOf(JWTStrategy())
+}
+
+// jwtKeyFunc returns the key used to verify tokens, after checking they are
+// signed with the expected algorithm.
+func (api *apiServer) jwtKeyFunc(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		log.WithFields(log.Fields{"method": token.Header["alg"]}).Warn("JWT Auth: Unexpected signing method.")
+		return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+	}
+	return []byte(api.options.JwtKey), nil
+}
+
+// tokenType is used to retrieve the *jwt.Token a request was authenticated
+// with from the context. JWTStrategy and CookieStrategy map it.
+var tokenType = reflect.TypeOf((*jwt.Token)(nil))
+
+// tokenUserID returns the id claim of the token the request was authenticated
+// with, or false if it wasn't authenticated with a token.
+func tokenUserID(c martini.Context) (uint, bool) {
+	v := c.Get(tokenType)
+	if !v.IsValid() {
+		return 0, false
+	}
+	id, ok := v.Interface().(*jwt.Token).Claims["id"].(float64)
+	return uint(id), ok
+}
+
+// loginModelFromToken returns the LoginModel identified by a valid token's id
+// claim. Two factor tokens are refused.
+func (api *apiServer) loginModelFromToken(token *jwt.Token) (LoginModel, error) {
+	if _, ok := token.Claims["mfa"]; ok {
+		return nil, fmt.Errorf("JWT token is only for two factor authentication")
+	}
+	id, ok := token.Claims["id"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("JWT token has no id")
+	}
+	return api.loginModelById(uint(id))
+}
+
+// jwtExpiry returns the lifetime of new tokens. Defaults to 1 hour.
+func (api *apiServer) jwtExpiry() time.Duration {
+	if api.options.JwtExpiry == 0 {
+		return time.Hour
 	}
+	return api.options.JwtExpiry
 }
 
 //Create a JWT token with id=id and expiring in timeout.
 func (api *apiServer) GetJWTToken(id uint) string {
-	timeout := api.options.JwtExpiry
-	if timeout == 0 {
-		timeout = time.Hour
+	return api.signToken(api.userClaims(id), api.jwtExpiry())
+}
+
+// GetScopedToken implements API interface for GetScopedToken()
+func (api *apiServer) GetScopedToken(id uint, scopes []string) string {
+	claims := api.userClaims(id)
+	claims[scopeClaim] = strings.Join(scopes, " ")
+	return api.signToken(claims, api.jwtExpiry())
+}
+
+// userClaims returns the claims of a token for user id.
+func (api *apiServer) userClaims(id uint) map[string]interface{} {
+	claims := map[string]interface{}{"id": id}
+	if tenancy := api.options.Tenancy; tenancy != nil && tenancy.Claim != "" && api.loginModel != nil {
+		if user, err := api.loginModel.GetById(id); err == nil {
+			if member, ok := user.(TenantMember); ok {
+				claims[tenancy.Claim] = member.TenantID()
+			}
+		}
 	}
+	return claims
+}
+
+// signToken returns a token with claims, expiring in timeout.
+func (api *apiServer) signToken(claims map[string]interface{}, timeout time.Duration) string {
 	key := api.options.JwtKey
 	token := jwt.New(jwt.SigningMethodHS256)
 	// Set some claims
-	token.Claims["id"] = id
+	for k, v := range claims {
+		token.Claims[k] = v
+	}
 	token.Claims["exp"] = time.Now().Add(timeout).Unix()
-	log.WithFields(log.Fields{"expiry": token.Claims["exp"], "id": id}).Info("Signing token.")
+	log.WithFields(log.Fields{"expiry": token.Claims["exp"], "id": claims["id"]}).Info("Signing token.")
 	// Sign and get the complete encoded token as a string
 	tokenString, err := token.SignedString([]byte(key))
-	log.Printf("Token: %s, error %v", tokenString, err)
 	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Can't sign token")
 		return ""
 	}
 	return tokenString
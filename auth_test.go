@@ -53,6 +53,10 @@ func TestAuthenticatication(t *testing.T) {
 	testReq(t, "Auth(User doesn't exist)", "GET", "/api/private_widgets"+tokenq, "", 401)
 	disableGetUserById = false
 	testReq(t, "Auth(Valid token)", "GET", "/api/private_widgets"+tokenq, "", 200)
+
+	testReq(t, "Refresh(No token)", "POST", "/auth/refresh", "", 401)
+	refreshed := getToken(testReq(t, "Refresh", "POST", "/auth/refresh"+tokenq, "", 200))
+	testReq(t, "Auth(Refreshed token)", "GET", "/api/private_widgets?access_token="+refreshed, "", 200)
 }
 
 // Extract jwt token from response
@@ -0,0 +1,128 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-martini/martini"
+)
+
+// DefaultMaxBodyBytes is the largest request body accepted unless
+// Options.MaxBodyBytes or RouteOptions.MaxBodyBytes is set.
+const DefaultMaxBodyBytes = 1 << 20
+
+// bodyLimit is mapped into the request context once the body is limited.
+type bodyLimit int64
+
+var (
+	bodyLimitType = reflect.TypeOf(bodyLimit(0))
+	apiServerType = reflect.TypeOf((*apiServer)(nil))
+)
+
+// bodyDecoder decodes the JSON body of r into v, returning false after writing
+// an error response if it can't. decodeBody is the default.
+type bodyDecoder func(w http.ResponseWriter, r *http.Request, c martini.Context, v interface{}) bool
+
+// errTrailingData is returned by decodeJSON for a body with more than one value.
+var errTrailingData = errors.New("Unexpected data after JSON value")
+
+// maxBodyBytes returns the body size limit for a route.
+func (api *apiServer) maxBodyBytes(options RouteOptions) int64 {
+	if options.MaxBodyBytes > 0 {
+		return options.MaxBodyBytes
+	}
+	if api.options.MaxBodyBytes > 0 {
+		return api.options.MaxBodyBytes
+	}
+	return DefaultMaxBodyBytes
+}
+
+// writeTooLarge writes a 413 Payload Too Large.
+func writeTooLarge(w http.ResponseWriter, limit int64) {
+	log.WithFields(log.Fields{"limit": limit}).Warn("Request body too large")
+	writeJSONError(w, 413, fmt.Sprintf("Request body is larger than %d bytes", limit))
+}
+
+// limitBody limits the body of r to limit bytes, returning false after
+// writing a 413 if its Content-Length is already too large. Chunked bodies are
+// checked as they are read.
+func limitBody(w http.ResponseWriter, r *http.Request, c martini.Context, limit int64) bool {
+	if r.ContentLength > limit {
+		writeTooLarge(w, limit)
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	c.Map(bodyLimit(limit))
+	return true
+}
+
+// bodyLimitHandler returns a handler limiting the request body of a route
+// which accepts one, or nil.
+func (api *apiServer) bodyLimitHandler(method string, options RouteOptions) martini.Handler {
+	if !isWrite(method) {
+		return nil
+	}
+	limit := api.maxBodyBytes(options)
+	return func(w http.ResponseWriter, r *http.Request, c martini.Context) {
+		limitBody(w, r, c, limit)
+	}
+}
+
+// decodeJSON decodes a single JSON value from r into v, without reading it
+// all into memory first.
+func decodeJSON(r io.Reader, v interface{}) error {
+	dec := json.NewDecoder(r)
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		if err != nil {
+			return err
+		}
+		return errTrailingData
+	}
+	return nil
+}
+
+// decodeBody decodes the JSON body of r into v. On failure it writes a 413
+// if the body is too large, 422 if it isn't valid JSON for v, or 400 if it
+// can't be read, and returns false. Bodies of routes not added through the
+// API are limited to the API's MaxBodyBytes.
+func decodeBody(w http.ResponseWriter, r *http.Request, c martini.Context, v interface{}) bool {
+	if !c.Get(bodyLimitType).IsValid() {
+		limit := int64(DefaultMaxBodyBytes)
+		if a := c.Get(apiServerType); a.IsValid() {
+			limit = a.Interface().(*apiServer).maxBodyBytes(RouteOptions{})
+		}
+		if !limitBody(w, r, c, limit) {
+			return false
+		}
+	}
+	err := decodeJSON(r.Body, v)
+	if err == nil {
+		return true
+	}
+	var tooLarge *http.MaxBytesError
+	var syntaxError *json.SyntaxError
+	var typeError *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &tooLarge):
+		writeTooLarge(w, tooLarge.Limit)
+	case err == io.EOF:
+		writeJSONError(w, 422, "Empty request body")
+	case err == io.ErrUnexpectedEOF:
+		writeJSONError(w, 422, "Truncated JSON body")
+	case errors.As(err, &syntaxError), errors.As(err, &typeError), err == errTrailingData:
+		log.WithFields(log.Fields{"error": err}).Warn("Can't parse incoming json")
+		writeJSONError(w, 422, err.Error()) // unprocessable entity
+	default:
+		log.WithFields(log.Fields{"error": err}).Warn("Can't read request body")
+		writeJSONError(w, 400, "Can't read request body")
+	}
+	return false
+}
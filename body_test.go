@@ -0,0 +1,56 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// BodyWidget keeps the rows posted by TestMaxBodyBytes out of the widgets
+// table, which other tests count.
+type BodyWidget struct {
+	ID   uint   `gorm:"primary_key" json:"id"`
+	Name string `json:"name"`
+}
+
+// testChunkedReq makes a request whose body has no Content-Length.
+func testChunkedReq(t *testing.T, a API, name string, path string, body string, expectedCode int) {
+	req, _ := http.NewRequest("POST", path, nil)
+	req.Body = ioutil.NopCloser(strings.NewReader(body))
+	req.ContentLength = -1
+	req.TransferEncoding = []string{"chunked"}
+	rec := httptest.NewRecorder()
+	a.Martini().ServeHTTP(rec, req)
+	if rec.Code != expectedCode {
+		t.Errorf("%v should have code %v. Got %v and body %s\n", name, expectedCode, rec.Code, rec.Body.String())
+	}
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	db := getTestDb()
+	db.DropTable(&WidgetClone{})
+	db.CreateTable(&WidgetClone{})
+	db.DropTable(&BodyWidget{})
+	db.CreateTable(&BodyWidget{})
+	a := New(Options{Db: db, Martini: getSilentMartini(), MaxBodyBytes: 64})
+	a.AddDefaultRoutes(&BodyWidget{})
+	a.AddPostRoute(&WidgetClone{}, RouteOptions{MaxBodyBytes: 1024})
+
+	long := `{"name":"` + strings.Repeat("x", 100) + `"}`
+	testApiReq(t, a, "Body(Small)", "POST", "/api/body_widgets", `{"name":"Small"}`, nil, 200)
+	rec := testApiReq(t, a, "Body(Too large)", "POST", "/api/body_widgets", long, nil, 413)
+	if !strings.Contains(rec.Body.String(), "64 bytes") {
+		t.Errorf("413 should give the limit: %s", rec.Body.String())
+	}
+	testApiReq(t, a, "Body(Patch too large)", "PATCH", "/api/body_widgets/1", long, nil, 413)
+	testApiReq(t, a, "Body(Route override)", "POST", "/api/widget_clones", long, nil, 200)
+
+	testChunkedReq(t, a, "Body(Chunked)", "/api/body_widgets", `{"name":"Chunked"}`, 200)
+	testChunkedReq(t, a, "Body(Chunked too large)", "/api/body_widgets", long, 413)
+
+	testApiReq(t, a, "Body(Empty)", "POST", "/api/body_widgets", "", nil, 422)
+	testApiReq(t, a, "Body(Truncated)", "POST", "/api/body_widgets", `{"name":"Trunc`, nil, 422)
+	testApiReq(t, a, "Body(Trailing data)", "POST", "/api/body_widgets", `{"name":"One"}{"name":"Two"}`, nil, 422)
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-martini/martini"
+	"github.com/jinzhu/gorm"
+)
+
+// StatusClientClosedRequest is sent when the client goes away before its
+// request is finished. It's nginx's non-standard 499.
+const StatusClientClosedRequest = 499
+
+// contextSetting is the gorm setting holding a request's context. See withContext.
+const contextSetting = "api:context"
+
+// contextCallbacks records the databases checkContext has been registered with.
+var contextCallbacks = struct {
+	sync.Mutex
+	registered map[*gorm.DB]bool
+}{registered: map[*gorm.DB]bool{}}
+
+// registerContextCallbacks makes db refuse to start a query, create, update
+// or delete once the context set by withContext is done. gorm can't cancel a
+// statement which has already started.
+func registerContextCallbacks(db *gorm.DB) {
+	contextCallbacks.Lock()
+	defer contextCallbacks.Unlock()
+	if contextCallbacks.registered[db] {
+		return
+	}
+	contextCallbacks.registered[db] = true
+	callbacks := db.Callback()
+	callbacks.Query().Before("gorm:query").Register(contextSetting, checkContext)
+	callbacks.Create().Before("gorm:begin_transaction").Register(contextSetting, checkContext)
+	callbacks.Update().Before("gorm:begin_transaction").Register(contextSetting, checkContext)
+	callbacks.Delete().Before("gorm:begin_transaction").Register(contextSetting, checkContext)
+}
+
+// checkContext is the gorm callback added by registerContextCallbacks.
+func checkContext(scope *gorm.Scope) {
+	if v, ok := scope.Get(contextSetting); ok {
+		if err := v.(context.Context).Err(); err != nil {
+			scope.Err(err)
+		}
+	}
+}
+
+// withContext returns db with ctx set for checkContext.
+func withContext(db *gorm.DB, ctx context.Context) *gorm.DB {
+	return db.Set(contextSetting, ctx)
+}
+
+// Context returns the request's context. It's done when the client goes away
+// or the route's Timeout passes. Queries made with req.DB check it first.
+func (req *Request) Context() context.Context {
+	if req.ctx == nil {
+		return context.Background()
+	}
+	return req.ctx
+}
+
+// timeout returns the deadline for a route's requests, or 0 for none.
+func (api *apiServer) timeout(options RouteOptions) time.Duration {
+	if options.Timeout > 0 {
+		return options.Timeout
+	}
+	return api.options.Timeout
+}
+
+// timeoutHandler returns a handler giving a route's requests a deadline, or
+// nil if it has no Timeout.
+func (api *apiServer) timeoutHandler(options RouteOptions) martini.Handler {
+	timeout := api.timeout(options)
+	if timeout <= 0 {
+		return nil
+	}
+	return func(c martini.Context, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		c.Map(r.WithContext(ctx))
+		c.Next()
+	}
+}
+
+// writeCancelled writes a 499 if the client has gone away, or a 503 if the
+// deadline has passed. Returns false if err is nil.
+func writeCancelled(w http.ResponseWriter, r *http.Request, err error) bool {
+	if err == nil {
+		return false
+	}
+	log.WithFields(log.Fields{"path": r.URL.Path, "error": err}).Warn("Request cancelled")
+	if err == context.DeadlineExceeded {
+		writeJSONError(w, 503, "Request timed out")
+	} else {
+		writeJSONError(w, StatusClientClosedRequest, "Client closed request")
+	}
+	return true
+}
+
+// cancelledHandler stops a request whose context is done. handlerList runs
+// it before every handler.
+func cancelledHandler(w http.ResponseWriter, r *http.Request) {
+	writeCancelled(w, r, r.Context().Err())
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestContext(t *testing.T) {
+	a := New(Options{Db: getTestDb(), Martini: getSilentMartini(), Timeout: time.Minute})
+	a.AddIndexRoute(&Widget{}, RouteOptions{
+		UriModelName: "slow_widgets",
+		Timeout:      time.Millisecond,
+		Query: func(req *Request) error {
+			<-req.Context().Done()
+			return nil
+		},
+	})
+	a.AddGetRoute(&Widget{}, RouteOptions{
+		UriModelName: "deadline_widgets",
+		Authorize: func(req *Request) error {
+			if deadline, ok := req.Context().Deadline(); !ok || time.Until(deadline) > time.Minute {
+				return Errorf(400, "Expected Options.Timeout deadline, got %v", deadline)
+			}
+			return nil
+		},
+	})
+
+	body := testApiReq(t, a, "Route timeout", "GET", "/api/slow_widgets", "", nil, 503).Body.String()
+	if body != `{"error":"Request timed out"}` {
+		t.Errorf("Unexpected timeout body %s", body)
+	}
+	testApiReq(t, a, "Global timeout", "GET", "/api/deadline_widgets/1", "", nil, 200)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r, _ := http.NewRequest("GET", "/api/deadline_widgets/1", nil)
+	w := httptest.NewRecorder()
+	a.Handler().ServeHTTP(w, r.WithContext(ctx))
+	if w.Code != StatusClientClosedRequest {
+		t.Errorf("Request from a client which has gone away should return 499, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestWriteCancelled(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/api/widgets", nil)
+	for _, c := range []struct {
+		err  error
+		code int
+	}{
+		{nil, 200},
+		{context.Canceled, StatusClientClosedRequest},
+		{context.DeadlineExceeded, 503},
+	} {
+		w := httptest.NewRecorder()
+		if writeCancelled(w, r, c.err) != (c.err != nil) || w.Code != c.code {
+			t.Errorf("writeCancelled(%v) wrote %d, expected %d", c.err, w.Code, c.code)
+		}
+	}
+}
+
+func TestTimeoutOption(t *testing.T) {
+	api := &apiServer{options: &Options{Timeout: time.Second}}
+	if d := api.timeout(RouteOptions{}); d != time.Second {
+		t.Errorf("Expected Options.Timeout, got %v", d)
+	}
+	if d := api.timeout(RouteOptions{Timeout: time.Millisecond}); d != time.Millisecond {
+		t.Errorf("Expected RouteOptions.Timeout to replace Options.Timeout, got %v", d)
+	}
+	if api.timeoutHandler(RouteOptions{}) == nil {
+		t.Errorf("Expected a timeout handler")
+	}
+	api.options.Timeout = 0
+	if api.timeoutHandler(RouteOptions{}) != nil {
+		t.Errorf("Expected no timeout handler without a Timeout")
+	}
+}
@@ -0,0 +1,181 @@
+package api
+
+import (
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-martini/martini"
+)
+
+// CORS configures Cross-Origin Resource Sharing, so that a front end served
+// from another origin can use the API. Set it as Options.CORS for every route,
+// or as RouteOptions.CORS to replace it for some routes.
+type CORS struct {
+	// Origins which may use the API. Each is "*" for any origin, an exact
+	// origin like "https://app.example.com", or a pattern with * wildcards
+	// like "https://*.example.com". "*" can't be used with AllowCredentials.
+	AllowedOrigins []string
+	// Methods allowed by preflight requests. Defaults to the methods
+	// registered on the path.
+	AllowedMethods []string
+	// Request headers allowed by preflight requests. Defaults to Accept,
+	// Authorization, Content-Type and the API key header.
+	AllowedHeaders []string
+	// Response headers which scripts may read.
+	ExposedHeaders []string
+	// Allow cookies and Authorization headers to be sent.
+	AllowCredentials bool
+	// How long browsers may cache a preflight response. 0 leaves it to the browser.
+	MaxAge time.Duration
+}
+
+// check panics if the configuration would let any origin make credentialed
+// requests, as every site the user visits could then use their session.
+func (cors *CORS) check() {
+	if !cors.AllowCredentials {
+		return
+	}
+	for _, allowed := range cors.AllowedOrigins {
+		if allowed == "*" {
+			panic("CORS AllowedOrigins can't be \"*\" with AllowCredentials. List the allowed origins instead.")
+		}
+	}
+}
+
+// allowsOrigin returns true if origin matches one of AllowedOrigins.
+func (cors *CORS) allowsOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, allowed := range cors.AllowedOrigins {
+		allowed = strings.ToLower(allowed)
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		if strings.Contains(allowed, "*") {
+			if ok, _ := path.Match(allowed, origin); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// allowedHeaders returns the request headers allowed by preflight requests.
+func (cors *CORS) allowedHeaders(api *apiServer) []string {
+	if len(cors.AllowedHeaders) > 0 {
+		return cors.AllowedHeaders
+	}
+	return []string{"Accept", "Authorization", "Content-Type", api.apiKeyHeader()}
+}
+
+// setOriginHeaders sets the headers common to preflight and actual
+// responses for an allowed origin.
+func (cors *CORS) setOriginHeaders(w http.ResponseWriter, origin string) {
+	header := w.Header()
+	if len(cors.AllowedOrigins) == 1 && cors.AllowedOrigins[0] == "*" && !cors.AllowCredentials {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		header.Set("Access-Control-Allow-Origin", origin)
+		header.Add("Vary", "Origin")
+	}
+	if cors.AllowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// routeCORS returns the CORS configuration for a route's options, or nil.
+func (api *apiServer) routeCORS(options RouteOptions) *CORS {
+	if options.CORS != nil {
+		return options.CORS
+	}
+	return api.options.CORS
+}
+
+// corsHandler returns a handler adding CORS headers to responses to allowed
+// origins, or nil if the route has no CORS configuration. It runs before
+// authentication, so errors can be read by scripts too.
+func (api *apiServer) corsHandler(options RouteOptions) martini.Handler {
+	cors := api.routeCORS(options)
+	if cors == nil {
+		return nil
+	}
+	cors.check()
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !cors.allowsOrigin(origin) {
+			return
+		}
+		cors.setOriginHeaders(w, origin)
+		if len(cors.ExposedHeaders) > 0 {
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(cors.ExposedHeaders, ", "))
+		}
+	}
+}
+
+// pathMethods returns the methods registered on path, sorted.
+func (api *apiServer) pathMethods(path string) []string {
+	seen := map[string]bool{}
+	methods := []string{}
+	for _, r := range api.routes {
+		if r.path == path && !seen[r.method] {
+			seen[r.method] = true
+			methods = append(methods, r.method)
+		}
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// pathRoute returns the route for method on path, or nil.
+func (api *apiServer) pathRoute(method string, path string) *route {
+	for _, r := range api.routes {
+		if r.method == method && r.path == path {
+			return r
+		}
+	}
+	return nil
+}
+
+// preflightHandler returns the handler for OPTIONS requests to path, which
+// answers CORS preflight requests as well as plain OPTIONS requests. The
+// allowed methods are found when the request is made, so they include
+// routes added to path later.
+func (api *apiServer) preflightHandler(path string) martini.Handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		methods := api.pathMethods(path)
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		origin := r.Header.Get("Origin")
+		requested := r.Header.Get("Access-Control-Request-Method")
+		if origin == "" || requested == "" {
+			w.WriteHeader(204)
+			return
+		}
+		route := api.pathRoute(requested, path)
+		if route == nil {
+			log.WithFields(log.Fields{"path": path, "method": requested}).Warn("CORS: preflight for unknown method")
+			w.WriteHeader(405)
+			return
+		}
+		cors := api.routeCORS(route.options)
+		if cors == nil || !cors.allowsOrigin(origin) {
+			log.WithFields(log.Fields{"path": path, "origin": origin}).Warn("CORS: origin not allowed")
+			w.WriteHeader(403)
+			return
+		}
+		if len(cors.AllowedMethods) > 0 {
+			methods = cors.AllowedMethods
+		}
+		cors.setOriginHeaders(w, origin)
+		header := w.Header()
+		header.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+		header.Set("Access-Control-Allow-Headers", strings.Join(cors.allowedHeaders(api), ", "))
+		if cors.MaxAge > 0 {
+			header.Set("Access-Control-Max-Age", strconv.Itoa(int(cors.MaxAge.Seconds())))
+		}
+		w.WriteHeader(204)
+	}
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCORS(t *testing.T) {
+	db := getTestDb()
+	db.DropTable(&WidgetClone{})
+	db.CreateTable(&WidgetClone{})
+	a := New(Options{Db: db, Martini: getSilentMartini(), CORS: &CORS{
+		AllowedOrigins:   []string{"https://app.example.com", "https://*.example.org"},
+		ExposedHeaders:   []string{"X-Total-Count"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	}})
+	a.AddDefaultRoutes(&Widget{})
+	a.AddDefaultRoutes(&WidgetClone{}, RouteOptions{CORS: &CORS{AllowedOrigins: []string{"*"}}})
+
+	app := map[string]string{"Origin": "https://app.example.com"}
+	rec := testApiReq(t, a, "CORS(Allowed origin)", "GET", "/api/widgets", "", app, 200)
+	if rec.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" || rec.Header().Get("Access-Control-Allow-Credentials") != "true" ||
+		rec.Header().Get("Access-Control-Expose-Headers") != "X-Total-Count" {
+		t.Errorf("Missing CORS headers: %v", rec.Header())
+	}
+	rec = testApiReq(t, a, "CORS(Pattern origin)", "GET", "/api/widgets", "", map[string]string{"Origin": "https://shop.example.org"}, 200)
+	if rec.Header().Get("Access-Control-Allow-Origin") != "https://shop.example.org" {
+		t.Errorf("Pattern origin not allowed: %v", rec.Header())
+	}
+	rec = testApiReq(t, a, "CORS(Other origin)", "GET", "/api/widgets", "", map[string]string{"Origin": "https://evil.example.net"}, 200)
+	if rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Other origin allowed: %v", rec.Header())
+	}
+
+	preflight := map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "PATCH"}
+	rec = testApiReq(t, a, "CORS(Preflight item)", "OPTIONS", "/api/widgets/1", "", preflight, 204)
+	if rec.Header().Get("Access-Control-Allow-Methods") != "DELETE, GET, HEAD, OPTIONS, PATCH" || rec.Header().Get("Access-Control-Max-Age") != "600" ||
+		rec.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+		t.Errorf("Bad preflight response: %v", rec.Header())
+	}
+	preflight["Access-Control-Request-Method"] = "POST"
+	rec = testApiReq(t, a, "CORS(Preflight index)", "OPTIONS", "/api/widgets", "", preflight, 204)
+	if rec.Header().Get("Access-Control-Allow-Methods") != "GET, HEAD, OPTIONS, POST" {
+		t.Errorf("Bad preflight methods: %v", rec.Header())
+	}
+	preflight["Access-Control-Request-Method"] = "PUT"
+	testApiReq(t, a, "CORS(Preflight unknown method)", "OPTIONS", "/api/widgets", "", preflight, 405)
+	preflight["Access-Control-Request-Method"] = "GET"
+	preflight["Origin"] = "https://evil.example.net"
+	testApiReq(t, a, "CORS(Preflight other origin)", "OPTIONS", "/api/widgets", "", preflight, 403)
+
+	// The route override allows any origin, without credentials.
+	rec = testApiReq(t, a, "CORS(Route override)", "OPTIONS", "/api/widget_clones", "", preflight, 204)
+	if rec.Header().Get("Access-Control-Allow-Origin") != "*" || rec.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("Route CORS not applied: %v", rec.Header())
+	}
+}
+
+// Any origin can't be allowed to make credentialed requests.
+func TestCORSAnyOriginWithCredentials(t *testing.T) {
+	defer ensurePanic(t, "CORS with AllowedOrigins * and AllowCredentials")
+	New(Options{Db: getTestDb(), Martini: getSilentMartini(), CORS: &CORS{AllowedOrigins: []string{"*"}, AllowCredentials: true}})
+}
@@ -1,10 +1,6 @@
 package main
 
 import (
-	"errors"
-	"fmt"
-	"net/http"
-
 	"github.com/go-martini/martini"
 	"github.com/jinzhu/gorm"
 	_ "github.com/mattn/go-sqlite3"
@@ -14,57 +10,52 @@ import (
 
 var GORMDB *gorm.DB
 
+// Passwords are hashed with bcrypt. The PasswordLoginModel checks them for us.
+var passwords = &api.PasswordLoginModel{Model: &User{}, MinLength: 5}
+
 // User contains our table of users
 type User struct {
-	ID       uint   `gorm:"primary_key" json:"id"`
-	Name     string `json:"name"`
-	Password string `json:"-"` // `json:"-"` prevents password ever being serialized to json
-	Admin    bool   `json:"admin"`
+	ID           uint   `gorm:"primary_key" json:"id"`
+	Name         string `json:"name"`
+	PasswordHash string `json:"-"` // `json:"-"` prevents password ever being serialized to json
+	Admin        bool   `json:"admin"`
 }
 
 // Check the login details.
 func (_ *User) CheckLoginDetails(j *map[string]interface{}) (uint, error) {
-	user := User{}
-	fmt.Printf("Checking login details\n")
-	if GORMDB.Where("name = ? AND password = ?", (*j)["name"], (*j)["password"]).Find(&user).RecordNotFound() {
-		fmt.Printf("Not found\n")
-		return 0, errors.New("Not authenticated")
-	} else {
-		fmt.Printf("Found user %v\n", user)
-		return user.ID, nil
-	}
+	return passwords.CheckLoginDetails(j)
 }
 
 // Return user given an ID. This is the second function to make *User fulfill
 // the LoginModel interface
 func (_ *User) GetById(id uint) (interface{}, error) {
-	user := User{}
-	if GORMDB.Where("id = ?", id).Find(&user).RecordNotFound() {
-		return &user, errors.New("User not found")
+	return passwords.GetById(id)
+}
+
+// Roles makes User implement api.HasRoles, so routes can require a role in
+// their api.Policy.
+func (u *User) Roles() []string {
+	if u.Admin {
+		return []string{"admin"}
 	}
-	return &user, nil
+	return nil
 }
 
 type PrivateWidget struct {
 	ID     uint   `gorm:"primary_key" json:"id"`
-	UserID uint   `json:"user_id"`
+	UserID uint   `json:"user_id" api:"owner"`
 	Name   string `json:"name"`
 }
 
-type BelongsToUser interface {
-	UserId() uint
-}
-
-func (pw *PrivateWidget) UserId() uint {
-	return pw.UserID
-}
-
 func seedDb(db *gorm.DB) {
 	db.DropTable(&User{})
 	db.CreateTable(&User{})
-	user1 := User{Name: "user1", Password: "user1"}
-	user2 := User{Name: "user2", Password: "user2"}
-	admin := User{Name: "admin", Password: "admin", Admin: true}
+	user1 := User{Name: "user1"}
+	user2 := User{Name: "user2"}
+	admin := User{Name: "admin", Admin: true}
+	passwords.SetPassword(&user1, "user1")
+	passwords.SetPassword(&user2, "user2")
+	passwords.SetPassword(&admin, "admin")
 	db.Create(&user1)
 	db.Create(&user2)
 	db.Create(&admin)
@@ -79,11 +70,14 @@ func main() {
 	// Create a DB with the test table and seed data
 	db, _ := gorm.Open("sqlite3", "./api-example.db")
 	GORMDB = &db
+	passwords.DB = GORMDB
 	seedDb(&db)
 
 	// Create an API server. We need to supply JwtKey if we're doing authentication.
 	// We pass db.Debug() instead of &db so you can see the sql queries in the log.
-	a := api.New(api.Options{Db: db.Debug(), JwtKey: "SomethingLongAndDifficultToGuess"})
+	// CORS lets public/index.html work when served from another origin too.
+	a := api.New(api.Options{Db: db.Debug(), JwtKey: "SomethingLongAndDifficultToGuess",
+		CORS: &api.CORS{AllowedOrigins: []string{"http://localhost:*", "http://127.0.0.1:*"}}})
 
 	// Allow logging in with the User model at /login. Details will be checked by User.CheckLoginDetails()
 	a.SetAuth(&User{}, "/login")
@@ -93,44 +87,22 @@ func main() {
 	// This one allows only authenticated users (ie. they've logged in at "/login" above).
 	onlyAuthenticated := api.RouteOptions{Authenticate: true}
 
-	// Only Allow Admin
+	// Only Allow Admin. The policy requires the admin role, which User grants
+	// to admins through the api.HasRoles interface.
 	onlyAdmin := api.RouteOptions{
-		Authenticate: true,
-		// Add an authorize callback. This is a Martini handler, and can access the LoginModel
-		// used for authentication. As we called API.SetAuth with &User{} this is guaranteed to
-		// be a *User, so we can do a type assertion.
-		Authorize: func(w http.ResponseWriter, userLM api.LoginModel) {
-			user := userLM.(*User)
-			if !user.Admin {
-				w.WriteHeader(403)
-				w.Write([]byte(`{"error":"You need to be admin to do that"}`))
-			}
-		}}
+		Policy: api.Policy{"index": "role:admin", "get": "role:admin", "create": "role:admin", "update": "role:admin", "delete": "role:admin"}}
 
-	// This RouteOptions can be used for any table with a user_id field. If logged in as admin
-	// it allows anything. If logged in as user it limits GETs to those of own user_id, and
-	// delete to own user_id. It also prevents changing user ownership.
+	// This RouteOptions can be used for any table with a field tagged `api:"owner"`. If logged in
+	// as admin it allows anything. If logged in as user it limits GETs to those of own user_id,
+	// sets user_id on new items, and prevents changing user ownership.
 	onlyOwnUnlessAdmin := api.RouteOptions{
-		Authenticate: true,
-		Query: func(req *api.Request, userLM api.LoginModel) {
-			user := userLM.(*User)
-			// Scope the requests database to only contain owned items. This prevents unauthorized
-			// GET, DELETE, and PATCH requests, and limits the index to own items.
-			if !user.Admin {
-				req.DB = req.DB.Where("user_id = ?", user.ID)
-			}
-		},
-		CheckUpload: func(w http.ResponseWriter, userLM api.LoginModel, req *api.Request) {
-			user := userLM.(*User)
-			uploaded := req.Uploaded.(BelongsToUser)
-			// For PATCH and POST routes we also need to check that the uploaded object has the correct user_id
-			if !user.Admin && user.ID != uploaded.UserId() {
-				w.WriteHeader(403)
-				fmt.Printf("%v != %v", user, uploaded)
-				w.Write([]byte(`{"error":"Only admin can change a user_id"}`))
-			}
+		Ownership: &api.Ownership{
+			IsSuperuser: func(userLM api.LoginModel) bool { return userLM.(*User).Admin },
 		}}
 
+	// Let admins audit who can do what.
+	a.AddPermissionsRoute("/api/_permissions", onlyAdmin)
+
 	// Add the Default REST routes for User.
 	// If two RouteOptions structures are provided the first is used for Read routes,
 	// and the second for Write routes. If three are given then the third is used for
@@ -147,6 +119,9 @@ func main() {
 			Prefix: "/user/:user_id",
 			Query:  func(req *api.Request, params martini.Params) { req.DB = req.DB.Where("user_id = ?", params["user_id"]) }})
 
+	// Describe every route above for the front end. Browse it at /api/openapi/ui.
+	a.AddOpenAPIRoute("/api/openapi")
+
 	// Run the server.
 	a.Martini().RunOnAddr("127.0.0.1:3000")
 }
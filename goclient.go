@@ -0,0 +1,568 @@
+package api
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"go/token"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// goName converts a snake_case name to an exported Go identifier, eg.
+// "private_widgets" gives "PrivateWidgets" and "user_id" gives "UserID".
+func goName(name string) string {
+	result := ""
+	for _, part := range strings.FieldsFunc(name, func(r rune) bool { return r == '_' || r == '-' || r == '.' }) {
+		if part == "id" || part == "url" || part == "api" {
+			result += strings.ToUpper(part)
+		} else {
+			result += strings.ToUpper(part[:1]) + part[1:]
+		}
+	}
+	return result
+}
+
+// unexport lower cases the leading capitals of an exported identifier, eg.
+// "UserID" gives "userID" and "APIKeys" gives "apiKeys".
+func unexport(n string) string {
+	if n == "" {
+		return "param"
+	}
+	upper := 1
+	for upper < len(n) && n[upper] >= 'A' && n[upper] <= 'Z' && (upper+1 == len(n) || n[upper+1] >= 'A' && n[upper+1] <= 'Z') {
+		upper++
+	}
+	return strings.ToLower(n[:upper]) + n[upper:]
+}
+
+// goArgName converts a snake_case name to an unexported Go identifier, eg.
+// "user_id" gives "userID".
+func goArgName(name string) string {
+	arg := unexport(goName(name))
+	if token.IsKeyword(arg) || arg == "ctx" || arg == "opts" || arg == "item" || arg == "fields" || arg == "s" {
+		arg += "Param"
+	}
+	return arg
+}
+
+// goTypes writes Go declarations for the types used by models.
+type goTypes struct {
+	imports map[string]bool
+	decls   map[string]string // Declarations of generated types, by name
+	pending []reflect.Type
+}
+
+// typeName returns the Go type used by the client for t, queueing any
+// struct types it needs declared.
+func (g *goTypes) typeName(t reflect.Type) string {
+	if t == timeType {
+		g.imports["time"] = true
+		return "time.Time"
+	}
+	if t.Name() != "" && t.Kind() != reflect.Struct && t.PkgPath() == "" {
+		return t.Name() // builtin
+	}
+	pt := reflect.PtrTo(t)
+	custom := pt.Implements(jsonMarshalerType) || pt.Implements(textMarshalerType) ||
+		pt.Implements(jsonUnmarshalerType) || pt.Implements(textUnmarshalerType)
+	if custom && t.Name() != "" {
+		// Types which marshal themselves are used as they are if they can be
+		// imported, and passed through as raw JSON if not.
+		if t.PkgPath() == "main" || strings.Contains(t.PkgPath(), "/internal/") || strings.HasSuffix(t.PkgPath(), "/internal") {
+			g.imports["encoding/json"] = true
+			return "json.RawMessage"
+		}
+		g.imports[t.PkgPath()] = true
+		return path.Base(t.PkgPath()) + "." + t.Name()
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return "*" + g.typeName(t.Elem())
+	case reflect.Slice:
+		return "[]" + g.typeName(t.Elem())
+	case reflect.Array:
+		return fmt.Sprintf("[%d]%s", t.Len(), g.typeName(t.Elem()))
+	case reflect.Map:
+		return "map[" + g.typeName(t.Key()) + "]" + g.typeName(t.Elem())
+	case reflect.Interface:
+		return "interface{}"
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structBody(t)
+		}
+		if _, ok := g.decls[t.Name()]; !ok {
+			g.decls[t.Name()] = "" // Placeholder for recursive types
+			g.pending = append(g.pending, t)
+		}
+		return t.Name()
+	}
+	return t.Kind().String() // Named types of builtin kinds, eg. type Colour string
+}
+
+// structBody returns a struct type with the fields of t decoded by encoding/json.
+func (g *goTypes) structBody(t reflect.Type) string {
+	var b bytes.Buffer
+	b.WriteString("struct {\n")
+	for _, f := range jsonFields(t) {
+		tag := f.Tag.Get("json")
+		if tag == "" {
+			tag = f.Name
+		}
+		comment := ""
+		if readOnlyField(f) || hasAPITag(f, "readonly") {
+			comment = " // Read only"
+		}
+		fmt.Fprintf(&b, "%s %s `json:%q`%s\n", f.Name, g.typeName(f.Type), tag, comment)
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+// declare declares every queued struct type.
+func (g *goTypes) declare() {
+	for len(g.pending) > 0 {
+		t := g.pending[0]
+		g.pending = g.pending[1:]
+		g.decls[t.Name()] = fmt.Sprintf("// %s mirrors the server's %s type.\ntype %s %s", t.Name(), t.String(), t.Name(), g.structBody(t))
+	}
+}
+
+// clientService is the model routes at one path, as called by the
+// generated clients.
+type clientService struct {
+	Name    string // eg. "Widgets", or "UserWidgets" for /api/user/:user_id/widgets
+	Path    string // eg. "/api/widgets"
+	Model   reflect.Type
+	IDType  reflect.Type // nil unless the model's ID is a number or string
+	Params  []string     // The path's parameters, eg. "user_id"
+	Actions map[string]bool
+}
+
+// clientServices returns the services for the model routes added so far.
+func (api *apiServer) clientServices() []*clientService {
+	services := []*clientService{}
+	byPath := map[string]*clientService{}
+	names := map[string]int{}
+	prefix := uriPrefix(api.options)
+	for _, r := range api.routes {
+		if r.implicit || r.model == nil {
+			continue
+		}
+		base := strings.TrimSuffix(r.path, "/:id")
+		s, ok := byPath[base]
+		if !ok {
+			s = &clientService{Path: base, Model: r.model, Actions: map[string]bool{}}
+			segments := strings.Split(strings.TrimPrefix(strings.TrimPrefix(base, prefix), "/"), "/")
+			for _, segment := range segments {
+				if strings.HasPrefix(segment, ":") {
+					s.Params = append(s.Params, segment[1:])
+				} else {
+					s.Name += goName(segment)
+				}
+			}
+			if names[s.Name]++; names[s.Name] > 1 {
+				s.Name = fmt.Sprintf("%s%d", s.Name, names[s.Name])
+			}
+			if f, ok := r.model.FieldByName("ID"); ok {
+				switch f.Type.Kind() {
+				case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+					reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.String:
+					s.IDType = f.Type
+				}
+			}
+			byPath[base] = s
+			services = append(services, s)
+		}
+		s.Actions[r.action] = true
+	}
+	return services
+}
+
+// goService is a clientService as the Go client template uses it.
+type goService struct {
+	Name    string
+	Path    string
+	Model   string
+	IDType  string
+	Params  []string // Go arguments for the path's parameters, eg. "userID string"
+	PathExp string   // Go expression for the path, eg. `"/api/users/" + url.PathEscape(userID) + "/widgets"`
+	Actions map[string]bool
+}
+
+// goPathExpression returns a Go expression building path from its
+// parameters, and the parameters as Go arguments.
+func goPathExpression(path string) (string, []string) {
+	parts := []string{}
+	args := []string{}
+	literal := ""
+	for _, segment := range strings.Split(path, "/")[1:] {
+		if strings.HasPrefix(segment, ":") {
+			arg := goArgName(segment[1:])
+			args = append(args, arg+" string")
+			parts = append(parts, fmt.Sprintf("%q", literal+"/"), "url.PathEscape("+arg+")")
+			literal = ""
+		} else {
+			literal += "/" + segment
+		}
+	}
+	if literal != "" || len(parts) == 0 {
+		parts = append(parts, fmt.Sprintf("%q", literal))
+	}
+	return strings.Join(parts, " + "), args
+}
+
+// goServices returns the Go client's services, queueing the types they use.
+func (api *apiServer) goServices(types *goTypes) []*goService {
+	services := []*goService{}
+	for _, cs := range api.clientServices() {
+		s := &goService{Name: cs.Name, Path: cs.Path, Model: types.typeName(cs.Model), IDType: "string", Actions: cs.Actions}
+		if cs.IDType != nil {
+			s.IDType = types.typeName(cs.IDType)
+		}
+		s.PathExp, s.Params = goPathExpression(cs.Path)
+		services = append(services, s)
+	}
+	return services
+}
+
+// GoClient implements API interface for GoClient().
+func (api *apiServer) GoClient(pkg string) ([]byte, error) {
+	types := &goTypes{imports: map[string]bool{}, decls: map[string]string{}}
+	services := api.goServices(types)
+	types.declare()
+
+	decls := make([]string, 0, len(types.decls))
+	for _, d := range types.decls {
+		decls = append(decls, d)
+	}
+	sort.Strings(decls)
+	imports := []string{}
+	for i := range types.imports {
+		switch i {
+		case "encoding/json", "time":
+			// Always imported
+		default:
+			imports = append(imports, i)
+		}
+	}
+	sort.Strings(imports)
+	title := api.options.APITitle
+	if title == "" {
+		title = "the API"
+	}
+
+	var b bytes.Buffer
+	err := goClientTemplate.Execute(&b, map[string]interface{}{
+		"Package":      pkg,
+		"Title":        title,
+		"Imports":      imports,
+		"Types":        decls,
+		"Services":     services,
+		"LoginPath":    api.loginPath,
+		"APIKeyHeader": api.apiKeyHeader(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	source, err := format.Source(b.Bytes())
+	if err != nil {
+		return b.Bytes(), fmt.Errorf("Generated client doesn't compile: %v", err)
+	}
+	return source, nil
+}
+
+var goClientTemplate = template.Must(template.New("client").Parse(`// Code generated by go-martini-api. DO NOT EDIT.
+
+// Package {{.Package}} is a client for {{.Title}}.
+package {{.Package}}
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+{{range .Imports}}
+	"{{.}}"{{end}}
+)
+
+// Client calls the API at BaseURL, eg. "https://example.com".
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client // Defaults to http.DefaultClient
+	APIKey     string       // Sent in the {{.APIKeyHeader}} header if set
+
+	mutex sync.Mutex
+	token string
+{{range .Services}}
+	{{.Name}} *{{.Name}}Service{{end}}
+}
+
+// New returns a Client for the API at baseURL.
+func New(baseURL string) *Client {
+	c := &Client{BaseURL: strings.TrimSuffix(baseURL, "/")}{{range .Services}}
+	c.{{.Name}} = &{{.Name}}Service{client: c}{{end}}
+	return c
+}
+
+// Token returns the token sent with requests.
+func (c *Client) Token() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.token
+}
+
+// SetToken sets the token sent with requests, eg. one saved from a previous login.
+func (c *Client) SetToken(token string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.token = token
+}
+
+// TokenExpiry returns when the token expires, or the zero time if there is
+// no token or it can't be read.
+func (c *Client) TokenExpiry() time.Time {
+	parts := strings.Split(c.Token(), ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	claims := struct {
+		Exp int64 ` + "`json:\"exp\"`" + `
+	}{}
+	if err != nil || json.Unmarshal(payload, &claims) != nil || claims.Exp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(claims.Exp, 0)
+}
+
+// Error is returned for responses with a status of 400 or more.
+type Error struct {
+	StatusCode int
+	Message    string            // The error message, or the body if it has none
+	Errors     map[string]string // Problems with the request body, by field or JSON pointer
+	RetryAfter time.Duration     // How long to wait before retrying, for a 429
+}
+
+func (e *Error) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = http.StatusText(e.StatusCode)
+	}
+	if len(e.Errors) > 0 {
+		problems := []string{}
+		for field, problem := range e.Errors {
+			problems = append(problems, field+": "+problem)
+		}
+		msg += " (" + strings.Join(problems, ", ") + ")"
+	}
+	return fmt.Sprintf("%d %s", e.StatusCode, msg)
+}
+
+// decodeError returns the Error for a failed response.
+func decodeError(resp *http.Response, body []byte) *Error {
+	e := &Error{StatusCode: resp.StatusCode}
+	decoded := struct {
+		Error  string            ` + "`json:\"error\"`" + `
+		Errors map[string]string ` + "`json:\"errors\"`" + `
+	}{}
+	if json.Unmarshal(body, &decoded) == nil {
+		e.Message, e.Errors = decoded.Error, decoded.Errors
+	} else {
+		e.Message = strings.TrimSpace(string(body))
+	}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		e.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return e
+}
+
+// do makes a request, decoding a successful JSON response into result.
+func (c *Client) do(ctx context.Context, method string, path string, query url.Values, body interface{}, result interface{}) error {
+	u := c.BaseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	var payload *bytes.Reader
+	if body != nil {
+		j, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(j)
+	} else {
+		payload = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token := c.Token(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if c.APIKey != "" {
+		req.Header.Set("{{.APIKeyHeader}}", c.APIKey)
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 400 {
+		return decodeError(resp, respBody)
+	}
+	if result != nil && len(respBody) > 0 {
+		return json.Unmarshal(respBody, result)
+	}
+	return nil
+}
+{{if .LoginPath}}
+// MFARequiredError is returned by Login for users with two factor
+// authentication on. Finish logging in with Verify.
+type MFARequiredError struct {
+	Token string // Pass to Verify
+}
+
+func (e *MFARequiredError) Error() string {
+	return "two factor authentication required"
+}
+
+// tokenResponse is the body of a successful login.
+type tokenResponse struct {
+	Token       string ` + "`json:\"token\"`" + `
+	MFARequired bool   ` + "`json:\"mfa_required\"`" + `
+	MFAToken    string ` + "`json:\"mfa_token\"`" + `
+}
+
+// Login logs in with details (eg. {"name": ..., "password": ...}) and sends
+// the token it gets with later requests. Users with two factor
+// authentication on get a *MFARequiredError.
+func (c *Client) Login(ctx context.Context, details map[string]interface{}) error {
+	result := tokenResponse{}
+	if err := c.do(ctx, "POST", {{printf "%q" .LoginPath}}, nil, details, &result); err != nil {
+		return err
+	}
+	if result.MFARequired {
+		return &MFARequiredError{Token: result.MFAToken}
+	}
+	c.SetToken(result.Token)
+	return nil
+}
+
+// Verify finishes logging in a user with two factor authentication on, with
+// the token from a *MFARequiredError and a code from their authenticator app.
+func (c *Client) Verify(ctx context.Context, mfaToken string, code string) error {
+	result := tokenResponse{}
+	body := map[string]string{"mfa_token": mfaToken, "code": code}
+	if err := c.do(ctx, "POST", {{printf "%q" (print .LoginPath "/verify")}}, nil, body, &result); err != nil {
+		return err
+	}
+	c.SetToken(result.Token)
+	return nil
+}
+
+// Refresh replaces the token with a new one, before it expires (see TokenExpiry).
+func (c *Client) Refresh(ctx context.Context) error {
+	result := tokenResponse{}
+	if err := c.do(ctx, "POST", {{printf "%q" (print .LoginPath "/refresh")}}, nil, nil, &result); err != nil {
+		return err
+	}
+	c.SetToken(result.Token)
+	return nil
+}
+{{end}}
+// ListOptions are the options for listing items.
+type ListOptions struct {
+	Query url.Values // Added to the URL, eg. for filters understood by the server
+}
+
+// query returns opts.Query, or nil if opts is nil.
+func (opts *ListOptions) query() url.Values {
+	if opts == nil {
+		return nil
+	}
+	return opts.Query
+}
+{{range .Types}}
+{{.}}
+{{end}}
+{{range $s := .Services}}
+// {{.Name}}Service calls the routes at {{.Path}}.
+type {{.Name}}Service struct {
+	client *Client
+}
+{{if .Actions.index}}
+// List returns the {{.Model}}s.
+func (s *{{.Name}}Service) List(ctx context.Context, {{range .Params}}{{.}}, {{end}}opts *ListOptions) ([]{{.Model}}, error) {
+	var result []{{.Model}}
+	err := s.client.do(ctx, "GET", {{.PathExp}}, opts.query(), nil, &result)
+	return result, err
+}
+{{end}}{{if .Actions.get}}
+// Get returns the {{.Model}} with id.
+func (s *{{.Name}}Service) Get(ctx context.Context, {{range .Params}}{{.}}, {{end}}id {{.IDType}}) (*{{.Model}}, error) {
+	result := &{{.Model}}{}
+	if err := s.client.do(ctx, "GET", {{.PathExp}}+"/"+url.PathEscape(fmt.Sprint(id)), nil, nil, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+{{end}}{{if .Actions.create}}
+// Create creates item, returning the {{.Model}} stored.
+func (s *{{.Name}}Service) Create(ctx context.Context, {{range .Params}}{{.}}, {{end}}item *{{.Model}}) (*{{.Model}}, error) {
+	result := &{{.Model}}{}
+	if err := s.client.do(ctx, "POST", {{.PathExp}}, nil, item, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+{{end}}{{if .Actions.update}}
+// Patch changes the fields of the {{.Model}} with id which are set in fields
+// (eg. a map), returning the {{.Model}} stored.
+func (s *{{.Name}}Service) Patch(ctx context.Context, {{range .Params}}{{.}}, {{end}}id {{.IDType}}, fields interface{}) (*{{.Model}}, error) {
+	result := &{{.Model}}{}
+	if err := s.client.do(ctx, "PATCH", {{.PathExp}}+"/"+url.PathEscape(fmt.Sprint(id)), nil, fields, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+{{end}}{{if .Actions.delete}}
+// Delete deletes the {{.Model}} with id, returning it.
+func (s *{{.Name}}Service) Delete(ctx context.Context, {{range .Params}}{{.}}, {{end}}id {{.IDType}}) (*{{.Model}}, error) {
+	result := &{{.Model}}{}
+	if err := s.client.do(ctx, "DELETE", {{.PathExp}}+"/"+url.PathEscape(fmt.Sprint(id)), nil, nil, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+{{end}}{{end}}`))
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type ClientPart struct {
+	Name string `json:"name"`
+}
+
+type ClientWidget struct {
+	ID        uint              `gorm:"primary_key" json:"id"`
+	Name      string            `json:"name"`
+	Parts     []ClientPart      `json:"parts"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Parent    *ClientWidget     `json:"parent"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+func TestGoClient(t *testing.T) {
+	widget := reflect.TypeOf(ClientWidget{})
+	a := &apiServer{options: &Options{}, loginPath: "/auth", routes: []*route{
+		{method: "GET", path: "/api/client_widgets", action: ACTION_INDEX, model: widget},
+		{method: "HEAD", path: "/api/client_widgets", implicit: true},
+		{method: "GET", path: "/api/client_widgets/:id", action: ACTION_GET, model: widget},
+		{method: "POST", path: "/api/client_widgets", action: ACTION_CREATE, model: widget},
+		{method: "PATCH", path: "/api/client_widgets/:id", action: ACTION_UPDATE, model: widget},
+		{method: "DELETE", path: "/api/client_widgets/:id", action: ACTION_DELETE, model: widget},
+		{method: "GET", path: "/api/users/:user_id/client_widgets", action: ACTION_INDEX, model: widget},
+		{method: "POST", path: "/auth", action: ""},
+	}}
+	source, err := a.GoClient("client")
+	if err != nil {
+		t.Fatalf("Can't generate client: %v\n%s", err, source)
+	}
+
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "client.go", source, 0)
+	if err != nil {
+		t.Fatalf("Can't parse client: %v", err)
+	}
+	conf := types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+	pkg, err := conf.Check("client", fset, []*ast.File{file}, nil)
+	if err != nil {
+		t.Fatalf("Client doesn't compile: %v\n%s", err, source)
+	}
+	for name, methods := range map[string][]string{
+		"ClientWidgetsService":      {"List", "Get", "Create", "Patch", "Delete"},
+		"UsersClientWidgetsService": {"List"},
+		"Client":                    {"Login", "Verify", "Refresh", "Token", "SetToken", "TokenExpiry"},
+	} {
+		obj := pkg.Scope().Lookup(name)
+		if obj == nil {
+			t.Errorf("Client has no %s", name)
+			continue
+		}
+		set := types.NewMethodSet(types.NewPointer(obj.Type()))
+		exported := 0
+		for i := 0; i < set.Len(); i++ {
+			if set.At(i).Obj().Exported() {
+				exported++
+			}
+		}
+		if exported != len(methods) {
+			t.Errorf("%s should have %d methods, has %v", name, len(methods), set)
+		}
+		for _, m := range methods {
+			if set.Lookup(pkg, m) == nil {
+				t.Errorf("%s has no method %s", name, m)
+			}
+		}
+	}
+	for _, expected := range []string{
+		"func (s *ClientWidgetsService) Get(ctx context.Context, id uint) (*ClientWidget, error)",
+		"func (s *UsersClientWidgetsService) List(ctx context.Context, userID string, opts *ListOptions) ([]ClientWidget, error)",
+		"Parent    *ClientWidget     `json:\"parent\"`",
+		"Labels    map[string]string `json:\"labels,omitempty\"`",
+		"ID        uint              `json:\"id\"` // Read only",
+	} {
+		if !strings.Contains(string(source), expected) {
+			t.Errorf("Client should contain %s", expected)
+		}
+	}
+}
+
+func TestGoArgName(t *testing.T) {
+	for name, expected := range map[string]string{"user_id": "userID", "id": "id", "api_key": "apiKey", "type": "typeParam"} {
+		if arg := goArgName(name); arg != expected {
+			t.Errorf("goArgName(%q) should be %q, got %q", name, expected, arg)
+		}
+	}
+}
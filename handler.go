@@ -0,0 +1,119 @@
+package api
+
+import (
+	"net/http"
+	"reflect"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/inject"
+	"github.com/go-martini/martini"
+)
+
+// Handler implements API interface for Handler(). It serves the recorded
+// routes itself, so martini's router and middleware aren't involved.
+func (api *apiServer) Handler() http.Handler {
+	return http.HandlerFunc(api.serveHTTP)
+}
+
+// serveHTTP runs the handlers of the first route matching r. HEAD requests run
+// the GET route, as martini does.
+func (api *apiServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	method := r.Method
+	if method == "HEAD" {
+		method = "GET"
+	}
+	for _, rt := range api.routes {
+		if rt.method != method || rt.handlers == nil {
+			continue
+		}
+		if params, ok := pathParams(rt.path, r.URL.Path); ok {
+			c := api.newRouteContext(w, r, params, rt.handlers)
+			defer c.recover()
+			c.run()
+			return
+		}
+	}
+	if api.options.MethodNotAllowed {
+		api.methodNotAllowed(w, r)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// routeContext is the martini.Context given to a route's handlers by
+// Handler(). Its injector falls back to the martini instance's, so services
+// mapped there with Map are still found.
+type routeContext struct {
+	inject.Injector
+	handlers []martini.Handler
+	rw       martini.ResponseWriter
+	index    int
+}
+
+func (api *apiServer) newRouteContext(w http.ResponseWriter, r *http.Request, params martini.Params, handlers []martini.Handler) *routeContext {
+	c := &routeContext{Injector: inject.New(), handlers: handlers, rw: martini.NewResponseWriter(w)}
+	c.SetParent(api.martini.Injector)
+	c.MapTo(c, (*martini.Context)(nil))
+	c.MapTo(c.rw, (*http.ResponseWriter)(nil))
+	c.Map(r)
+	c.Map(params)
+	c.Map(api)
+	return c
+}
+
+// Next implements martini.Context, running the remaining handlers.
+func (c *routeContext) Next() {
+	c.index++
+	c.run()
+}
+
+// Written implements martini.Context.
+func (c *routeContext) Written() bool {
+	return c.rw.Written()
+}
+
+// run invokes the handlers in turn until one writes the response.
+func (c *routeContext) run() {
+	for c.index < len(c.handlers) {
+		vals, err := c.Invoke(c.handlers[c.index])
+		if err != nil {
+			panic(err)
+		}
+		c.index++
+		if len(vals) > 0 {
+			writeReturn(c.rw, vals)
+		}
+		if c.Written() {
+			return
+		}
+	}
+}
+
+// recover stands in for martini.Recovery: a panicking handler is logged and
+// answered with a 500, if nothing has been written yet.
+func (c *routeContext) recover() {
+	if err := recover(); err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Handler panicked")
+		if !c.Written() {
+			writeJSONError(c.rw, 500, "Internal Server Error")
+		}
+	}
+}
+
+// writeReturn writes a handler's return values the way martini's default
+// ReturnHandler does: an optional int status, then a []byte or string body.
+func writeReturn(w http.ResponseWriter, vals []reflect.Value) {
+	body := vals[0]
+	if len(vals) > 1 && vals[0].Kind() == reflect.Int {
+		w.WriteHeader(int(vals[0].Int()))
+		body = vals[1]
+	}
+	if body.Kind() == reflect.Interface || body.Kind() == reflect.Ptr {
+		body = body.Elem()
+	}
+	if body.Kind() == reflect.Slice && body.Type().Elem().Kind() == reflect.Uint8 {
+		w.Write(body.Bytes())
+	} else {
+		w.Write([]byte(body.String()))
+	}
+}
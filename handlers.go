@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -28,10 +29,23 @@ type Request struct {
 	Method   string // 'GET', 'POST', 'PUT', 'PATCH' or 'DELETE'
 	Result   interface{}
 	Uploaded interface{}
+	Tenant   string // The tenant ID of the request, if Options.Tenancy is set
+
+	// The real user, if the logged in user is being impersonated. See AddImpersonationRoute.
+	Impersonator *Impersonator
+
+	// For hooks which don't use martini's injector. See Hook.
+	Writer      http.ResponseWriter
+	HTTPRequest *http.Request
+	Params      map[string]string // The route's :params, eg. Params["id"]
+	User        LoginModel        // The logged in user. Set when a Hook is called, or by an Authenticate Hook
+
+	ctx      context.Context // See Context()
+	original interface{}     // PATCH only. A copy of the item as it was loaded, for BeforeUpdateHook
 }
 
 // options.Authenticate may either be a bool (and if true we return our default auth handler),
-// or a handler, in which case we return this.
+// an AuthStrategy, a Hook, or a handler, in which case we return this.
 func (api *apiServer) getAuthenticateHandler(auth interface{}) martini.Handler {
 	if auth == nil {
 		return nil
@@ -40,6 +54,10 @@ func (api *apiServer) getAuthenticateHandler(auth interface{}) martini.Handler {
 		if bauth {
 			return api.IsAuthenticated()
 		}
+	} else if strategy, ok := auth.(AuthStrategy); ok {
+		return AnyOf(strategy)
+	} else if hook, ok := asHook(auth); ok {
+		return authenticateHook(hook)
 	} else {
 		return auth
 	}
@@ -49,37 +67,74 @@ func (api *apiServer) getAuthenticateHandler(auth interface{}) martini.Handler {
 // buildHandlerList returns a list of handlers for a request.
 // TODO? have a replaceResult handler (or maybe a options.DontSend) that prevents us
 // sending the results and lets us be used as pure middleware
-func (api *apiServer) buildHandlerList(method string, options RouteOptions, dbHandler martini.Handler) []martini.Handler {
+func (api *apiServer) buildHandlerList(method string, itemType reflect.Type, options RouteOptions, dbHandler martini.Handler) []martini.Handler {
+	var afterRead martini.Handler
+	if method == "GET" {
+		afterRead = afterReadHandler(itemType)
+	}
 	return api.handlerList(
-		bindRequestHandler(method),
+		api.bindRequestHandler(method, itemType),
+		api.rateLimitHandler(method, options),
 		api.getAuthenticateHandler(options.Authenticate),
+		scopeHandler(options.RequiredScopes),
+		api.impersonationStep(options),
+		api.tenantMemberStep(options),
+		api.rateLimitUserStep(method, options),
+		requirementHandler(options.requirement),
 		options.Authorize,
+		options.ownerQuery,
 		options.Query,
 		dbHandler,
+		afterRead,
 		options.EditResult,
 		sendResult)
 }
 
-// Concatenate all non nil arguments into a handler list.
+// impersonationStep returns the impersonationHandler for an authenticated
+// route, or nil.
+func (api *apiServer) impersonationStep(options RouteOptions) martini.Handler {
+	if api.getAuthenticateHandler(options.Authenticate) == nil {
+		return nil
+	}
+	return impersonationHandler(options.RefuseImpersonation)
+}
+
+// Concatenate all non nil arguments into a handler list, adapting any Hooks
+// to martini handlers. Each is preceded by cancelledHandler, so a cancelled
+// request stops between handlers.
 func (api *apiServer) handlerList(handlers ...martini.Handler) []martini.Handler {
-	result := make([]martini.Handler, 0, 5)
+	result := make([]martini.Handler, 0, 10)
 	if api.options.HttpLatency > 0 && martini.Env != martini.Prod {
 		result = append(result, api.SleepHandler())
 	}
 	for _, handler := range handlers {
 		if handler != nil {
-			result = append(result, handler)
+			result = append(result, cancelledHandler, martiniHandler(handler))
 		}
 	}
 	return result
 }
 
 // bindRequestHandler creates an empty api request object and binds it to the
-// martini
-func bindRequestHandler(method string) martini.Handler {
-	return func(c martini.Context, a API) {
-		req := Request{DB: a.DB(), API: a, Method: method}
+// martini, with the request's context. If itemType is tenant scoped (see Tenancy) the request's DB is
+// scoped to the request's tenant.
+func (api *apiServer) bindRequestHandler(method string, itemType reflect.Type) martini.Handler {
+	_, scoped := api.tenantField(itemType)
+	return func(c martini.Context, a API, w http.ResponseWriter, r *http.Request, params martini.Params) {
+		ctx := r.Context()
+		req := Request{DB: withContext(a.DB(), ctx), API: a, Method: method, Writer: w, HTTPRequest: r, Params: params, ctx: ctx}
+		if api.options.Tenancy != nil {
+			req.Tenant = api.resolveTenant(r)
+		}
+		if scoped {
+			if req.Tenant == "" {
+				writeNoTenant(w, r)
+				return
+			}
+			req.DB = req.DB.Where(api.tenantQuery(itemType), req.Tenant)
+		}
 		c.Map(&req)
+		c.MapTo(ctx, (*context.Context)(nil))
 	}
 }
 
@@ -107,7 +162,7 @@ func getItemHandler(itemType reflect.Type) martini.Handler {
 // itemHandlers returns a handler function list for retrieving a single item from the gorm DB by
 // item type.
 func (api *apiServer) itemHandlers(itemType reflect.Type, options RouteOptions) []martini.Handler {
-	return api.buildHandlerList("GET", options, getItemHandler(itemType))
+	return api.buildHandlerList("GET", itemType, options, getItemHandler(itemType))
 }
 
 // indexHandlers returns a handler function list for retrieving an index of functions from the gorm DB by
@@ -118,18 +173,25 @@ func (api *apiServer) indexHandlers(sliceType reflect.Type, options RouteOptions
 		req.DB.Find(items)
 		req.Result = items
 	}
-	return api.buildHandlerList("GET", options, indexHandler)
+	return api.buildHandlerList("GET", sliceType.Elem(), options, indexHandler)
 }
 
 // postHandlers returns a handler function list for posting a single item to the DB
 func (api *apiServer) postHandlers(itemType reflect.Type, options RouteOptions) []martini.Handler {
 	return api.handlerList(
-		bindRequestHandler("POST"),
+		api.bindRequestHandler("POST", itemType),
+		api.rateLimitHandler("POST", options),
 		api.getAuthenticateHandler(options.Authenticate),
+		scopeHandler(options.RequiredScopes),
+		api.impersonationStep(options),
+		api.tenantMemberStep(options),
+		api.rateLimitUserStep("POST", options),
+		requirementHandler(options.requirement),
 		options.Authorize,
-		jsonParseBody(itemType),
+		jsonParseBody(itemType, api.bodyDecoder("POST", itemType, options)),
+		options.ownerUpload,
 		options.CheckUpload,
-		doCreate(itemType),
+		api.doCreate(itemType),
 		options.EditResult,
 		sendResult)
 }
@@ -138,12 +200,11 @@ func (api *apiServer) postHandlers(itemType reflect.Type, options RouteOptions)
 func (api *apiServer) patchHandlers(itemType reflect.Type, options RouteOptions) []martini.Handler {
 	//unmarshal the uploaded body into req.Result. req.Result should already contain the retrieved item,
 	//we will now contain the updated version.
+	decode := api.bodyDecoder("PATCH", itemType, options)
 	copyItem := func(req *Request, w http.ResponseWriter, r *http.Request, c martini.Context) {
-		body := httpBody(r)
 		beforeID, _ := getID(req.Result)
-		if err := json.Unmarshal(body, req.Result); err != nil {
-			log.WithFields(log.Fields{"error": err}).Warn("Can't parse incoming json")
-			w.WriteHeader(422) // unprocessable entity
+		req.original = deepCopy(req.Result)
+		if !decode(w, r, c, req.Result) {
 			return
 		}
 		afterID, _ := getID(req.Result)
@@ -164,17 +225,42 @@ func (api *apiServer) patchHandlers(itemType reflect.Type, options RouteOptions)
 			}
 		}
 	}
-	patchHandler := func(params martini.Params, req *Request, w http.ResponseWriter, a API) {
-		a.DB().Save(req.Uploaded)
+	tenantField, tenantScoped := api.tenantField(itemType)
+	patchHandler := func(params martini.Params, req *Request, w http.ResponseWriter, r *http.Request, c martini.Context) {
+		if tenantScoped && !sameTenant(tenantField, req.Uploaded, req.Tenant) {
+			log.WithFields(log.Fields{"tenant": req.Tenant}).Warn("Patch trying to change tenant")
+			w.WriteHeader(403)
+			w.Write([]byte(`{"error":"Can't change tenant"}`))
+			return
+		}
+		if h, ok := req.Uploaded.(BeforeUpdateHook); ok && lifecycleFailed(w, r, "BeforeUpdate", h.APIBeforeUpdate(req, req.original)) {
+			return
+		}
+		save := func(db *gorm.DB) *gorm.DB { return db.Save(req.Uploaded) }
+		if err := api.commitWrite(req, w, r, c, ACTION_UPDATE, req.original, req.Uploaded, save); err != nil {
+			writeFailed(w, r, req, err)
+			return
+		}
 		req.Result = req.Uploaded
+		if h, ok := req.Result.(AfterUpdateHook); ok {
+			afterCommitFailed("AfterUpdate", h.APIAfterUpdate(req))
+		}
 	}
 	return api.handlerList(
-		bindRequestHandler("PATCH"),
+		api.bindRequestHandler("PATCH", itemType),
+		api.rateLimitHandler("PATCH", options),
 		api.getAuthenticateHandler(options.Authenticate),
+		scopeHandler(options.RequiredScopes),
+		api.impersonationStep(options),
+		api.tenantMemberStep(options),
+		api.rateLimitUserStep("PATCH", options),
+		requirementHandler(options.requirement),
 		options.Authorize,
+		options.ownerQuery,
 		options.Query,
 		getItemHandler(itemType),
 		copyItem,
+		options.ownerUpload,
 		options.CheckUpload,
 		patchHandler,
 		options.EditResult,
@@ -186,34 +272,44 @@ func (api *apiServer) deleteHandlers(itemType reflect.Type, options RouteOptions
 	tableName := pluralCamelNameType(itemType)
 	qstring := fmt.Sprintf("%s.id = ?", tableName)
 	//TODO use getItemHandler() as part of deleteHandler
-	deleteHandler := func(params martini.Params, req *Request, w http.ResponseWriter, a API) {
+	deleteHandler := func(params martini.Params, req *Request, w http.ResponseWriter, r *http.Request, c martini.Context) {
 		id := params["id"]
 		item := reflect.New(itemType).Interface()
 		if err := req.DB.Where(qstring, id).Find(item); err.Error != nil {
 			log.WithFields(log.Fields{"error": err}).Info("SQL query finding record to delete")
+			if writeCancelled(w, r, req.Context().Err()) {
+				return
+			}
 			if err.RecordNotFound() {
 				w.WriteHeader(404)
 			} else {
 				w.WriteHeader(500)
 			}
 		} else {
+			if h, ok := item.(BeforeDeleteHook); ok && lifecycleFailed(w, r, "BeforeDelete", h.APIBeforeDelete(req)) {
+				return
+			}
 			log.WithFields(log.Fields{"item": item}).Info("Deleting")
+			remove := func(db *gorm.DB) *gorm.DB { return db.Delete(item) }
+			if err := api.commitWrite(req, w, r, c, ACTION_DELETE, item, nil, remove); err != nil {
+				writeFailed(w, r, req, err)
+				return
+			}
 			req.Result = item
-			a.DB().Delete(item)
+			if h, ok := item.(AfterDeleteHook); ok {
+				afterCommitFailed("AfterDelete", h.APIAfterDelete(req))
+			}
 		}
 	}
-	return api.buildHandlerList("DELETE", options, deleteHandler)
+	return api.buildHandlerList("DELETE", itemType, options, deleteHandler)
 }
 
 // jsonParseBody returns a martini handler that deserialises the json body of a request into
-// a struct, and validates it.
-func jsonParseBody(itemType reflect.Type) martini.Handler {
+// a struct with decode, and validates it.
+func jsonParseBody(itemType reflect.Type, decode bodyDecoder) martini.Handler {
 	return func(req *Request, w http.ResponseWriter, r *http.Request, c martini.Context, params martini.Params) {
-		body := httpBody(r)
 		item := reflect.New(itemType).Interface()
-		if err := json.Unmarshal(body, item); err != nil {
-			log.WithFields(log.Fields{"error": err}).Warn("Can't parse incoming json")
-			w.WriteHeader(422) // unprocessable entity
+		if !decode(w, r, c, item) {
 			return
 		}
 		req.Uploaded = item
@@ -234,20 +330,55 @@ func jsonParseBody(itemType reflect.Type) martini.Handler {
 // add req.Uploaded to the gorm DB. No checks take place in this function. You should have
 // Authorized and Authenticated your user using callbacks, and validated the req.Uploaded
 // structure in the CheckUpload callback.
-func doCreate(itemType reflect.Type) martini.Handler {
-	return func(req *Request, w http.ResponseWriter, a API) {
-		uploaded := req.Uploaded
-		log.Printf("upload is a %T\n", uploaded)
+//
+// If itemType is tenant scoped the request's tenant is stamped on req.Uploaded.
+func (api *apiServer) doCreate(itemType reflect.Type) martini.Handler {
+	tenantField, tenantScoped := api.tenantField(itemType)
+	return func(req *Request, w http.ResponseWriter, r *http.Request, c martini.Context) {
+		if tenantScoped {
+			if err := stampTenant(tenantField, req.Uploaded, req.Tenant); err != nil {
+				log.Warn("Can't set tenant in doCreate: ", err)
+				w.WriteHeader(400)
+				return
+			}
+		}
 
+		if h, ok := req.Uploaded.(BeforeCreateHook); ok && lifecycleFailed(w, r, "BeforeCreate", h.APIBeforeCreate(req)) {
+			return
+		}
 		//item := reflect.New(itemType).Elem().Interface()
-		post := a.DB().Create(req.Uploaded)
-		err := post.Error
+		create := func(db *gorm.DB) *gorm.DB { return db.Create(req.Uploaded) }
+		err := api.commitWrite(req, w, r, c, ACTION_CREATE, nil, req.Uploaded, create)
+		if writeCancelled(w, r, req.Context().Err()) {
+			return
+		}
 		if err != nil {
 			log.Warn("Error creating in doCreate: ", err)
 			w.WriteHeader(422)
+			return
 		}
 		req.Result = req.Uploaded
+		if h, ok := req.Result.(AfterCreateHook); ok {
+			afterCommitFailed("AfterCreate", h.APIAfterCreate(req))
+		}
+	}
+}
+
+// commitWrite makes a change to the database with write, recording it in the
+// audit log if Options.Audit is set (see auditedWrite). Once it's committed
+// the change is sent to webhook subscribers if Options.Webhooks is set.
+func (api *apiServer) commitWrite(req *Request, w http.ResponseWriter, r *http.Request, c martini.Context, action string, before interface{}, after interface{}, write func(db *gorm.DB) *gorm.DB) error {
+	if err := api.auditedWrite(req, w, r, c, action, before, after, write); err != nil {
+		return err
 	}
+	if api.webhooks != nil {
+		if after != nil {
+			api.emitWebhook(req, c, action, after)
+		} else {
+			api.emitWebhook(req, c, action, before)
+		}
+	}
+	return nil
 }
 
 // SleepHandler sleeps for millisecs to emulate latency during development.
@@ -142,21 +142,39 @@ func getTestApi() API {
 
 // Test a request to the api.
 func testReq(t *testing.T, name string, method string, path string, body string, expectedCode int) string {
-	api := getTestApi()
+	return testReqHeaders(t, name, method, path, body, nil, expectedCode).Body.String()
+}
+
+// Test a request to the api with extra request headers. Returns the recorded
+// response so headers can be checked.
+func testReqHeaders(t *testing.T, name string, method string, path string, body string, headers map[string]string, expectedCode int) *httptest.ResponseRecorder {
+	return testApiReq(t, getTestApi(), name, method, path, body, headers, expectedCode)
+}
+
+// testRemoteAddr is the client address of requests made by testApiReq, as
+// set by httptest.NewRequest.
+const testRemoteAddr = "192.0.2.1:1234"
+
+// Test a request to an api other than the singleton returned by getTestApi().
+func testApiReq(t *testing.T, api API, name string, method string, path string, body string, headers map[string]string, expectedCode int) *httptest.ResponseRecorder {
 	payload := strings.NewReader(body)
+	httpRecorder := httptest.NewRecorder()
 	req, err := http.NewRequest(method, path, payload)
 	if err != nil {
 		t.Errorf("Error creating request for %v: %v\n", path, err)
-		return ""
+		return httpRecorder
+	}
+	req.RemoteAddr = testRemoteAddr
+	for k, v := range headers {
+		req.Header.Set(k, v)
 	}
-	httpRecorder := httptest.NewRecorder()
 	api.Martini().ServeHTTP(httpRecorder, req)
 	if httpRecorder.Code == expectedCode {
 		t.Logf("SUCCESS - %v returned code %v and body %s\n", name, httpRecorder.Code, httpRecorder.Body.String())
 	} else {
 		t.Errorf("%v should have code %v. Got %v and body %s\n", name, expectedCode, httpRecorder.Code, httpRecorder.Body.String())
 	}
-	return httpRecorder.Body.String()
+	return httpRecorder
 }
 
 // ensurePanic is A deferrable function that fails the test with msg if there
@@ -0,0 +1,126 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-martini/martini"
+)
+
+// Hook is a RouteOptions handler which doesn't depend on martini's injector.
+// Authenticate, Authorize, Query, CheckUpload and EditResult may each be a
+// Hook, or a plain func(*Request) error, instead of a martini.Handler.
+//
+// Everything a hook needs is on the Request: the response Writer, the
+// HTTPRequest, the route Params and the logged in User. Returning an error
+// stops the request, with a status code chosen by writeHookError. A hook may
+// also write its own response, which stops the request too.
+type Hook func(req *Request) error
+
+// HTTPError is returned by a Hook to stop the request with status Code and
+// a JSON {"error": Message} body.
+type HTTPError struct {
+	Code    int
+	Message string
+}
+
+func (e *HTTPError) Error() string {
+	return e.Message
+}
+
+// StatusCode implements StatusError.
+func (e *HTTPError) StatusCode() int {
+	return e.Code
+}
+
+// StatusError is implemented by errors which choose the status code sent
+// when they are returned by a Hook or a lifecycle hook, eg. *HTTPError.
+type StatusError interface {
+	error
+	StatusCode() int
+}
+
+// Errorf returns an *HTTPError with status code and a formatted message,
+// eg. return api.Errorf(403, "Widget %d is locked", id).
+func Errorf(code int, format string, a ...interface{}) error {
+	return &HTTPError{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// asHook returns h as a Hook, if it is one.
+func asHook(h martini.Handler) (Hook, bool) {
+	switch f := h.(type) {
+	case Hook:
+		return f, true
+	case func(*Request) error:
+		return Hook(f), true
+	}
+	return nil, false
+}
+
+// writeHookError sends the response for an error returned by a Hook. A
+// StatusError is sent with its StatusCode(), a cancelled context as for
+// writeCancelled, and anything else as a 500. A hook which finds nothing
+// should return eg. Errorf(404, "Not Found").
+func writeHookError(w http.ResponseWriter, r *http.Request, err error) {
+	if e, ok := err.(StatusError); ok {
+		writeJSONError(w, e.StatusCode(), e.Error())
+		return
+	}
+	switch err {
+	case context.Canceled, context.DeadlineExceeded:
+		writeCancelled(w, r, err)
+		return
+	}
+	log.WithFields(log.Fields{"error": err}).Error("Hook failed")
+	writeJSONError(w, 500, "Internal Server Error")
+}
+
+// runHook calls hook with req, after bringing req.Writer and req.User up to
+// date from the context. A User set by the hook is mapped into the context
+// for the martini handlers which follow. Returns false if the request should
+// stop.
+func runHook(hook Hook, c martini.Context, req *Request, w http.ResponseWriter) bool {
+	req.Writer = w
+	if req.User == nil {
+		if user := c.Get(loginModelType); user.IsValid() {
+			req.User = user.Interface().(LoginModel)
+		}
+	}
+	hadUser := req.User != nil
+	if err := hook(req); err != nil {
+		writeHookError(w, req.HTTPRequest, err)
+		return false
+	}
+	if !hadUser && req.User != nil {
+		c.Map(req.User)
+	}
+	return true
+}
+
+// martiniHandler adapts a Hook to a martini.Handler. Anything else is
+// returned unchanged, so existing martini handlers keep working.
+func martiniHandler(h martini.Handler) martini.Handler {
+	hook, ok := asHook(h)
+	if !ok {
+		return h
+	}
+	return func(c martini.Context, req *Request, w http.ResponseWriter) {
+		runHook(hook, c, req, w)
+	}
+}
+
+// authenticateHook adapts a Hook used as RouteOptions.Authenticate. The hook
+// must set req.User, or the request gets a 401.
+func authenticateHook(hook Hook) martini.Handler {
+	return func(c martini.Context, req *Request, w http.ResponseWriter) {
+		if !runHook(hook, c, req, w) || req.User != nil {
+			return
+		}
+		if rw, ok := w.(martini.ResponseWriter); !ok || !rw.Written() {
+			w.WriteHeader(401)
+			fmt.Fprintf(w, "Unauthorized")
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-martini/martini"
+)
+
+func TestHooks(t *testing.T) {
+	a := New(Options{JwtKey: "RandomString", Db: getTestDb(), Martini: getSilentMartini()})
+	a.SetAuth(&User{}, "/auth")
+	a.AddDefaultRoutes(&Widget{}, RouteOptions{
+		UriModelName: "hook_widgets",
+		Authenticate: Hook(func(req *Request) error {
+			if req.HTTPRequest.Header.Get("X-User") == "" {
+				return Errorf(401, "No user")
+			}
+			req.User = &User{ID: 1, Name: req.HTTPRequest.Header.Get("X-User")}
+			return nil
+		}),
+		Authorize: func(req *Request) error {
+			if req.Params["id"] == "2" {
+				return Errorf(403, "Widget %s is locked", req.Params["id"])
+			}
+			if req.Params["id"] == "3" {
+				return errors.New("Database on fire")
+			}
+			return nil
+		},
+		// martini handlers still work alongside hooks, and see the User set by one.
+		Query: func(req *Request, user LoginModel) {
+			req.DB = req.DB.Where("widgets.id <= ?", 3)
+		},
+		EditResult: func(req *Request) error {
+			req.Result = fmt.Sprintf("%s:%v", req.User.(*User).Name, req.Result.(*Widget).Name)
+			return nil
+		},
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("/", a.Handler())
+	for _, c := range []struct {
+		path, user string
+		code       int
+		body       string
+	}{
+		{"/api/hook_widgets/1", "", 401, `{"error":"No user"}`},
+		{"/api/hook_widgets/1", "alice", 200, `"alice:Widget 1"`},
+		{"/api/hook_widgets/2", "alice", 403, `{"error":"Widget 2 is locked"}`},
+		{"/api/hook_widgets/3", "alice", 500, `{"error":"Internal Server Error"}`},
+	} {
+		r, _ := http.NewRequest("GET", c.path, nil)
+		if c.user != "" {
+			r.Header.Set("X-User", c.user)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != c.code || w.Body.String() != c.body {
+			t.Errorf("GET %s as %q should return %d %s, got %d %s", c.path, c.user, c.code, c.body, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestAuthenticateHookWithoutUser(t *testing.T) {
+	a := New(Options{Db: getTestDb(), Martini: getSilentMartini()})
+	a.AddIndexRoute(&Widget{}, RouteOptions{
+		UriModelName: "anonymous_widgets",
+		Authenticate: func(req *Request) error { return nil },
+	})
+	testApiReq(t, a, "Authenticate hook which sets no User", "GET", "/api/anonymous_widgets", "", nil, 401)
+}
+
+func TestAsHook(t *testing.T) {
+	for _, h := range []martini.Handler{
+		Hook(func(*Request) error { return nil }),
+		func(*Request) error { return nil },
+	} {
+		if _, ok := asHook(h); !ok {
+			t.Errorf("%T should be a Hook", h)
+		}
+	}
+	for _, h := range []martini.Handler{
+		func(*Request) {},
+		func(req *Request, w http.ResponseWriter) error { return nil },
+	} {
+		if _, ok := asHook(h); ok {
+			t.Errorf("%T shouldn't be a Hook", h)
+		}
+		if fmt.Sprint(martiniHandler(h)) != fmt.Sprint(h) {
+			t.Errorf("martiniHandler should return %T unchanged", h)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package api
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-martini/martini"
+)
+
+// Impersonator is mapped into the request context, and set as
+// Request.Impersonator, when the request uses a token from the route added by
+// AddImpersonationRoute. The LoginModel in the context is then the user being
+// impersonated, and Impersonator.User the real (acting) user.
+type Impersonator struct {
+	ID   uint
+	User LoginModel
+}
+
+// actClaim is the JWT claim holding the id of the acting user.
+const actClaim = "act"
+
+var (
+	impersonatorType = reflect.TypeOf((*Impersonator)(nil))
+	requestType      = reflect.TypeOf((*Request)(nil))
+)
+
+// GetImpersonator returns the acting user if the request is impersonated, or
+// nil.
+func GetImpersonator(c martini.Context) *Impersonator {
+	v := c.Get(impersonatorType)
+	if !v.IsValid() {
+		return nil
+	}
+	return v.Interface().(*Impersonator)
+}
+
+// mapImpersonator maps the acting user of token into c, if it has one.
+func (api *apiServer) mapImpersonator(token *jwt.Token, c martini.Context) error {
+	act, ok := token.Claims[actClaim].(float64)
+	if !ok {
+		return nil
+	}
+	actor, err := api.loginModelById(uint(act))
+	if err != nil {
+		return err
+	}
+	c.Map(&Impersonator{ID: uint(act), User: actor})
+	return nil
+}
+
+// isWrite returns true for methods which change data.
+func isWrite(method string) bool {
+	return method != "GET" && method != "HEAD" && method != "OPTIONS"
+}
+
+// impersonationHandler returns a handler which refuses impersonated requests
+// if refuse is set, and otherwise records the acting user on the Request and
+// logs impersonated writes with both identities.
+func impersonationHandler(refuse bool) martini.Handler {
+	return func(w http.ResponseWriter, r *http.Request, c martini.Context) {
+		impersonator := GetImpersonator(c)
+		if impersonator == nil {
+			return
+		}
+		if refuse {
+			log.WithFields(log.Fields{"impersonator": impersonator.ID, "path": r.URL.Path}).Warn("Impersonated request refused")
+			writeJSONError(w, 403, "Not allowed while impersonating")
+			return
+		}
+		if v := c.Get(requestType); v.IsValid() {
+			v.Interface().(*Request).Impersonator = impersonator
+		}
+		if isWrite(r.Method) {
+			fields := log.Fields{"impersonator": impersonator.ID, "method": r.Method, "path": r.URL.Path}
+			if user := c.Get(loginModelType); user.IsValid() {
+				if id, ok := userID(user.Interface()); ok {
+					fields["user"] = id
+				}
+			}
+			log.WithFields(fields).Info("Impersonated write")
+		}
+	}
+}
+
+// AddImpersonationRoute implements API interface for AddImpersonationRoute()
+func (api *apiServer) AddImpersonationRoute(path string, options ...RouteOptions) {
+	routeOptions := adminOptions(withScopes(applyPolicy(nil, ACTION_CREATE, getOptions(options, ROUTE_WRITE)), "impersonate"))
+	log.WithFields(log.Fields{"path": path}).Info("Adding impersonation route")
+
+	api.addRoute("POST", path+"/:id", "", nil, routeOptions, api.handlerList(
+		api.bindRequestHandler("POST", nil),
+		api.getAuthenticateHandler(routeOptions.Authenticate),
+		scopeHandler(routeOptions.RequiredScopes),
+		// Impersonated sessions can't impersonate somebody else.
+		impersonationHandler(true),
+		api.tenantMemberStep(routeOptions),
+		requirementHandler(routeOptions.requirement),
+		routeOptions.Authorize,
+		func(req *Request, params martini.Params, w http.ResponseWriter, c martini.Context) {
+			actor := ownershipUser(w, c)
+			if actor == nil {
+				return
+			}
+			id, err := strconv.ParseUint(params["id"], 10, 64)
+			if err != nil {
+				writeJSONError(w, 404, "Not found")
+				return
+			}
+			actorID, ok := userID(actor)
+			if !ok {
+				writeNoUserID(w, actor)
+				return
+			}
+			if uint(id) == actorID {
+				writeJSONError(w, 422, "Can't impersonate yourself")
+				return
+			}
+			user, err := api.loginModelById(uint(id))
+			if err != nil || (req.Tenant != "" && !isTenantMember(user, req.Tenant)) {
+				writeJSONError(w, 404, "Not found")
+				return
+			}
+			claims := api.userClaims(uint(id))
+			claims[actClaim] = actorID
+			log.WithFields(log.Fields{"impersonator": actorID, "user": id}).Warn("Impersonation started")
+			req.Result = map[string]string{"token": api.signToken(claims, api.jwtExpiry())}
+		},
+		sendResult))
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestImpersonation(t *testing.T) {
+	db := getTestDb()
+	db.DropTable(&WidgetClone{})
+	db.CreateTable(&WidgetClone{})
+	customer := User{Name: "customer", Password: "password"}
+	db.Create(&customer)
+
+	a := New(Options{JwtKey: "RandomString", Db: db, Martini: getSilentMartini()})
+	a.SetAuth(&User{}, "/auth")
+	a.AddImpersonationRoute("/impersonate")
+	a.AddDefaultRoutes(&Widget{}, RouteOptions{Authenticate: true, Authorize: func(req *Request, w http.ResponseWriter) {
+		if req.Impersonator != nil {
+			w.Header().Set("X-Impersonator", fmt.Sprint(req.Impersonator.ID))
+		}
+	}})
+	a.AddIndexRoute(&WidgetClone{}, RouteOptions{Authenticate: true, RefuseImpersonation: true})
+
+	admin := "?access_token=" + a.GetJWTToken(1)
+	asCustomer := fmt.Sprintf("/impersonate/%d", customer.ID)
+	testApiReq(t, a, "Impersonate(No token)", "POST", asCustomer, "", nil, 401)
+	testApiReq(t, a, "Impersonate(Not admin)", "POST", "/impersonate/1?access_token="+a.GetJWTToken(customer.ID), "", nil, 403)
+	testApiReq(t, a, "Impersonate(Unknown user)", "POST", "/impersonate/4242"+admin, "", nil, 404)
+	body := testApiReq(t, a, "Impersonate", "POST", asCustomer+admin, "", nil, 200).Body.String()
+	acting := "?access_token=" + getToken(body)
+
+	testApiReq(t, a, "Impersonated(Read)", "GET", "/api/widgets"+acting, "", nil, 200)
+	rec := testApiReq(t, a, "Impersonated(Write)", "POST", "/api/widgets"+acting, `{"name":"Support"}`, nil, 200)
+	if rec.Header().Get("X-Impersonator") != "1" {
+		t.Errorf("Impersonator not recorded on write: %v", rec.Header())
+	}
+	testApiReq(t, a, "Impersonated(Refused route)", "GET", "/api/widget_clones"+acting, "", nil, 403)
+	testApiReq(t, a, "Impersonated(Refused route, real user)", "GET", "/api/widget_clones"+admin, "", nil, 200)
+	testApiReq(t, a, "Impersonated(Chain)", "POST", "/impersonate/1"+acting, "", nil, 403)
+	testApiReq(t, a, "Impersonated(Mint)", "POST", "/auth/scoped"+acting, `{"scopes":["widgets:read"]}`, nil, 403)
+}
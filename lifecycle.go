@@ -0,0 +1,171 @@
+package api
+
+import (
+	"net/http"
+	"reflect"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-martini/martini"
+)
+
+// Models may implement any of these lifecycle interfaces. The default routes
+// find them by type assertion, as for NeedsValidation, and call them in the
+// order below. An error from a Before hook stops the request: see
+// writeHookError for the status code sent. An After hook runs once the change
+// is committed, so its error is only logged and the change is still sent.
+//
+// The methods are prefixed with API because gorm calls model methods named
+// BeforeCreate, AfterCreate, BeforeUpdate, AfterUpdate, BeforeDelete and
+// AfterDelete itself, and refuses any it doesn't know how to call.
+
+// BeforeCreateHook is called on req.Uploaded by POST, after CheckUpload and
+// before it is created.
+type BeforeCreateHook interface {
+	APIBeforeCreate(req *Request) error
+}
+
+// AfterCreateHook is called on req.Result by POST once it is created.
+type AfterCreateHook interface {
+	APIAfterCreate(req *Request) error
+}
+
+// BeforeUpdateHook is called on the patched item by PATCH, after CheckUpload
+// and before it is saved. old is a copy of the item as it was loaded.
+type BeforeUpdateHook interface {
+	APIBeforeUpdate(req *Request, old interface{}) error
+}
+
+// AfterUpdateHook is called on req.Result by PATCH once it is saved.
+type AfterUpdateHook interface {
+	APIAfterUpdate(req *Request) error
+}
+
+// BeforeDeleteHook is called on the item by DELETE before it is deleted.
+type BeforeDeleteHook interface {
+	APIBeforeDelete(req *Request) error
+}
+
+// AfterDeleteHook is called on req.Result by DELETE once it is deleted.
+type AfterDeleteHook interface {
+	APIAfterDelete(req *Request) error
+}
+
+// AfterReadHook is called by GET on the item, and by the index on each item,
+// after they are loaded and before EditResult.
+type AfterReadHook interface {
+	APIAfterRead(req *Request) error
+}
+
+var afterReadHookType = reflect.TypeOf((*AfterReadHook)(nil)).Elem()
+
+// lifecycleFailed writes the response for an error returned by a lifecycle
+// hook. Returns false if err is nil.
+func lifecycleFailed(w http.ResponseWriter, r *http.Request, hook string, err error) bool {
+	if err == nil {
+		return false
+	}
+	log.WithFields(log.Fields{"hook": hook, "error": err}).Warn("Lifecycle hook failed")
+	writeHookError(w, r, err)
+	return true
+}
+
+// afterCommitFailed logs an error returned by an After hook. The change is
+// already committed, so the request still succeeds.
+func afterCommitFailed(hook string, err error) {
+	if err != nil {
+		log.WithFields(log.Fields{"hook": hook, "error": err}).Error("Lifecycle hook failed after commit")
+	}
+}
+
+// deepCopy returns a pointer to a copy of the struct item points to. The
+// copy shares no pointers, slices or maps with item, except inside
+// unexported fields (eg. a time.Time's location), so decoding a PATCH body
+// into item leaves it as it was.
+func deepCopy(item interface{}) interface{} {
+	return copyValue(reflect.ValueOf(item), map[copiedPointer]reflect.Value{}).Interface()
+}
+
+// copiedPointer identifies a pointer already copied by copyValue, so shared
+// and cyclic pointers are copied once.
+type copiedPointer struct {
+	address uintptr
+	t       reflect.Type
+}
+
+// copyValue returns a deep copy of v.
+func copyValue(v reflect.Value, copied map[copiedPointer]reflect.Value) reflect.Value {
+	c := reflect.New(v.Type()).Elem()
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			break
+		}
+		key := copiedPointer{v.Pointer(), v.Type()}
+		if p, ok := copied[key]; ok {
+			c.Set(p)
+			break
+		}
+		p := reflect.New(v.Type().Elem())
+		copied[key] = p
+		p.Elem().Set(copyValue(v.Elem(), copied))
+		c.Set(p)
+	case reflect.Interface:
+		if !v.IsNil() {
+			c.Set(copyValue(v.Elem(), copied))
+		}
+	case reflect.Slice:
+		if v.IsNil() {
+			break
+		}
+		c.Set(reflect.MakeSlice(v.Type(), v.Len(), v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(copyValue(v.Index(i), copied))
+		}
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(copyValue(v.Index(i), copied))
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			break
+		}
+		c.Set(reflect.MakeMap(v.Type()))
+		for _, k := range v.MapKeys() {
+			c.SetMapIndex(k, copyValue(v.MapIndex(k), copied))
+		}
+	case reflect.Struct:
+		c.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if c.Field(i).CanSet() {
+				c.Field(i).Set(copyValue(v.Field(i), copied))
+			}
+		}
+	default:
+		c.Set(v)
+	}
+	return c
+}
+
+// afterReadHandler returns a handler calling AfterReadHook on the item or
+// items in req.Result, or nil if itemType doesn't implement it.
+func afterReadHandler(itemType reflect.Type) martini.Handler {
+	if !reflect.PtrTo(itemType).Implements(afterReadHookType) {
+		return nil
+	}
+	return func(req *Request, w http.ResponseWriter, r *http.Request) {
+		v := reflect.ValueOf(req.Result)
+		if v.Kind() != reflect.Ptr || v.IsNil() {
+			return
+		}
+		if v.Elem().Kind() != reflect.Slice {
+			lifecycleFailed(w, r, "AfterRead", req.Result.(AfterReadHook).APIAfterRead(req))
+			return
+		}
+		for i := 0; i < v.Elem().Len(); i++ {
+			item := v.Elem().Index(i).Addr().Interface().(AfterReadHook)
+			if lifecycleFailed(w, r, "AfterRead", item.APIAfterRead(req)) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// LifecycleWidget records the lifecycle hooks called on it in lifecycleCalls.
+// Its Name chooses which hook fails, eg. "refuse create".
+type LifecycleWidget struct {
+	ID       uint    `gorm:"primary_key" json:"id"`
+	Name     string  `json:"name"`
+	Secret   string  `json:"secret"`
+	Nickname *string `json:"nickname"`
+}
+
+var lifecycleCalls []string
+
+func (w *LifecycleWidget) called(hook string) error {
+	lifecycleCalls = append(lifecycleCalls, hook)
+	switch w.Name {
+	case "refuse " + hook:
+		return Errorf(409, "Refused %s", hook)
+	case "break " + hook:
+		return errors.New("Broken")
+	}
+	return nil
+}
+
+func (w *LifecycleWidget) APIBeforeCreate(req *Request) error { return w.called("create") }
+func (w *LifecycleWidget) APIAfterCreate(req *Request) error  { return w.called("created") }
+func (w *LifecycleWidget) APIBeforeUpdate(req *Request, old interface{}) error {
+	lifecycleCalls = append(lifecycleCalls, "from "+old.(*LifecycleWidget).Name)
+	if nickname := old.(*LifecycleWidget).Nickname; nickname != nil {
+		lifecycleCalls = append(lifecycleCalls, "nickname was "+*nickname)
+	}
+	return w.called("update")
+}
+func (w *LifecycleWidget) APIAfterUpdate(req *Request) error { return w.called("updated") }
+func (w *LifecycleWidget) APIBeforeDelete(req *Request) error {
+	return w.called("delete")
+}
+func (w *LifecycleWidget) APIAfterDelete(req *Request) error { return w.called("deleted") }
+func (w *LifecycleWidget) APIAfterRead(req *Request) error {
+	w.Secret = ""
+	return w.called("read")
+}
+
+func TestLifecycleHooks(t *testing.T) {
+	a := getTestApi()
+	db := a.DB()
+	db.DropTable(&LifecycleWidget{})
+	db.CreateTable(&LifecycleWidget{})
+	a.AddDefaultRoutes(&LifecycleWidget{})
+
+	expectCalls := func(name string, expected ...string) {
+		if strings.Join(lifecycleCalls, ",") != strings.Join(expected, ",") {
+			t.Errorf("%s should call %v, called %v", name, expected, lifecycleCalls)
+		}
+		lifecycleCalls = nil
+	}
+
+	body := testReq(t, "Lifecycle(POST)", "POST", "/api/lifecycle_widgets", `{"name":"one","secret":"shh"}`, 200)
+	expectCalls("POST", "create", "created")
+	created := LifecycleWidget{}
+	json.Unmarshal([]byte(body), &created)
+	path := fmt.Sprintf("/api/lifecycle_widgets/%d", created.ID)
+
+	body = testReq(t, "Lifecycle(GET)", "GET", path, "", 200)
+	expectCalls("GET", "read")
+	if strings.Contains(body, "shh") {
+		t.Errorf("AfterRead should have removed the secret: %s", body)
+	}
+	testReq(t, "Lifecycle(Index)", "GET", "/api/lifecycle_widgets", "", 200)
+	expectCalls("Index", "read")
+
+	testReq(t, "Lifecycle(PATCH)", "PATCH", path, `{"name":"two"}`, 200)
+	expectCalls("PATCH", "from one", "update", "updated")
+
+	body = testReq(t, "Lifecycle(Refused PATCH)", "PATCH", path, `{"name":"refuse update"}`, 409)
+	expectCalls("Refused PATCH", "from two", "update")
+	if body != `{"error":"Refused update"}` {
+		t.Errorf("Unexpected body for refused update: %s", body)
+	}
+	check := LifecycleWidget{}
+	db.First(&check, created.ID)
+	if check.Name != "two" {
+		t.Errorf("Refused update was saved: %v", check)
+	}
+	// old must keep pointer fields as they were, not as the body set them.
+	testReq(t, "Lifecycle(PATCH pointer)", "PATCH", path, `{"nickname":"first"}`, 200)
+	expectCalls("PATCH pointer", "from two", "update", "updated")
+	testReq(t, "Lifecycle(PATCH pointer again)", "PATCH", path, `{"nickname":"second"}`, 200)
+	expectCalls("PATCH pointer again", "from two", "nickname was first", "update", "updated")
+	testReq(t, "Lifecycle(Failed AfterUpdate)", "PATCH", path, `{"name":"refuse updated"}`, 200)
+	expectCalls("Failed AfterUpdate", "from two", "nickname was second", "update", "updated")
+
+	testReq(t, "Lifecycle(Refused POST)", "POST", "/api/lifecycle_widgets", `{"name":"refuse create"}`, 409)
+	expectCalls("Refused POST", "create")
+	testReq(t, "Lifecycle(Broken POST)", "POST", "/api/lifecycle_widgets", `{"name":"break create"}`, 500)
+	expectCalls("Broken POST", "create")
+	count := 0
+	db.Model(&LifecycleWidget{}).Count(&count)
+	if count != 1 {
+		t.Errorf("Refused creates were saved: %d widgets", count)
+	}
+
+	testReq(t, "Lifecycle(DELETE)", "DELETE", path, "", 200)
+	expectCalls("DELETE", "delete", "deleted")
+}
+
+func TestDeepCopy(t *testing.T) {
+	type node struct {
+		Name  *string
+		Tags  []string
+		Attrs map[string]int
+		At    time.Time
+		Next  *node
+	}
+	name := "one"
+	item := &node{Name: &name, Tags: []string{"a"}, Attrs: map[string]int{"x": 1}, At: time.Unix(10, 0)}
+	item.Next = item
+	c := deepCopy(item).(*node)
+	*item.Name, item.Tags[0], item.Attrs["x"] = "changed", "changed", 2
+	if *c.Name != "one" || c.Tags[0] != "a" || c.Attrs["x"] != 1 || !c.At.Equal(time.Unix(10, 0)) {
+		t.Errorf("Copy should keep its values, got %+v", c)
+	}
+	if c.Next != c {
+		t.Errorf("A cycle should be copied as a cycle")
+	}
+}
+
+func TestWriteHookError(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/api/widgets", nil)
+	for _, c := range []struct {
+		err  error
+		code int
+	}{
+		{Errorf(409, "Conflict"), 409},
+		{Errorf(404, "Not Found"), 404},
+		{context.DeadlineExceeded, 503},
+		{errors.New("Broken"), 500},
+	} {
+		w := httptest.NewRecorder()
+		writeHookError(w, r, c.err)
+		if w.Code != c.code {
+			t.Errorf("writeHookError(%v) should send %d, sent %d", c.err, c.code, w.Code)
+		}
+	}
+}
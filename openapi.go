@@ -0,0 +1,400 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-martini/martini"
+)
+
+// OpenAPIVersion is the version of the OpenAPI specification followed by the
+// document returned by OpenAPI().
+const OpenAPIVersion = "3.1.0"
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaBuilder builds JSON Schemas for Go types as encoding/json would
+// marshal them. Named structs are added to defs and referenced by $ref.
+type schemaBuilder struct {
+	defs   map[string]interface{}
+	prefix string       // Prefix of $ref, eg. "#/components/schemas/"
+	root   reflect.Type // If set, referred to as "#" rather than added to defs
+}
+
+func newSchemaBuilder(prefix string) *schemaBuilder {
+	return &schemaBuilder{defs: map[string]interface{}{}, prefix: prefix}
+}
+
+// schema returns the schema for t.
+func (b *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+	nullable := false
+	for t.Kind() == reflect.Ptr {
+		t, nullable = t.Elem(), true
+	}
+	s := b.valueSchema(t)
+	if typ, ok := s["type"].(string); ok && nullable {
+		s["type"] = []string{typ, "null"}
+	}
+	return s
+}
+
+// valueSchema returns the schema for t, which isn't a pointer.
+func (b *schemaBuilder) valueSchema(t reflect.Type) map[string]interface{} {
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	pt := reflect.PtrTo(t)
+	if pt.Implements(jsonUnmarshalerType) {
+		return map[string]interface{}{}
+	}
+	if pt.Implements(textUnmarshalerType) && t.Kind() != reflect.Map {
+		return map[string]interface{}{"type": "string"}
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.structSchema(t)
+		}
+		if t == b.root {
+			return map[string]interface{}{"$ref": "#"}
+		}
+		if _, ok := b.defs[t.Name()]; !ok {
+			b.defs[t.Name()] = nil // Placeholder for recursive types
+			b.defs[t.Name()] = b.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": b.prefix + t.Name()}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Slice, reflect.Array:
+		if expected(t) == "string" {
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Interface:
+		return map[string]interface{}{}
+	}
+	s := map[string]interface{}{"type": expected(t)}
+	switch t.Kind() {
+	case reflect.Int32, reflect.Uint32:
+		s["format"] = "int32"
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64:
+		s["format"] = "int64"
+	case reflect.Float32:
+		s["format"] = "float"
+	case reflect.Float64:
+		s["format"] = "double"
+	}
+	if t.Kind() >= reflect.Uint && t.Kind() <= reflect.Uintptr {
+		s["minimum"] = 0
+	}
+	return s
+}
+
+// structSchema returns the object schema for struct t, including the
+// validation options in its api tags (see applyAPITag).
+func (b *schemaBuilder) structSchema(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := []string{}
+	for _, f := range jsonFields(t) {
+		s := b.schema(f.Type)
+		if strings.Contains(f.Tag.Get("json"), ",string") {
+			s = map[string]interface{}{"type": "string"}
+		}
+		if readOnlyField(f) {
+			s["readOnly"] = true
+		}
+		if applyAPITag(f, s) {
+			required = append(required, jsonName(f))
+		}
+		properties[jsonName(f)] = s
+	}
+	s := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+// readOnlyField returns true for fields set by the database rather than by
+// clients: primary keys and gorm's timestamps.
+func readOnlyField(f reflect.StructField) bool {
+	if strings.Contains(f.Tag.Get("gorm"), "primary_key") {
+		return true
+	}
+	switch f.Name {
+	case "ID", "CreatedAt", "UpdatedAt", "DeletedAt":
+		return true
+	}
+	return false
+}
+
+// openAPIPath converts a martini path to an OpenAPI one, returning it and
+// its parameter names. eg. "/api/depts/:dept_id" gives "/api/depts/{dept_id}".
+func openAPIPath(path string) (string, []string) {
+	params := []string{}
+	parts := strings.Split(path, "/")
+	for i, p := range parts {
+		if strings.HasPrefix(p, ":") {
+			params = append(params, p[1:])
+			parts[i] = "{" + p[1:] + "}"
+		}
+	}
+	return strings.Join(parts, "/"), params
+}
+
+// securitySchemes returns the OpenAPI security scheme names for a route's
+// Authenticate option, or nil if it can't be described.
+func securitySchemes(auth interface{}) []string {
+	if b, ok := auth.(bool); ok && b {
+		return []string{"bearerAuth"}
+	}
+	if s, ok := auth.(AuthStrategy); ok {
+		switch s.Name() {
+		case "jwt":
+			return []string{"bearerAuth"}
+		case "api_key":
+			return []string{"apiKeyAuth"}
+		case "basic":
+			return []string{"basicAuth"}
+		case "cookie":
+			return []string{"cookieAuth"}
+		}
+	}
+	return nil
+}
+
+// jsonContent returns an OpenAPI content map for a JSON schema.
+func jsonContent(schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+}
+
+// errorResponse returns an OpenAPI response for one of the API's errors.
+func errorResponse(description string) map[string]interface{} {
+	return map[string]interface{}{"description": description}
+}
+
+// operation returns the OpenAPI operation for r.
+func (api *apiServer) operation(r *route, b *schemaBuilder, params []string) map[string]interface{} {
+	op := map[string]interface{}{}
+	responses := map[string]interface{}{}
+	ok := map[string]interface{}{"description": "OK", "content": jsonContent(map[string]interface{}{})}
+	if r.model != nil {
+		name := pluralCamelNameType(r.model)
+		op["tags"] = []string{name}
+		op["operationId"] = r.action + r.model.Name()
+		item := b.schema(r.model)
+		ok["content"] = jsonContent(item)
+		switch r.action {
+		case ACTION_INDEX:
+			op["summary"] = "List " + name
+			op["operationId"] = r.action + r.model.Name() + "s"
+			ok["content"] = jsonContent(map[string]interface{}{"type": "array", "items": item})
+		case ACTION_GET:
+			op["summary"] = "Get one of " + name
+		case ACTION_CREATE:
+			op["summary"] = "Create one of " + name
+		case ACTION_UPDATE:
+			op["summary"] = "Update fields of one of " + name
+		case ACTION_DELETE:
+			op["summary"] = "Delete one of " + name
+		}
+		if r.action == ACTION_CREATE || r.action == ACTION_UPDATE {
+			op["requestBody"] = map[string]interface{}{"required": true, "content": jsonContent(item)}
+			responses["413"] = errorResponse("Request body too large")
+			responses["422"] = errorResponse("Invalid request body")
+		}
+		if r.action != ACTION_INDEX && r.action != ACTION_CREATE {
+			responses["404"] = errorResponse("Not found")
+		}
+	} else {
+		op["summary"] = r.method + " " + r.path
+		if isWrite(r.method) {
+			op["requestBody"] = map[string]interface{}{"content": jsonContent(map[string]interface{}{"type": "object"})}
+		}
+	}
+	responses["200"] = ok
+
+	if len(params) > 0 {
+		parameters := make([]interface{}, 0, len(params))
+		for _, p := range params {
+			parameters = append(parameters, map[string]interface{}{"name": p, "in": "path", "required": true,
+				"schema": map[string]interface{}{"type": "string"}})
+		}
+		op["parameters"] = parameters
+	}
+
+	if api.getAuthenticateHandler(r.options.Authenticate) != nil {
+		responses["401"] = errorResponse("Unauthorized")
+		scopes := r.options.RequiredScopes
+		if scopes == nil {
+			scopes = []string{}
+		}
+		if schemes := securitySchemes(r.options.Authenticate); schemes != nil {
+			security := []interface{}{}
+			for _, s := range schemes {
+				security = append(security, map[string]interface{}{s: scopes})
+			}
+			op["security"] = security
+		} else {
+			op["x-authentication"] = "custom"
+		}
+	} else {
+		op["security"] = []interface{}{}
+	}
+	if r.options.requirement != "" && r.options.requirement != POLICY_PUBLIC {
+		op["x-requirement"] = r.options.requirement
+	}
+	if r.options.requirement != "" || len(r.options.RequiredScopes) > 0 || r.options.Authorize != nil {
+		responses["403"] = errorResponse("Forbidden")
+	}
+	op["responses"] = responses
+	return op
+}
+
+// OpenAPI implements API interface for OpenAPI().
+func (api *apiServer) OpenAPI() map[string]interface{} {
+	b := newSchemaBuilder("#/components/schemas/")
+	paths := map[string]interface{}{}
+	operationIds := map[string]int{}
+	for _, r := range api.routes {
+		if r.implicit || r.method == "OPTIONS" || r.method == "HEAD" {
+			continue
+		}
+		path, params := openAPIPath(r.path)
+		item, ok := paths[path].(map[string]interface{})
+		if !ok {
+			item = map[string]interface{}{}
+			paths[path] = item
+		}
+		op := api.operation(r, b, params)
+		if id, ok := op["operationId"].(string); ok {
+			// The same model may be added at more than one path.
+			if operationIds[id]++; operationIds[id] > 1 {
+				op["operationId"] = fmt.Sprintf("%s%d", id, operationIds[id])
+			}
+		}
+		item[strings.ToLower(r.method)] = op
+	}
+
+	title, version := api.options.APITitle, api.options.APIVersion
+	if title == "" {
+		title = "API"
+	}
+	if version == "" {
+		version = "1.0"
+	}
+	return map[string]interface{}{
+		"openapi": OpenAPIVersion,
+		"info":    map[string]interface{}{"title": title, "version": version},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": b.defs,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+				"apiKeyAuth": map[string]interface{}{"type": "apiKey", "in": "header", "name": api.apiKeyHeader()},
+				"basicAuth":  map[string]interface{}{"type": "http", "scheme": "basic"},
+				"cookieAuth": map[string]interface{}{"type": "apiKey", "in": "cookie", "name": api.sessionCookieName()},
+			},
+		},
+	}
+}
+
+// AddOpenAPIRoute implements API interface for AddOpenAPIRoute(). The routes
+// are governed by the "index" entry of any RouteOptions.Policy.
+func (api *apiServer) AddOpenAPIRoute(path string, options ...RouteOptions) {
+	readOptions := withScopes(applyPolicy(nil, ACTION_INDEX, getOptions(options, ROUTE_READ)), "openapi:read")
+	log.WithFields(log.Fields{"path": path}).Info("Adding OpenAPI routes")
+	handlers := func(h martini.Handler) []martini.Handler {
+		return api.handlerList(
+			api.bindRequestHandler("GET", nil),
+			api.getAuthenticateHandler(readOptions.Authenticate),
+			scopeHandler(readOptions.RequiredScopes),
+			api.impersonationStep(readOptions),
+			api.tenantMemberStep(readOptions),
+			requirementHandler(readOptions.requirement),
+			readOptions.Authorize,
+			h)
+	}
+	api.addRoute("GET", path, "", nil, readOptions, handlers(func(w http.ResponseWriter) []byte {
+		j, _ := json.Marshal(api.OpenAPI())
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		return j
+	}))
+	api.addRoute("GET", path+"/ui", "", nil, readOptions, handlers(func(w http.ResponseWriter) []byte {
+		// encoding/json escapes <, > and &, so the document can't end the script.
+		j, _ := json.Marshal(api.OpenAPI())
+		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		return []byte(strings.Replace(openAPIViewer, "{{document}}", string(j), 1))
+	}))
+}
+
+// openAPIViewer is a page listing the operations in an OpenAPI document,
+// with no dependencies.
+const openAPIViewer = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>API</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+details { border: 1px solid #ddd; border-radius: 4px; margin: 0.5em 0; padding: 0.5em; }
+summary { cursor: pointer; }
+.method { display: inline-block; width: 5em; font-weight: bold; text-transform: uppercase; }
+.get { color: #2a7ab0; } .post { color: #2f9e44; } .patch { color: #d9822b; } .delete { color: #c92a2a; }
+pre { background: #f6f8fa; padding: 0.5em; overflow: auto; }
+</style>
+</head>
+<body>
+<h1 id="title"></h1>
+<div id="operations"></div>
+<h2>Schemas</h2>
+<div id="schemas"></div>
+<script>
+var doc = {{document}};
+function text(tag, s, cls) {
+  var e = document.createElement(tag);
+  e.textContent = s;
+  if (cls) e.className = cls;
+  return e;
+}
+function block(title, value) {
+  var d = document.createElement("div");
+  d.appendChild(text("h4", title));
+  d.appendChild(text("pre", JSON.stringify(value, null, 2)));
+  return d;
+}
+document.title = doc.info.title;
+document.getElementById("title").textContent = doc.info.title + " " + doc.info.version;
+var ops = document.getElementById("operations");
+Object.keys(doc.paths).sort().forEach(function(path) {
+  Object.keys(doc.paths[path]).forEach(function(method) {
+    var op = doc.paths[path][method];
+    var d = document.createElement("details");
+    var s = document.createElement("summary");
+    s.appendChild(text("span", method, "method " + method));
+    s.appendChild(text("code", path));
+    s.appendChild(text("span", " " + (op.summary || "")));
+    d.appendChild(s);
+    if (op.security && op.security.length) d.appendChild(block("Security", op.security));
+    if (op.parameters) d.appendChild(block("Parameters", op.parameters));
+    if (op.requestBody) d.appendChild(block("Request body", op.requestBody.content));
+    d.appendChild(block("Responses", op.responses));
+    ops.appendChild(d);
+  });
+});
+var schemas = document.getElementById("schemas");
+Object.keys(doc.components.schemas).sort().forEach(function(name) {
+  var d = document.createElement("details");
+  d.appendChild(text("summary", name));
+  d.appendChild(text("pre", JSON.stringify(doc.components.schemas[name], null, 2)));
+  schemas.appendChild(d);
+});
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type openAPIPart struct {
+	Name string `json:"name"`
+}
+
+type openAPIOrder struct {
+	ID        uint              `gorm:"primary_key" json:"id"`
+	Total     float64           `json:"total"`
+	Note      *string           `json:"note"`
+	Parts     []openAPIPart     `json:"parts"`
+	Labels    map[string]string `json:"labels"`
+	Count     int64             `json:"count,string"`
+	Secret    string            `json:"-"`
+	CreatedAt time.Time
+}
+
+func TestSchemaBuilder(t *testing.T) {
+	b := newSchemaBuilder("#/components/schemas/")
+	ref := b.schema(reflect.TypeOf(&openAPIOrder{}))
+	if ref["$ref"] != "#/components/schemas/openAPIOrder" {
+		t.Errorf("Expected a $ref, got %v", ref)
+	}
+	j, _ := json.Marshal(b.defs)
+	expected := `{"openAPIOrder":{"properties":{` +
+		`"CreatedAt":{"format":"date-time","readOnly":true,"type":"string"},` +
+		`"count":{"type":"string"},` +
+		`"id":{"format":"int64","minimum":0,"readOnly":true,"type":"integer"},` +
+		`"labels":{"additionalProperties":{"type":"string"},"type":"object"},` +
+		`"note":{"type":["string","null"]},` +
+		`"parts":{"items":{"$ref":"#/components/schemas/openAPIPart"},"type":"array"},` +
+		`"total":{"format":"double","type":"number"}},"type":"object"},` +
+		`"openAPIPart":{"properties":{"name":{"type":"string"}},"type":"object"}}`
+	if string(j) != expected {
+		t.Errorf("Bad schemas:\n%s\nexpected:\n%s", j, expected)
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	a := New(Options{Db: getTestDb(), Martini: getSilentMartini(), APITitle: "Widgets"})
+	a.AddDefaultRoutes(&Widget{})
+	a.AddIndexRoute(&Widget{}, RouteOptions{Prefix: "/shops/:shop_id", Authenticate: APIKeyStrategy(), RequiredScopes: []string{"shops:read"}})
+	a.AddOpenAPIRoute("/api/openapi")
+
+	doc := a.OpenAPI()
+	if doc["openapi"] != OpenAPIVersion || doc["info"].(map[string]interface{})["title"] != "Widgets" {
+		t.Errorf("Bad document header: %v", doc)
+	}
+	paths := doc["paths"].(map[string]interface{})
+	for path, methods := range map[string][]string{
+		"/api/widgets":                 {"get", "post"},
+		"/api/widgets/{id}":            {"delete", "get", "patch"},
+		"/api/shops/{shop_id}/widgets": {"get"},
+		"/api/openapi":                 {"get"},
+		"/api/openapi/ui":              {"get"},
+	} {
+		item, ok := paths[path].(map[string]interface{})
+		if !ok || len(item) != len(methods) {
+			t.Errorf("Expected %v at %s, got %v", methods, path, paths[path])
+			continue
+		}
+		for _, m := range methods {
+			if _, ok := item[m]; !ok {
+				t.Errorf("Expected %s at %s", m, path)
+			}
+		}
+	}
+	op := paths["/api/shops/{shop_id}/widgets"].(map[string]interface{})["get"].(map[string]interface{})
+	j, _ := json.Marshal([]interface{}{op["operationId"], op["parameters"], op["security"]})
+	if string(j) != `["indexWidgets2",[{"in":"path","name":"shop_id","required":true,"schema":{"type":"string"}}],[{"apiKeyAuth":["shops:read"]}]]` {
+		t.Errorf("Bad prefixed operation: %s", j)
+	}
+
+	rec := testApiReq(t, a, "OpenAPI(Document)", "GET", "/api/openapi", "", nil, 200)
+	served := map[string]interface{}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &served); err != nil || served["openapi"] != OpenAPIVersion {
+		t.Errorf("Bad served document (%v): %s", err, rec.Body.String())
+	}
+	rec = testApiReq(t, a, "OpenAPI(Viewer)", "GET", "/api/openapi/ui", "", nil, 200)
+	if rec.Header().Get("Content-Type") != "text/html; charset=UTF-8" {
+		t.Errorf("Viewer should be html: %v", rec.Header())
+	}
+}
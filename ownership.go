@@ -0,0 +1,143 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-martini/martini"
+	"github.com/serenize/snaker"
+)
+
+// Ownership enables row level ownership for a model with a field tagged
+// `api:"owner"`, which should hold the id of the LoginModel owning the row.
+// Set it as RouteOptions.Ownership. Routes with Ownership are authenticated
+// (with the builtin JWT authentication unless Authenticate is set) and:
+//
+//   - GET, PATCH and DELETE only find rows owned by the logged in user
+//   - POST sets the owner field to the logged in user
+//   - PATCH refuses to change the owner field
+//
+// Users for whom IsSuperuser returns true bypass all of these checks.
+type Ownership struct {
+	// IsSuperuser returns true if user may access rows owned by anybody. If nil
+	// nobody may.
+	IsSuperuser func(user LoginModel) bool
+
+	// UserID returns the id of user to compare with the owner field. Defaults
+	// to the value of the user's ID field.
+	UserID func(user LoginModel) uint
+}
+
+// ownerField returns the field of itemType tagged `api:"owner"`.
+func ownerField(itemType reflect.Type) (reflect.StructField, bool) {
+	for i := 0; i < itemType.NumField(); i++ {
+		field := itemType.Field(i)
+		if hasAPITag(field, "owner") {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// hasAPITag returns true if field's comma separated api tag contains option.
+func hasAPITag(field reflect.StructField, option string) bool {
+	for _, o := range strings.Split(field.Tag.Get("api"), ",") {
+		if strings.TrimSpace(o) == option {
+			return true
+		}
+	}
+	return false
+}
+
+// userID returns the id of the logged in user, or false if it has none.
+func (o *Ownership) userID(user LoginModel) (uint, bool) {
+	if o.UserID != nil {
+		return o.UserID(user), true
+	}
+	return userID(user)
+}
+
+// isSuperuser returns true if user bypasses ownership checks.
+func (o *Ownership) isSuperuser(user LoginModel) bool {
+	return o.IsSuperuser != nil && o.IsSuperuser(user)
+}
+
+// ownershipUser returns the logged in user from the context, or writes a 401
+// and returns nil.
+func ownershipUser(w http.ResponseWriter, c martini.Context) LoginModel {
+	user := c.Get(loginModelType)
+	if !user.IsValid() {
+		w.WriteHeader(401)
+		fmt.Fprintf(w, "Unauthorized")
+		return nil
+	}
+	return user.Interface().(LoginModel)
+}
+
+// applyOwnership returns options with the ownership handlers for modelP set,
+// if options.Ownership is set.
+func applyOwnership(modelP interface{}, options RouteOptions) RouteOptions {
+	ownership := options.Ownership
+	if ownership == nil {
+		return options
+	}
+	itemType := reflect.TypeOf(modelP).Elem()
+	field, ok := ownerField(itemType)
+	if !ok {
+		panic(fmt.Sprintf("RouteOptions.Ownership set, but %v has no field tagged `api:\"owner\"`", itemType))
+	}
+	switch field.Type.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+	default:
+		panic(fmt.Sprintf("The owner field %v.%s must be an integer to hold a user id, not %v", itemType, field.Name, field.Type))
+	}
+	if options.Authenticate == nil {
+		options.Authenticate = true
+	}
+	qstring := fmt.Sprintf("%s.%s = ?", pluralCamelNameType(itemType), snaker.CamelToSnake(field.Name))
+
+	options.ownerQuery = func(w http.ResponseWriter, c martini.Context, req *Request) {
+		user := ownershipUser(w, c)
+		if user == nil || ownership.isSuperuser(user) {
+			return
+		}
+		id, ok := ownership.userID(user)
+		if !ok {
+			writeNoUserID(w, user)
+			return
+		}
+		req.DB = req.DB.Where(qstring, id)
+	}
+
+	options.ownerUpload = func(w http.ResponseWriter, c martini.Context, req *Request) {
+		user := ownershipUser(w, c)
+		if user == nil {
+			return
+		}
+		owner := reflect.ValueOf(req.Uploaded).Elem().FieldByIndex(field.Index)
+		superuser := ownership.isSuperuser(user)
+		userID, ok := ownership.userID(user)
+		if !ok {
+			writeNoUserID(w, user)
+			return
+		}
+		id := reflect.ValueOf(userID).Convert(owner.Type())
+		switch req.Method {
+		case "POST":
+			if !superuser || reflect.DeepEqual(owner.Interface(), reflect.Zero(owner.Type()).Interface()) {
+				owner.Set(id)
+			}
+		case "PATCH":
+			if !superuser && owner.Interface() != id.Interface() {
+				log.WithFields(log.Fields{"owner": owner.Interface(), "user": id.Interface()}).Warn("Patch trying to change owner")
+				w.WriteHeader(403)
+				w.Write([]byte(`{"error":"Only a superuser can change the owner"}`))
+			}
+		}
+	}
+	return options
+}
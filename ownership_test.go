@@ -0,0 +1,81 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+type OwnedWidget struct {
+	ID     uint   `gorm:"primary_key" json:"id"`
+	UserID uint   `json:"user_id" api:"owner"`
+	Name   string `json:"name"`
+}
+
+func TestOwnership(t *testing.T) {
+	a := getTestApi()
+	db := a.DB()
+	db.DropTable(&OwnedWidget{})
+	db.CreateTable(&OwnedWidget{})
+	owner := User{Name: "owner", Password: "password"}
+	db.Create(&owner)
+	defer db.Delete(&owner)
+	mine := OwnedWidget{UserID: owner.ID, Name: "Mine"}
+	theirs := OwnedWidget{UserID: owner.ID + 1000, Name: "Theirs"}
+	db.Create(&mine)
+	db.Create(&theirs)
+
+	ownership := &Ownership{IsSuperuser: func(user LoginModel) bool { return user.(*User).Name == "admin" }}
+	a.AddDefaultRoutes(&OwnedWidget{}, RouteOptions{Ownership: ownership})
+
+	adminq := "?access_token=" + getToken(testReq(t, "Login(admin)", "POST", "/auth", `{"name": "admin", "password": "password"}`, 200))
+	ownerq := "?access_token=" + getToken(testReq(t, "Login(owner)", "POST", "/auth", `{"name": "owner", "password": "password"}`, 200))
+
+	testReq(t, "Ownership(No token)", "GET", "/api/owned_widgets", "", 401)
+	body := testReq(t, "Ownership(Index)", "GET", "/api/owned_widgets"+ownerq, "", 200)
+	widgets := []OwnedWidget{}
+	json.Unmarshal([]byte(body), &widgets)
+	if len(widgets) != 1 || widgets[0].ID != mine.ID {
+		t.Errorf("Index not scoped to owned rows: %s", body)
+	}
+	body = testReq(t, "Ownership(Superuser index)", "GET", "/api/owned_widgets"+adminq, "", 200)
+	widgets = []OwnedWidget{}
+	json.Unmarshal([]byte(body), &widgets)
+	if len(widgets) != 2 {
+		t.Errorf("Superuser index should see all rows: %s", body)
+	}
+
+	testReq(t, "Ownership(Get own)", "GET", fmt.Sprintf("/api/owned_widgets/%d%s", mine.ID, ownerq), "", 200)
+	testReq(t, "Ownership(Get other)", "GET", fmt.Sprintf("/api/owned_widgets/%d%s", theirs.ID, ownerq), "", 404)
+	testReq(t, "Ownership(Patch other)", "PATCH", fmt.Sprintf("/api/owned_widgets/%d%s", theirs.ID, ownerq), `{"name":"Stolen"}`, 404)
+	testReq(t, "Ownership(Delete other)", "DELETE", fmt.Sprintf("/api/owned_widgets/%d%s", theirs.ID, ownerq), "", 404)
+	testReq(t, "Ownership(Transfer)", "PATCH", fmt.Sprintf("/api/owned_widgets/%d%s", mine.ID, ownerq), fmt.Sprintf(`{"user_id":%d}`, theirs.UserID), 403)
+	testReq(t, "Ownership(Patch own)", "PATCH", fmt.Sprintf("/api/owned_widgets/%d%s", mine.ID, ownerq), `{"name":"Still mine"}`, 200)
+	testReq(t, "Ownership(Superuser transfer)", "PATCH", fmt.Sprintf("/api/owned_widgets/%d%s", theirs.ID, adminq), fmt.Sprintf(`{"user_id":%d}`, owner.ID), 200)
+
+	body = testReq(t, "Ownership(Create)", "POST", "/api/owned_widgets"+ownerq, fmt.Sprintf(`{"name":"New","user_id":%d}`, owner.ID+1000), 200)
+	created := OwnedWidget{}
+	json.Unmarshal([]byte(body), &created)
+	if created.UserID != owner.ID {
+		t.Errorf("Create didn't force owner field: %s", body)
+	}
+
+	defer ensurePanic(t, "Ownership accepted a model without an owner field")
+	a.AddIndexRoute(&Widget{}, RouteOptions{UriModelName: "unowned_widgets", Ownership: ownership})
+}
+
+func TestOwnershipFieldType(t *testing.T) {
+	type stringOwned struct {
+		Owner string `api:"owner"`
+	}
+	type pointerOwned struct {
+		Owner *uint `api:"owner"`
+	}
+	for _, model := range []interface{}{&stringOwned{}, &pointerOwned{}} {
+		func() {
+			defer ensurePanic(t, fmt.Sprintf("Ownership accepted the owner field of %T", model))
+			applyOwnership(model, RouteOptions{Ownership: &Ownership{}})
+		}()
+	}
+	applyOwnership(&OwnedWidget{}, RouteOptions{Ownership: &Ownership{}})
+}
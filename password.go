@@ -0,0 +1,510 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-martini/martini"
+	"github.com/jinzhu/gorm"
+	"github.com/serenize/snaker"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHasher hashes passwords for PasswordLoginModel.
+type PasswordHasher interface {
+	// Hash returns an encoded hash of password, including its salt and parameters.
+	Hash(password string) (string, error)
+	// Handles returns true if hash was created by this kind of hasher.
+	Handles(hash string) bool
+	// Verify compares password with hash in constant time.
+	Verify(hash string, password string) bool
+	// NeedsRehash returns true if hash was created with different parameters.
+	NeedsRehash(hash string) bool
+}
+
+// BcryptHasher hashes passwords with bcrypt. Cost defaults to bcrypt.DefaultCost.
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h BcryptHasher) cost() int {
+	if h.Cost == 0 {
+		return bcrypt.DefaultCost
+	}
+	return h.Cost
+}
+
+func (h BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.cost())
+	return string(hash), err
+}
+
+func (h BcryptHasher) Handles(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func (h BcryptHasher) Verify(hash string, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+func (h BcryptHasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != h.cost()
+}
+
+// Argon2idHasher hashes passwords with argon2id. Zero fields take the
+// defaults recommended by the argon2 package: Time 1, Memory 64MiB, Threads 4,
+// KeyLen 32 and SaltLen 16.
+type Argon2idHasher struct {
+	Time    uint32
+	Memory  uint32 // KiB
+	Threads uint8
+	KeyLen  uint32
+	SaltLen int
+}
+
+// withDefaults returns h with zero fields set to their defaults.
+func (h Argon2idHasher) withDefaults() Argon2idHasher {
+	if h.Time == 0 {
+		h.Time = 1
+	}
+	if h.Memory == 0 {
+		h.Memory = 64 * 1024
+	}
+	if h.Threads == 0 {
+		h.Threads = 4
+	}
+	if h.KeyLen == 0 {
+		h.KeyLen = 32
+	}
+	if h.SaltLen == 0 {
+		h.SaltLen = 16
+	}
+	return h
+}
+
+func (h Argon2idHasher) Hash(password string) (string, error) {
+	h = h.withDefaults()
+	salt := make([]byte, h.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, h.KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.Memory, h.Time, h.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h Argon2idHasher) Handles(hash string) bool {
+	return strings.HasPrefix(hash, "$argon2id$")
+}
+
+// decode splits an encoded hash into its parameters, salt and key.
+func (h Argon2idHasher) decode(hash string) (params Argon2idHasher, salt []byte, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, errors.New("Not an argon2id hash")
+	}
+	var version int
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return
+	}
+	if version != argon2.Version {
+		return params, nil, nil, errors.New("Unsupported argon2 version")
+	}
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return
+	}
+	params.SaltLen = len(salt)
+	params.KeyLen = uint32(len(key))
+	return params, salt, key, nil
+}
+
+func (h Argon2idHasher) Verify(hash string, password string) bool {
+	params, salt, key, err := h.decode(hash)
+	if err != nil {
+		return false
+	}
+	other := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLen)
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+func (h Argon2idHasher) NeedsRehash(hash string) bool {
+	params, _, _, err := h.decode(hash)
+	return err != nil || params != h.withDefaults()
+}
+
+// passwordHashers are used to verify hashes created by a previous Hasher.
+var passwordHashers = []PasswordHasher{BcryptHasher{}, Argon2idHasher{}}
+
+// PasswordLoginModel implements LoginModel for a user model storing a
+// password hash. Your user model can implement LoginModel by delegating to it:
+//
+//	var passwords = &api.PasswordLoginModel{DB: db, Model: &User{}}
+//	func (_ *User) CheckLoginDetails(j *map[string]interface{}) (uint, error) { return passwords.CheckLoginDetails(j) }
+//	func (_ *User) GetById(id uint) (interface{}, error) { return passwords.GetById(id) }
+//
+// Hashes made by any builtin hasher are accepted, and are replaced on a
+// successful login if they weren't made by Hasher with its current parameters.
+type PasswordLoginModel struct {
+	DB    *gorm.DB
+	Model interface{} // Pointer to the user model, eg. &User{}. It must have an ID field.
+
+	UsernameColumn string         // Column (and login body key) holding the username. Defaults to "name".
+	PasswordField  string         // Field of Model holding the hash. Defaults to "PasswordHash".
+	Hasher         PasswordHasher // Defaults to BcryptHasher{}
+	MinLength      int            // Minimum length of new passwords. Defaults to 8.
+
+	// ResetTokenExpiry is the lifetime of password reset tokens. Defaults to 1 hour.
+	ResetTokenExpiry time.Duration
+	// SendResetToken delivers a password reset token to user (eg. by email).
+	// Required by AddPasswordRoutes.
+	SendResetToken func(user interface{}, token string) error
+
+	dummyOnce sync.Once
+	dummyHash string
+}
+
+// ErrBadPassword is returned when a password doesn't match.
+var ErrBadPassword = errors.New("Incorrect username or password")
+
+// ErrBadResetToken is returned when a reset token is unknown, used or expired.
+var ErrBadResetToken = errors.New("Invalid or expired reset token")
+
+// PasswordResetToken is a single use token for resetting a password, stored in
+// the password_reset_tokens table. Only a hash of the token is stored.
+type PasswordResetToken struct {
+	ID        uint   `gorm:"primary_key"`
+	UserID    uint   `sql:"index"`
+	Hash      string `sql:"unique_index"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+func (p *PasswordLoginModel) hasher() PasswordHasher {
+	if p.Hasher == nil {
+		return BcryptHasher{}
+	}
+	return p.Hasher
+}
+
+func (p *PasswordLoginModel) usernameColumn() string {
+	if p.UsernameColumn == "" {
+		return "name"
+	}
+	return p.UsernameColumn
+}
+
+func (p *PasswordLoginModel) passwordField() string {
+	if p.PasswordField == "" {
+		return "PasswordHash"
+	}
+	return p.PasswordField
+}
+
+func (p *PasswordLoginModel) minLength() int {
+	if p.MinLength == 0 {
+		return 8
+	}
+	return p.MinLength
+}
+
+// newUser returns a pointer to a new, empty user model.
+func (p *PasswordLoginModel) newUser() interface{} {
+	return reflect.New(reflect.TypeOf(p.Model).Elem()).Interface()
+}
+
+// hashField returns the field of user holding the hash.
+func (p *PasswordLoginModel) hashField(user interface{}) reflect.Value {
+	field := reflect.ValueOf(user).Elem().FieldByName(p.passwordField())
+	if !field.IsValid() || field.Kind() != reflect.String {
+		panic(fmt.Sprintf("PasswordLoginModel: %T has no string field %s", user, p.passwordField()))
+	}
+	return field
+}
+
+// verify checks password against hash, with whichever builtin hasher made it.
+// It returns whether the password matched, and whether it needs rehashing.
+func (p *PasswordLoginModel) verify(hash string, password string) (bool, bool) {
+	current := p.hasher()
+	if current.Handles(hash) {
+		return current.Verify(hash, password), current.NeedsRehash(hash)
+	}
+	for _, h := range passwordHashers {
+		if h.Handles(hash) {
+			return h.Verify(hash, password), true
+		}
+	}
+	return false, false
+}
+
+// dummyVerify spends about as long as verify, so missing users can't be told
+// apart from wrong passwords by timing.
+func (p *PasswordLoginModel) dummyVerify(password string) {
+	p.dummyOnce.Do(func() { p.dummyHash, _ = p.hasher().Hash("not a password") })
+	p.hasher().Verify(p.dummyHash, password)
+}
+
+// SetPassword sets the hash field of user (a pointer to the user model). It
+// doesn't save user.
+func (p *PasswordLoginModel) SetPassword(user interface{}, password string) error {
+	if len(password) < p.minLength() {
+		return fmt.Errorf("Password must be at least %d characters", p.minLength())
+	}
+	hash, err := p.hasher().Hash(password)
+	if err != nil {
+		return err
+	}
+	p.hashField(user).SetString(hash)
+	return nil
+}
+
+// savePassword sets and saves the password of user.
+func (p *PasswordLoginModel) savePassword(user interface{}, password string) error {
+	if err := p.SetPassword(user, password); err != nil {
+		return err
+	}
+	column := snaker.CamelToSnake(p.passwordField())
+	return p.DB.Model(user).UpdateColumn(column, p.hashField(user).String()).Error
+}
+
+// CheckLoginDetails implements LoginModel. It expects the username under the
+// UsernameColumn key, and the password under "password".
+func (p *PasswordLoginModel) CheckLoginDetails(j *map[string]interface{}) (uint, error) {
+	username, _ := (*j)[p.usernameColumn()].(string)
+	password, _ := (*j)["password"].(string)
+	user := p.newUser()
+	if username == "" || p.DB.Where(p.usernameColumn()+" = ?", username).First(user).RecordNotFound() {
+		p.dummyVerify(password)
+		return 0, ErrBadPassword
+	}
+	hash := p.hashField(user).String()
+	match, rehash := p.verify(hash, password)
+	if !match {
+		return 0, ErrBadPassword
+	}
+	id, ok := userID(user)
+	if !ok {
+		return 0, fmt.Errorf("%T has no integer ID field", user)
+	}
+	if rehash {
+		if err := p.savePassword(user, password); err != nil {
+			log.WithFields(log.Fields{"id": id, "error": err}).Warn("Can't upgrade password hash")
+		} else {
+			log.WithFields(log.Fields{"id": id}).Info("Upgraded password hash")
+		}
+	}
+	return id, nil
+}
+
+// GetById implements LoginModel.
+func (p *PasswordLoginModel) GetById(id uint) (interface{}, error) {
+	user := p.newUser()
+	if p.DB.Where("id = ?", id).First(user).RecordNotFound() {
+		return user, errors.New("User not found")
+	}
+	return user, nil
+}
+
+// ChangePassword changes the password of the user with id, if oldPassword is correct.
+func (p *PasswordLoginModel) ChangePassword(id uint, oldPassword string, newPassword string) error {
+	user, err := p.GetById(id)
+	if err != nil {
+		return err
+	}
+	if match, _ := p.verify(p.hashField(user).String(), oldPassword); !match {
+		return ErrBadPassword
+	}
+	return p.savePassword(user, newPassword)
+}
+
+// CreateResetToken stores and returns a new reset token for the user with id.
+func (p *PasswordLoginModel) CreateResetToken(id uint) (string, error) {
+	token, err := newAPIKeySecret()
+	if err != nil {
+		return "", err
+	}
+	expiry := p.ResetTokenExpiry
+	if expiry == 0 {
+		expiry = time.Hour
+	}
+	prt := PasswordResetToken{UserID: id, Hash: hashAPIKey(token), ExpiresAt: time.Now().Add(expiry)}
+	return token, p.DB.Create(&prt).Error
+}
+
+// ResetPassword sets a new password for the user a reset token was created
+// for. The token can't be used again.
+func (p *PasswordLoginModel) ResetPassword(token string, newPassword string) error {
+	prt := PasswordResetToken{}
+	if token == "" || p.DB.Where("hash = ?", hashAPIKey(token)).First(&prt).RecordNotFound() ||
+		prt.UsedAt != nil || prt.ExpiresAt.Before(time.Now()) {
+		return ErrBadResetToken
+	}
+	user, err := p.GetById(prt.UserID)
+	if err != nil {
+		return err
+	}
+	if len(newPassword) < p.minLength() {
+		return fmt.Errorf("Password must be at least %d characters", p.minLength())
+	}
+	// Claim the token first, so concurrent requests can't both use it.
+	claim := p.DB.Model(&PasswordResetToken{}).Where("id = ? AND used_at IS NULL", prt.ID).UpdateColumn("used_at", time.Now())
+	if claim.Error != nil || claim.RowsAffected != 1 {
+		return ErrBadResetToken
+	}
+	return p.savePassword(user, newPassword)
+}
+
+// userID returns the ID field of a user model pointer as a uint, or false
+// if it hasn't got an integer ID field.
+func userID(user interface{}) (uint, bool) {
+	id, err := getID(user)
+	if err != nil {
+		return 0, false
+	}
+	v := reflect.ValueOf(id)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return uint(v.Int()), v.Int() >= 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return uint(v.Uint()), true
+	}
+	return 0, false
+}
+
+// writeNoUserID responds to a request whose logged in user has no id we can use.
+func writeNoUserID(w http.ResponseWriter, user interface{}) {
+	log.WithFields(log.Fields{"type": fmt.Sprintf("%T", user)}).Error("LoginModel has no integer ID field")
+	writeJSONError(w, 500, "Internal Server Error")
+}
+
+// passwordUpload is the body accepted by the password routes.
+type passwordUpload struct {
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+	Token       string `json:"token"`
+}
+
+// parsePasswordUpload binds the request body to req.Uploaded.
+func parsePasswordUpload(req *Request, w http.ResponseWriter, r *http.Request, c martini.Context) {
+	upload := passwordUpload{}
+	if !decodeBody(w, r, c, &upload) {
+		return
+	}
+	req.Uploaded = &upload
+}
+
+// writePasswordError writes err as a JSON error with code.
+func writePasswordError(w http.ResponseWriter, code int, err error) {
+	j, _ := json.Marshal(map[string]string{"error": err.Error()})
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	w.Write(j)
+}
+
+// AddPasswordRoutes implements API interface for AddPasswordRoutes()
+func (api *apiServer) AddPasswordRoutes(path string, passwords *PasswordLoginModel, options ...RouteOptions) {
+	if passwords.SendResetToken == nil {
+		panic("AddPasswordRoutes needs PasswordLoginModel.SendResetToken to deliver reset tokens")
+	}
+	if err := passwords.DB.AutoMigrate(&PasswordResetToken{}).Error; err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Can't create password_reset_tokens table")
+	}
+	changeOptions := withScopes(getOptions(options, ROUTE_WRITE), "password:write")
+	if changeOptions.Authenticate == nil {
+		changeOptions.Authenticate = true
+	}
+	log.WithFields(log.Fields{"path": path}).Info("Adding password routes")
+
+	api.addRoute("POST", path+"/change", "", nil, changeOptions, api.handlerList(
+		api.bindRequestHandler("POST", nil),
+		api.getAuthenticateHandler(changeOptions.Authenticate),
+		scopeHandler(changeOptions.RequiredScopes),
+		impersonationHandler(true),
+		api.tenantMemberStep(changeOptions),
+		changeOptions.Authorize,
+		parsePasswordUpload,
+		func(req *Request, w http.ResponseWriter, c martini.Context) {
+			user := c.Get(loginModelType)
+			if !user.IsValid() {
+				w.WriteHeader(401)
+				return
+			}
+			id, ok := userID(user.Interface())
+			if !ok {
+				writeNoUserID(w, user.Interface())
+				return
+			}
+			upload := req.Uploaded.(*passwordUpload)
+			err := passwords.ChangePassword(id, upload.OldPassword, upload.NewPassword)
+			if err == ErrBadPassword {
+				writePasswordError(w, 403, err)
+				return
+			} else if err != nil {
+				writePasswordError(w, 422, err)
+				return
+			}
+			req.Result = map[string]bool{"ok": true}
+		},
+		sendResult))
+
+	api.addRoute("POST", path+"/reset_request", "", nil, RouteOptions{}, api.handlerList(
+		api.bindRequestHandler("POST", nil),
+		ParseJsonBody,
+		func(j *JsonBody, w http.ResponseWriter) {
+			username, _ := (*j)[passwords.usernameColumn()].(string)
+			user := passwords.newUser()
+			// Respond the same whether or not the user exists, so this can't
+			// be used to find usernames.
+			if username != "" && !passwords.DB.Where(passwords.usernameColumn()+" = ?", username).First(user).RecordNotFound() {
+				var token string
+				id, ok := userID(user)
+				err := fmt.Errorf("%T has no integer ID field", user)
+				if ok {
+					token, err = passwords.CreateResetToken(id)
+				}
+				if err == nil {
+					err = passwords.SendResetToken(user, token)
+				}
+				if err != nil {
+					log.WithFields(log.Fields{"error": err}).Error("Can't send password reset token")
+				}
+			}
+			w.WriteHeader(202)
+			w.Write([]byte("{}"))
+		}))
+
+	api.addRoute("POST", path+"/reset", "", nil, RouteOptions{}, api.handlerList(
+		api.bindRequestHandler("POST", nil),
+		parsePasswordUpload,
+		func(req *Request, w http.ResponseWriter) {
+			upload := req.Uploaded.(*passwordUpload)
+			err := passwords.ResetPassword(upload.Token, upload.NewPassword)
+			if err == ErrBadResetToken {
+				writePasswordError(w, 403, err)
+				return
+			} else if err != nil {
+				writePasswordError(w, 422, err)
+				return
+			}
+			req.Result = map[string]bool{"ok": true}
+		},
+		sendResult))
+}
@@ -0,0 +1,110 @@
+package api
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type HashedUser struct {
+	ID           uint   `gorm:"primary_key" json:"id"`
+	Name         string `json:"name"`
+	PasswordHash string `json:"-"`
+}
+
+var testPasswords = &PasswordLoginModel{Model: &HashedUser{}, Hasher: BcryptHasher{Cost: bcrypt.MinCost}}
+
+func (_ *HashedUser) CheckLoginDetails(j *map[string]interface{}) (uint, error) {
+	return testPasswords.CheckLoginDetails(j)
+}
+
+func (_ *HashedUser) GetById(id uint) (interface{}, error) {
+	return testPasswords.GetById(id)
+}
+
+func TestPasswordLoginModel(t *testing.T) {
+	db := getTestDb()
+	db.DropTable(&HashedUser{})
+	db.CreateTable(&HashedUser{})
+	db.DropTable(&PasswordResetToken{})
+	testPasswords.DB = db
+	sentTokens := map[string]string{}
+	testPasswords.SendResetToken = func(user interface{}, token string) error {
+		sentTokens[user.(*HashedUser).Name] = token
+		return nil
+	}
+
+	// Seed with an outdated argon2id hash, which should be upgraded to bcrypt on login.
+	oldHash, _ := Argon2idHasher{Memory: 1024}.Hash("correct horse")
+	user := HashedUser{Name: "hashed", PasswordHash: oldHash}
+	db.Create(&user)
+
+	a := New(Options{JwtKey: "RandomString", Db: db, Martini: getSilentMartini()})
+	a.SetAuth(&HashedUser{}, "/auth")
+	a.AddPasswordRoutes("/password", testPasswords)
+
+	testApiReq(t, a, "Login(Unknown user)", "POST", "/auth", `{"name":"nobody","password":"correct horse"}`, nil, 403)
+	testApiReq(t, a, "Login(Wrong password)", "POST", "/auth", `{"name":"hashed","password":"wrong horse"}`, nil, 403)
+	body := testApiReq(t, a, "Login", "POST", "/auth", `{"name":"hashed","password":"correct horse"}`, nil, 200).Body.String()
+	db.Where("id = ?", user.ID).First(&user)
+	if !strings.HasPrefix(user.PasswordHash, "$2a$") {
+		t.Errorf("Outdated hash wasn't upgraded on login: %s", user.PasswordHash)
+	}
+	tokenq := "?access_token=" + getToken(body)
+
+	testApiReq(t, a, "Change(No token)", "POST", "/password/change", `{"old_password":"correct horse","new_password":"battery staple"}`, nil, 401)
+	testApiReq(t, a, "Change(Wrong password)", "POST", "/password/change"+tokenq, `{"old_password":"wrong horse","new_password":"battery staple"}`, nil, 403)
+	testApiReq(t, a, "Change(Too short)", "POST", "/password/change"+tokenq, `{"old_password":"correct horse","new_password":"short"}`, nil, 422)
+	testApiReq(t, a, "Change", "POST", "/password/change"+tokenq, `{"old_password":"correct horse","new_password":"battery staple"}`, nil, 200)
+	testApiReq(t, a, "Login(Old password)", "POST", "/auth", `{"name":"hashed","password":"correct horse"}`, nil, 403)
+	testApiReq(t, a, "Login(New password)", "POST", "/auth", `{"name":"hashed","password":"battery staple"}`, nil, 200)
+
+	testApiReq(t, a, "ResetRequest(Unknown user)", "POST", "/password/reset_request", `{"name":"nobody"}`, nil, 202)
+	testApiReq(t, a, "ResetRequest", "POST", "/password/reset_request", `{"name":"hashed"}`, nil, 202)
+	token, ok := sentTokens["hashed"]
+	if !ok || len(sentTokens) != 1 {
+		t.Fatalf("Reset tokens not sent correctly: %v", sentTokens)
+	}
+	testApiReq(t, a, "Reset(Wrong token)", "POST", "/password/reset", `{"token":"guess","new_password":"tr0ub4dor&3"}`, nil, 403)
+	testApiReq(t, a, "Reset", "POST", "/password/reset", `{"token":"`+token+`","new_password":"tr0ub4dor&3"}`, nil, 200)
+	testApiReq(t, a, "Reset(Used token)", "POST", "/password/reset", `{"token":"`+token+`","new_password":"hijacked!"}`, nil, 403)
+	testApiReq(t, a, "Login(Reset password)", "POST", "/auth", `{"name":"hashed","password":"tr0ub4dor&3"}`, nil, 200)
+}
+
+// Check the argon2id hasher verifies its own hashes and spots outdated parameters.
+func TestArgon2idHasher(t *testing.T) {
+	h := Argon2idHasher{Memory: 1024}
+	hash, err := h.Hash("password")
+	if err != nil || !h.Handles(hash) {
+		t.Fatalf("Argon2idHasher didn't create a hash: %v %v", hash, err)
+	}
+	if !h.Verify(hash, "password") || h.Verify(hash, "Password") {
+		t.Errorf("Argon2idHasher didn't verify correctly")
+	}
+	if h.NeedsRehash(hash) || !(Argon2idHasher{Memory: 2048}).NeedsRehash(hash) {
+		t.Errorf("Argon2idHasher didn't detect outdated parameters correctly")
+	}
+}
+
+// userID copes with models it can't get an id from.
+func TestUserID(t *testing.T) {
+	type StringID struct{ ID string }
+	type NoID struct{ Name string }
+	for _, c := range []struct {
+		user interface{}
+		id   uint
+		ok   bool
+	}{
+		{&HashedUser{ID: 7}, 7, true},
+		{HashedUser{ID: 7}, 0, false},
+		{(*HashedUser)(nil), 0, false},
+		{&StringID{ID: "7"}, 0, false},
+		{&NoID{}, 0, false},
+		{nil, 0, false},
+	} {
+		if id, ok := userID(c.user); id != c.id || ok != c.ok {
+			t.Errorf("userID(%#v) should be %d, %v. Got %d, %v", c.user, c.id, c.ok, id, ok)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-martini/martini"
+)
+
+// Policy maps an action (ACTION_INDEX, ACTION_GET, ACTION_CREATE,
+// ACTION_UPDATE or ACTION_DELETE) to the requirement for carrying it out.
+// A requirement is one of:
+//
+//	"public"                  anybody, authenticated or not
+//	"any"                     any authenticated user
+//	"role:editor"             an authenticated user with the editor role
+//	"role:editor,role:admin"  an authenticated user with either role
+//
+// Actions missing from the Policy have no requirement beyond any
+// RouteOptions.Authenticate and RouteOptions.Authorize handlers. A Policy
+// requiring authentication will use the builtin JWT authentication unless
+// RouteOptions.Authenticate is set.
+type Policy map[string]string
+
+const (
+	POLICY_PUBLIC = "public"
+	POLICY_ANY    = "any"
+	POLICY_ROLE   = "role:"
+)
+
+// Models implementing HasPolicy declare the Policy for their routes. A Policy
+// in RouteOptions overrides this action by action.
+type HasPolicy interface {
+	Policy() Policy
+}
+
+// A LoginModel implementing HasRoles can be granted access by "role:" requirements.
+type HasRoles interface {
+	Roles() []string
+}
+
+// loginModelType is used to retrieve the authenticated LoginModel from the context.
+var loginModelType = reflect.TypeOf((*LoginModel)(nil)).Elem()
+
+// applyPolicy returns options with the effective requirement for action on
+// modelP set, and authentication turned on if the requirement needs it.
+func applyPolicy(modelP interface{}, action string, options RouteOptions) RouteOptions {
+	requirement := ""
+	if hp, ok := modelP.(HasPolicy); ok {
+		requirement = hp.Policy()[action]
+	}
+	if r, ok := options.Policy[action]; ok {
+		requirement = r
+	}
+	options.requirement = requirement
+	if requirement != "" && requirement != POLICY_PUBLIC && options.Authenticate == nil {
+		options.Authenticate = true
+	}
+	return options
+}
+
+// adminOptions returns options for a route which only admins may use, unless
+// a Policy says otherwise.
+func adminOptions(options RouteOptions) RouteOptions {
+	if options.requirement == "" {
+		options.requirement = POLICY_ROLE + "admin"
+	}
+	if options.Authenticate == nil {
+		options.Authenticate = true
+	}
+	return options
+}
+
+// requiredRoles returns the roles in a requirement, any one of which grants access.
+func requiredRoles(requirement string) []string {
+	roles := []string{}
+	for _, r := range strings.Split(requirement, ",") {
+		r = strings.TrimSpace(r)
+		if strings.HasPrefix(r, POLICY_ROLE) {
+			roles = append(roles, strings.TrimPrefix(r, POLICY_ROLE))
+		}
+	}
+	return roles
+}
+
+// userHasRole returns true if user implements HasRoles and has any of roles.
+func userHasRole(user interface{}, roles []string) bool {
+	hr, ok := user.(HasRoles)
+	if !ok {
+		return false
+	}
+	for _, have := range hr.Roles() {
+		for _, want := range roles {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// requirementHandler returns a handler enforcing a Policy requirement, or nil
+// if there is nothing to enforce. It runs after authentication, so for any
+// requirement but "public" the LoginModel must be in the request context.
+func requirementHandler(requirement string) martini.Handler {
+	if requirement == "" || requirement == POLICY_PUBLIC {
+		return nil
+	}
+	roles := requiredRoles(requirement)
+	if requirement != POLICY_ANY && len(roles) == 0 {
+		panic(fmt.Sprintf("Unknown policy requirement %q", requirement))
+	}
+	return func(w http.ResponseWriter, c martini.Context) {
+		user := c.Get(loginModelType)
+		if !user.IsValid() {
+			w.WriteHeader(401)
+			fmt.Fprintf(w, "Unauthorized")
+			return
+		}
+		if len(roles) > 0 && !userHasRole(user.Interface(), roles) {
+			log.WithFields(log.Fields{"requirement": requirement}).Warn("Policy: user lacks role")
+			w.WriteHeader(403)
+			w.Write([]byte(`{"error":"Forbidden"}`))
+		}
+	}
+}
+
+// Permission is one row of the permission matrix returned by the route added
+// with AddPermissionsRoute.
+type Permission struct {
+	Method        string   `json:"method"`
+	Path          string   `json:"path"`
+	Model         string   `json:"model,omitempty"`
+	Action        string   `json:"action,omitempty"`
+	Requirement   string   `json:"requirement"`
+	Scopes        []string `json:"scopes,omitempty"` // RequiredScopes of scoped tokens
+	Authenticated bool     `json:"authenticated"`    // true if the route has an Authenticate handler
+	Authorized    bool     `json:"authorized"`       // true if the route has a custom Authorize handler
+}
+
+// Permissions returns the permission matrix for every route added so far,
+// sorted by path and method.
+func (api *apiServer) Permissions() []Permission {
+	permissions := make([]Permission, 0, len(api.routes))
+	for _, r := range api.routes {
+		if r.implicit {
+			continue
+		}
+		p := Permission{Method: r.method, Path: r.path, Action: r.action,
+			Requirement:   r.options.requirement,
+			Scopes:        r.options.RequiredScopes,
+			Authenticated: api.getAuthenticateHandler(r.options.Authenticate) != nil,
+			Authorized:    r.options.Authorize != nil}
+		if r.model != nil {
+			p.Model = r.model.Name()
+		}
+		if p.Requirement == "" {
+			p.Requirement = POLICY_PUBLIC
+			if p.Authenticated {
+				p.Requirement = POLICY_ANY
+			}
+		}
+		permissions = append(permissions, p)
+	}
+	sort.SliceStable(permissions, func(i, j int) bool {
+		if permissions[i].Path != permissions[j].Path {
+			return permissions[i].Path < permissions[j].Path
+		}
+		return permissions[i].Method < permissions[j].Method
+	})
+	return permissions
+}
+
+// AddPermissionsRoute implements API interface for AddPermissionsRoute(). The
+// route is governed by the "index" entry of any RouteOptions.Policy.
+func (api *apiServer) AddPermissionsRoute(path string, options ...RouteOptions) {
+	readOptions := withScopes(applyPolicy(nil, ACTION_INDEX, getOptions(options, ROUTE_READ)), "permissions:read")
+	log.WithFields(log.Fields{"path": path}).Info("Adding permissions route")
+	api.addRoute("GET", path, "", nil, readOptions, api.handlerList(
+		api.bindRequestHandler("GET", nil),
+		api.getAuthenticateHandler(readOptions.Authenticate),
+		scopeHandler(readOptions.RequiredScopes),
+		api.impersonationStep(readOptions),
+		api.tenantMemberStep(readOptions),
+		requirementHandler(readOptions.requirement),
+		readOptions.Authorize,
+		func(req *Request) {
+			permissions := api.Permissions()
+			req.Result = &permissions
+		},
+		readOptions.EditResult,
+		sendResult))
+}
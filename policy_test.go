@@ -0,0 +1,67 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// Give the test admin user the admin role, so *User implements HasRoles.
+func (u *User) Roles() []string {
+	if u.Name == "admin" {
+		return []string{"admin"}
+	}
+	return nil
+}
+
+type PolicyWidget struct {
+	ID   uint   `gorm:"primary_key" json:"id"`
+	Name string `json:"name"`
+}
+
+func (_ *PolicyWidget) Policy() Policy {
+	return Policy{"index": "public", "get": "any", "create": "role:editor", "update": "role:editor,role:admin", "delete": "role:admin"}
+}
+
+func TestPolicy(t *testing.T) {
+	a := getTestApi()
+	a.DB().DropTable(&PolicyWidget{})
+	a.DB().CreateTable(&PolicyWidget{})
+	pw := PolicyWidget{Name: "Policy Widget"}
+	a.DB().Create(&pw)
+	a.AddDefaultRoutes(&PolicyWidget{})
+	a.AddIndexRoute(&PolicyWidget{}, RouteOptions{UriModelName: "policy_override_widgets", Policy: Policy{"index": "any"}})
+	a.AddPermissionsRoute("/api/_permissions")
+
+	token := getToken(testReq(t, "Login", "POST", "/auth", `{"name": "admin", "password": "password"}`, 200))
+	tokenq := "?access_token=" + token
+	item := fmt.Sprintf("/api/policy_widgets/%d", pw.ID)
+
+	testReq(t, "Policy(public)", "GET", "/api/policy_widgets", "", 200)
+	testReq(t, "Policy(any, no token)", "GET", item, "", 401)
+	testReq(t, "Policy(any)", "GET", item+tokenq, "", 200)
+	testReq(t, "Policy(role, no token)", "POST", "/api/policy_widgets", `{"name":"new"}`, 401)
+	testReq(t, "Policy(role, missing role)", "POST", "/api/policy_widgets"+tokenq, `{"name":"new"}`, 403)
+	testReq(t, "Policy(either role)", "PATCH", item+tokenq, `{"name":"edited"}`, 200)
+	testReq(t, "Policy(route override)", "GET", "/api/policy_override_widgets", "", 401)
+	testReq(t, "Policy(role)", "DELETE", item+tokenq, "", 200)
+
+	body := testReq(t, "Permissions", "GET", "/api/_permissions", "", 200)
+	permissions := []Permission{}
+	json.Unmarshal([]byte(body), &permissions)
+	found := false
+	for _, p := range permissions {
+		if p.Path == "/api/policy_widgets/:id" && p.Method == "DELETE" {
+			found = true
+			if p.Requirement != "role:admin" || !p.Authenticated || p.Model != "PolicyWidget" {
+				t.Errorf("Wrong permission for DELETE policy_widgets: %v", p)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Permission matrix doesn't contain DELETE policy_widgets: %s", body)
+	}
+
+	defer ensurePanic(t, "Policy accepted an unknown requirement")
+	a.AddIndexRoute(&Widget{}, RouteOptions{UriModelName: "bad_policy_widgets", Policy: Policy{"index": "admins"}})
+}
@@ -0,0 +1,402 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-martini/martini"
+	"github.com/jinzhu/gorm"
+)
+
+// Rate limiting algorithms for RateLimit.Algorithm.
+const (
+	RATE_TOKEN_BUCKET   = "token_bucket"
+	RATE_SLIDING_WINDOW = "sliding_window"
+)
+
+// RateQuota allows Requests requests Per duration. A zero quota is unlimited.
+type RateQuota struct {
+	Requests int
+	Per      time.Duration
+}
+
+// RateLimit limits how often each client may call the API. Set it as
+// Options.RateLimit for a quota shared by all model routes, or as
+// RouteOptions.RateLimit for a quota shared by the routes it is set on.
+// Requests are counted against the client IP (or Key, if set) before
+// authentication, and moved to the API key or logged in user they
+// authenticate as. Responses get RateLimit-Limit, RateLimit-Remaining and
+// RateLimit-Reset headers, and requests over the quota get 429 Too Many
+// Requests with a Retry-After header.
+type RateLimit struct {
+	// RATE_TOKEN_BUCKET (the default) allows bursts of up to Requests, refilled
+	// evenly over Per. RATE_SLIDING_WINDOW allows Requests in any window of Per.
+	Algorithm string
+	Read      RateQuota // Quota for GET and HEAD requests
+	Write     RateQuota // Quota for other requests
+
+	// Key returns the client a request is counted against. Optional.
+	Key func(r *http.Request, c martini.Context) string
+
+	// Store holds the quotas used. Defaults to a MemoryRateLimitStore. Use a
+	// SQLRateLimitStore to share quotas between servers.
+	Store RateLimitStore
+	// Name separates the quotas of RateLimits sharing a Store. Defaults to "api".
+	Name string
+
+	once sync.Once
+}
+
+// RateLimitState is the state of one client's quota. It is also the
+// model stored by SQLRateLimitStore.
+type RateLimitState struct {
+	BucketKey   string    `gorm:"primary_key" json:"bucket_key"`
+	Tokens      float64   `json:"tokens"`       // Token bucket: tokens left
+	Count       int       `json:"count"`        // Sliding window: requests in the current window
+	PrevCount   int       `json:"prev_count"`   // Sliding window: requests in the previous window
+	WindowStart time.Time `json:"window_start"` // Sliding window: start of the current window
+	LastSeen    time.Time `json:"last_seen"`
+	ExpiresAt   time.Time `json:"expires_at"` // After this the state is the same as a new one
+	Version     int       `json:"version"`
+}
+
+// RateLimitStore stores RateLimitStates. Implement it to keep quotas elsewhere.
+type RateLimitStore interface {
+	// Update calls update with the state stored at key (or a state with only
+	// BucketKey set if there is none) and stores the result, atomically.
+	// update may be called more than once.
+	Update(key string, update func(state *RateLimitState)) error
+}
+
+// MemoryRateLimitStore is a RateLimitStore for a single server.
+type MemoryRateLimitStore struct {
+	mutex   sync.Mutex
+	states  map[string]RateLimitState
+	updates int
+}
+
+// NewMemoryRateLimitStore returns an empty MemoryRateLimitStore.
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{states: make(map[string]RateLimitState)}
+}
+
+func (s *MemoryRateLimitStore) Update(key string, update func(state *RateLimitState)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	state, ok := s.states[key]
+	if !ok {
+		state = RateLimitState{BucketKey: key}
+	}
+	update(&state)
+	s.states[key] = state
+	// Forget expired states now and then.
+	if s.updates++; s.updates%1000 == 0 {
+		now := time.Now()
+		for k, st := range s.states {
+			if now.After(st.ExpiresAt) {
+				delete(s.states, k)
+			}
+		}
+	}
+	return nil
+}
+
+// SQLRateLimitStore is a RateLimitStore keeping quotas in the
+// rate_limit_states table, so they are shared by servers using the same
+// database. Updates use optimistic locking on Version.
+type SQLRateLimitStore struct {
+	DB      *gorm.DB
+	mutex   sync.Mutex
+	updates int
+}
+
+var errRateLimitContention = errors.New("Rate limit state is being updated too often to store")
+
+// NewSQLRateLimitStore returns a SQLRateLimitStore using db, creating its
+// table if needed.
+func NewSQLRateLimitStore(db *gorm.DB) *SQLRateLimitStore {
+	if err := db.AutoMigrate(&RateLimitState{}).Error; err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Can't create rate_limit_states table")
+	}
+	return &SQLRateLimitStore{DB: db}
+}
+
+func (s *SQLRateLimitStore) Update(key string, update func(state *RateLimitState)) error {
+	s.sweep()
+	for attempt := 0; attempt < 5; attempt++ {
+		state := RateLimitState{}
+		found := !s.DB.Where("bucket_key = ?", key).First(&state).RecordNotFound()
+		if !found {
+			state = RateLimitState{BucketKey: key}
+		}
+		version := state.Version
+		update(&state)
+		state.Version = version + 1
+		if !found {
+			if s.DB.Create(&state).Error == nil {
+				return nil
+			}
+			continue // Another server created it first.
+		}
+		result := s.DB.Model(&RateLimitState{}).Where("bucket_key = ? AND version = ?", key, version).UpdateColumns(map[string]interface{}{
+			"tokens": state.Tokens, "count": state.Count, "prev_count": state.PrevCount, "window_start": state.WindowStart,
+			"last_seen": state.LastSeen, "expires_at": state.ExpiresAt, "version": state.Version})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 1 {
+			return nil
+		}
+	}
+	return errRateLimitContention
+}
+
+// sweep deletes expired states now and then.
+func (s *SQLRateLimitStore) sweep() {
+	s.mutex.Lock()
+	s.updates++
+	due := s.updates%1000 == 0
+	s.mutex.Unlock()
+	if due {
+		s.DB.Where("expires_at < ?", time.Now()).Delete(&RateLimitState{})
+	}
+}
+
+// init sets defaults.
+func (rl *RateLimit) init() {
+	rl.once.Do(func() {
+		if rl.Store == nil {
+			rl.Store = NewMemoryRateLimitStore()
+		}
+		if rl.Name == "" {
+			rl.Name = "api"
+		}
+		if rl.Algorithm == "" {
+			rl.Algorithm = RATE_TOKEN_BUCKET
+		}
+		if rl.Algorithm != RATE_TOKEN_BUCKET && rl.Algorithm != RATE_SLIDING_WINDOW {
+			panic(fmt.Sprintf("Unknown rate limit algorithm %q", rl.Algorithm))
+		}
+	})
+}
+
+// quota returns the quota for method.
+func (rl *RateLimit) quota(method string) (RateQuota, string) {
+	if isWrite(method) {
+		return rl.Write, "write"
+	}
+	return rl.Read, "read"
+}
+
+// rateDecision is the outcome of counting a request.
+type rateDecision struct {
+	allowed    bool
+	remaining  int
+	reset      time.Duration // Until the quota is fully available again
+	retryAfter time.Duration // Until the next request is allowed, if not allowed
+}
+
+// takeTokenBucket counts a request against a token bucket.
+func takeTokenBucket(state *RateLimitState, quota RateQuota, now time.Time) rateDecision {
+	capacity := float64(quota.Requests)
+	rate := capacity / quota.Per.Seconds() // tokens per second
+	if state.LastSeen.IsZero() {
+		state.Tokens = capacity
+	} else {
+		state.Tokens = math.Min(capacity, state.Tokens+now.Sub(state.LastSeen).Seconds()*rate)
+	}
+	state.LastSeen = now
+	d := rateDecision{}
+	if state.Tokens >= 1 {
+		state.Tokens--
+		d.allowed = true
+	} else {
+		d.retryAfter = time.Duration((1 - state.Tokens) / rate * float64(time.Second))
+	}
+	d.remaining = int(state.Tokens)
+	d.reset = time.Duration((capacity - state.Tokens) / rate * float64(time.Second))
+	state.ExpiresAt = now.Add(d.reset)
+	return d
+}
+
+// takeSlidingWindow counts a request against a sliding window, estimated
+// from the counts of the current and previous fixed windows.
+func takeSlidingWindow(state *RateLimitState, quota RateQuota, now time.Time) rateDecision {
+	start := now.Truncate(quota.Per)
+	if !state.WindowStart.Equal(start) {
+		if state.WindowStart.Equal(start.Add(-quota.Per)) {
+			state.PrevCount = state.Count
+		} else {
+			state.PrevCount = 0
+		}
+		state.Count = 0
+		state.WindowStart = start
+	}
+	state.LastSeen = now
+	state.ExpiresAt = start.Add(2 * quota.Per)
+	elapsed := now.Sub(start)
+	weight := 1 - elapsed.Seconds()/quota.Per.Seconds()
+	estimate := float64(state.PrevCount)*weight + float64(state.Count)
+	d := rateDecision{reset: quota.Per - elapsed}
+	if estimate+1 <= float64(quota.Requests) {
+		state.Count++
+		d.allowed = true
+		d.remaining = int(float64(quota.Requests) - estimate - 1)
+		return d
+	}
+	if state.Count+1 > quota.Requests || state.PrevCount == 0 {
+		d.retryAfter = quota.Per - elapsed
+	} else {
+		// The previous window's share falls as the window slides.
+		needed := 1 - float64(quota.Requests-1-state.Count)/float64(state.PrevCount)
+		d.retryAfter = time.Duration(needed*float64(quota.Per)) - elapsed
+	}
+	return d
+}
+
+// refundTokenBucket returns a request's token to a token bucket.
+func refundTokenBucket(state *RateLimitState, quota RateQuota) {
+	state.Tokens = math.Min(float64(quota.Requests), state.Tokens+1)
+}
+
+// refundSlidingWindow uncounts a request from the current window.
+func refundSlidingWindow(state *RateLimitState) {
+	if state.Count > 0 {
+		state.Count--
+	}
+}
+
+// rateLimitKey returns the client a request is counted against.
+func (rl *RateLimit) rateLimitKey(r *http.Request, c martini.Context) string {
+	if rl.Key != nil {
+		return rl.Key(r, c)
+	}
+	if v := c.Get(reflect.TypeOf((*APIKey)(nil))); v.IsValid() {
+		return fmt.Sprintf("key:%d", v.Interface().(*APIKey).ID)
+	}
+	if v := c.Get(loginModelType); v.IsValid() {
+		if id, ok := userID(v.Interface()); ok {
+			return fmt.Sprintf("user:%d", id)
+		}
+	}
+	return "ip:" + clientIP(r)
+}
+
+// rateLimitCharge is the bucket a request was counted against before
+// authentication.
+type rateLimitCharge struct {
+	key string
+}
+
+// routeRateLimit returns the RateLimit and quota of a route for method, or a
+// nil RateLimit if it has none.
+func (api *apiServer) routeRateLimit(method string, options RouteOptions) (*RateLimit, RateQuota, string) {
+	rl := options.RateLimit
+	if rl == nil {
+		rl = api.options.RateLimit
+	}
+	if rl == nil {
+		return nil, RateQuota{}, ""
+	}
+	quota, class := rl.quota(method)
+	if quota.Requests <= 0 || quota.Per <= 0 {
+		return nil, quota, class
+	}
+	rl.init()
+	return rl, quota, class
+}
+
+// rateLimitHandler returns a handler counting requests for method against
+// the route's RateLimit, or nil if there is none. It runs before
+// authentication, so requests which fail to authenticate are counted too,
+// against the client IP unless Key is set.
+func (api *apiServer) rateLimitHandler(method string, options RouteOptions) martini.Handler {
+	rl, quota, class := api.routeRateLimit(method, options)
+	if rl == nil {
+		return nil
+	}
+	return func(w http.ResponseWriter, r *http.Request, c martini.Context) {
+		key := rl.Name + "|" + class + "|" + rl.rateLimitKey(r, c)
+		if rl.take(w, key, quota) {
+			c.Map(&rateLimitCharge{key: key})
+		}
+	}
+}
+
+// rateLimitUserStep returns a handler which, once a request has
+// authenticated, moves its charge from the client IP to the API key or user
+// it authenticated as. It is nil for routes without a quota or
+// authentication.
+func (api *apiServer) rateLimitUserStep(method string, options RouteOptions) martini.Handler {
+	rl, quota, class := api.routeRateLimit(method, options)
+	if rl == nil || api.getAuthenticateHandler(options.Authenticate) == nil {
+		return nil
+	}
+	return func(w http.ResponseWriter, r *http.Request, c martini.Context) {
+		v := c.Get(reflect.TypeOf((*rateLimitCharge)(nil)))
+		if !v.IsValid() {
+			return
+		}
+		charge := v.Interface().(*rateLimitCharge)
+		key := rl.Name + "|" + class + "|" + rl.rateLimitKey(r, c)
+		if key == charge.key {
+			return
+		}
+		rl.refund(charge.key, quota)
+		rl.take(w, key, quota)
+	}
+}
+
+// take counts a request against key, setting the RateLimit headers. It
+// writes a 429 response and returns false if the quota is used up.
+func (rl *RateLimit) take(w http.ResponseWriter, key string, quota RateQuota) bool {
+	now := time.Now()
+	var d rateDecision
+	err := rl.Store.Update(key, func(state *RateLimitState) {
+		if rl.Algorithm == RATE_SLIDING_WINDOW {
+			d = takeSlidingWindow(state, quota, now)
+		} else {
+			d = takeTokenBucket(state, quota, now)
+		}
+	})
+	if err != nil {
+		// Fail open rather than refusing everybody.
+		log.WithFields(log.Fields{"key": key, "error": err}).Error("RateLimit: can't update store")
+		return true
+	}
+	header := w.Header()
+	header.Set("RateLimit-Limit", strconv.Itoa(quota.Requests))
+	header.Set("RateLimit-Remaining", strconv.Itoa(d.remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(d.reset.Seconds()))))
+	if !d.allowed {
+		seconds := int(math.Ceil(d.retryAfter.Seconds()))
+		if seconds < 1 {
+			seconds = 1
+		}
+		log.WithFields(log.Fields{"key": key, "retry_after": seconds}).Warn("Rate limited")
+		header.Set("Retry-After", strconv.Itoa(seconds))
+		writeJSONError(w, 429, fmt.Sprintf("Rate limit exceeded. Retry after %d seconds", seconds))
+	}
+	return d.allowed
+}
+
+// refund uncounts a request taken from key.
+func (rl *RateLimit) refund(key string, quota RateQuota) {
+	err := rl.Store.Update(key, func(state *RateLimitState) {
+		if rl.Algorithm == RATE_SLIDING_WINDOW {
+			refundSlidingWindow(state)
+		} else {
+			refundTokenBucket(state, quota)
+		}
+	})
+	if err != nil {
+		log.WithFields(log.Fields{"key": key, "error": err}).Error("RateLimit: can't update store")
+	}
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	quota := RateQuota{Requests: 2, Per: time.Minute}
+	state := RateLimitState{}
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, allowed := range []bool{true, true, false} {
+		if d := takeTokenBucket(&state, quota, now); d.allowed != allowed {
+			t.Errorf("Request %d: expected allowed %v, got %+v", i, allowed, d)
+		}
+	}
+	d := takeTokenBucket(&state, quota, now)
+	if d.retryAfter != 30*time.Second || d.remaining != 0 {
+		t.Errorf("Expected 30s retry after an empty bucket, got %+v", d)
+	}
+	if d := takeTokenBucket(&state, quota, now.Add(30*time.Second)); !d.allowed {
+		t.Errorf("A token should have refilled after 30s, got %+v", d)
+	}
+	refundTokenBucket(&state, quota)
+	if d := takeTokenBucket(&state, quota, now.Add(30*time.Second)); !d.allowed {
+		t.Errorf("A refunded token should be available, got %+v", d)
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	quota := RateQuota{Requests: 4, Per: time.Minute}
+	state := RateLimitState{}
+	start := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		if d := takeSlidingWindow(&state, quota, start.Add(50*time.Second)); !d.allowed {
+			t.Errorf("Request %d should be allowed, got %+v", i, d)
+		}
+	}
+	if d := takeSlidingWindow(&state, quota, start.Add(55*time.Second)); d.allowed || d.retryAfter != 5*time.Second {
+		t.Errorf("Expected refusal until the next window, got %+v", d)
+	}
+	// A quarter into the next window three quarters of the previous count.
+	if d := takeSlidingWindow(&state, quota, start.Add(75*time.Second)); !d.allowed || d.remaining != 0 {
+		t.Errorf("Expected one request allowed, got %+v", d)
+	}
+	if d := takeSlidingWindow(&state, quota, start.Add(75*time.Second)); d.allowed || d.retryAfter != 15*time.Second {
+		t.Errorf("Expected refusal for 15s, got %+v", d)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	db := getTestDb()
+	db.DropTable(&WidgetClone{})
+	db.CreateTable(&WidgetClone{})
+	db.Create(&WidgetClone{ID: 1, Name: "Clone 1"})
+	a := New(Options{Db: db, Martini: getSilentMartini(), RateLimit: &RateLimit{
+		Read:  RateQuota{Requests: 2, Per: time.Minute},
+		Write: RateQuota{Requests: 1, Per: time.Minute},
+	}})
+	a.AddDefaultRoutes(&Widget{})
+	a.AddGetRoute(&WidgetClone{}, RouteOptions{RateLimit: &RateLimit{Algorithm: RATE_SLIDING_WINDOW}})
+	a.AddIndexRoute(&WidgetClone{}, RouteOptions{Authenticate: true, RateLimit: &RateLimit{Read: RateQuota{Requests: 1, Per: time.Minute}}})
+
+	rec := testApiReq(t, a, "RateLimit(First)", "GET", "/api/widgets", "", nil, 200)
+	if rec.Header().Get("RateLimit-Limit") != "2" || rec.Header().Get("RateLimit-Remaining") != "1" {
+		t.Errorf("Bad rate limit headers: %v", rec.Header())
+	}
+	testApiReq(t, a, "RateLimit(Second)", "GET", "/api/widgets/1", "", nil, 200)
+	rec = testApiReq(t, a, "RateLimit(Over)", "GET", "/api/widgets", "", nil, 429)
+	if rec.Header().Get("Retry-After") != "30" {
+		t.Errorf("Expected Retry-After 30, got %v", rec.Header())
+	}
+	testApiReq(t, a, "RateLimit(Write)", "PATCH", "/api/widgets/1", `{"name":"Widget 1"}`, nil, 200)
+	testApiReq(t, a, "RateLimit(Write over)", "POST", "/api/widgets", `{"name":"Limited"}`, nil, 429)
+	testApiReq(t, a, "RateLimit(No route quota)", "GET", "/api/widget_clones/1", "", nil, 200)
+	testApiReq(t, a, "RateLimit(Failed auth)", "GET", "/api/widget_clones", "", nil, 401)
+	testApiReq(t, a, "RateLimit(Failed auth over)", "GET", "/api/widget_clones", "", nil, 429)
+}
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	s := NewMemoryRateLimitStore()
+	for i := 0; i < 3; i++ {
+		s.Update("a", func(state *RateLimitState) {
+			if state.BucketKey != "a" || state.Count != i {
+				t.Errorf("Update %d got state %+v", i, state)
+			}
+			state.Count++
+		})
+	}
+}
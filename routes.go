@@ -0,0 +1,165 @@
+package api
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"reflect"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-martini/martini"
+)
+
+// RouteInfo describes a route added by the API. See Routes().
+type RouteInfo struct {
+	Method    string       `json:"method"`
+	Path      string       `json:"path"`
+	Action    string       `json:"action,omitempty"` // One of the ACTION_ constants for model routes
+	Model     reflect.Type `json:"-"`                // nil for routes not operating on a model
+	ModelName string       `json:"model,omitempty"`
+	// How requests are authenticated: "none", "jwt" for Authenticate: true,
+	// the Name() of an AuthStrategy, or "custom" for a martini.Handler.
+	Auth string `json:"auth"`
+	// The RouteOptions handlers set: Authenticate, Authorize, Query,
+	// CheckUpload and EditResult.
+	Hooks []string `json:"hooks,omitempty"`
+	// The other RouteOptions in effect, eg. Policy, Ownership or StrictBody.
+	// Defaults count, such as the RequiredScopes every model route has.
+	Options  []string `json:"options,omitempty"`
+	Implicit bool     `json:"implicit,omitempty"` // true for the HEAD and OPTIONS routes added automatically
+}
+
+// authMode returns RouteInfo.Auth for an Authenticate option.
+func authMode(auth interface{}) string {
+	switch a := auth.(type) {
+	case nil:
+		return "none"
+	case bool:
+		if a {
+			return "jwt"
+		}
+		return "none"
+	case AuthStrategy:
+		return a.Name()
+	}
+	return "custom"
+}
+
+// routeHooks returns RouteInfo.Hooks for options.
+func routeHooks(options RouteOptions) []string {
+	hooks := []string{}
+	for _, h := range []struct {
+		name string
+		set  bool
+	}{
+		{"Authenticate", authMode(options.Authenticate) == "custom"},
+		{"Authorize", options.Authorize != nil},
+		{"Query", options.Query != nil},
+		{"CheckUpload", options.CheckUpload != nil},
+		{"EditResult", options.EditResult != nil},
+	} {
+		if h.set {
+			hooks = append(hooks, h.name)
+		}
+	}
+	return hooks
+}
+
+// routeOptions returns RouteInfo.Options for options.
+func routeOptions(options RouteOptions) []string {
+	set := []string{}
+	for _, o := range []struct {
+		name string
+		set  bool
+	}{
+		{"Prefix", options.Prefix != ""},
+		{"UriModelName", options.UriModelName != ""},
+		{"Policy", options.Policy != nil},
+		{"Ownership", options.Ownership != nil},
+		{"RequiredScopes", len(options.RequiredScopes) > 0},
+		{"RefuseImpersonation", options.RefuseImpersonation},
+		{"CORS", options.CORS != nil},
+		{"RateLimit", options.RateLimit != nil},
+		{"MaxBodyBytes", options.MaxBodyBytes > 0},
+		{"Timeout", options.Timeout > 0},
+		{"StrictBody", options.StrictBody},
+		{"ValidateSchema", options.ValidateSchema},
+	} {
+		if o.set {
+			set = append(set, o.name)
+		}
+	}
+	return set
+}
+
+// Routes implements API interface for Routes().
+func (api *apiServer) Routes() []RouteInfo {
+	routes := make([]RouteInfo, 0, len(api.routes))
+	for _, r := range api.routes {
+		info := RouteInfo{Method: r.method, Path: r.path, Action: r.action, Model: r.model,
+			Auth: authMode(r.options.Authenticate), Hooks: routeHooks(r.options),
+			Options: routeOptions(r.options), Implicit: r.implicit}
+		if r.model != nil {
+			info.ModelName = r.model.String()
+		}
+		routes = append(routes, info)
+	}
+	return routes
+}
+
+// AddRoutesRoute implements API interface for AddRoutesRoute(). The route is
+// governed by the "index" entry of any RouteOptions.Policy.
+func (api *apiServer) AddRoutesRoute(options ...RouteOptions) {
+	path := uriPrefix(api.options) + "/_routes"
+	if martini.Env == martini.Prod {
+		log.WithFields(log.Fields{"path": path}).Info("Not adding routes route in production")
+		return
+	}
+	readOptions := withScopes(applyPolicy(nil, ACTION_INDEX, getOptions(options, ROUTE_READ)), "routes:read")
+	log.WithFields(log.Fields{"path": path}).Info("Adding routes route")
+	api.addRoute("GET", path, "", nil, readOptions, api.handlerList(
+		api.bindRequestHandler("GET", nil),
+		api.getAuthenticateHandler(readOptions.Authenticate),
+		scopeHandler(readOptions.RequiredScopes),
+		api.impersonationStep(readOptions),
+		api.tenantMemberStep(readOptions),
+		requirementHandler(readOptions.requirement),
+		readOptions.Authorize,
+		func(w http.ResponseWriter, r *http.Request) {
+			routes := api.Routes()
+			if strings.Contains(r.Header.Get("Accept"), "text/html") {
+				w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+				if err := routesPage.Execute(w, routes); err != nil {
+					log.WithFields(log.Fields{"error": err}).Error("Can't render routes page")
+				}
+				return
+			}
+			j, _ := json.Marshal(routes)
+			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			w.Write(j)
+		}))
+}
+
+// routesPage renders Routes() for a browser.
+var routesPage = template.Must(template.New("routes").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Routes</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; }
+th, td { border-bottom: 1px solid #ddd; padding: 0.3em 0.8em; text-align: left; vertical-align: top; }
+tr.implicit { color: #999; }
+</style>
+</head>
+<body>
+<h1>Routes</h1>
+<table>
+<tr><th>Method</th><th>Path</th><th>Model</th><th>Action</th><th>Auth</th><th>Hooks</th><th>Options</th></tr>
+{{range .}}<tr{{if .Implicit}} class="implicit"{{end}}><td>{{.Method}}</td><td><code>{{.Path}}</code></td><td>{{.ModelName}}</td><td>{{.Action}}</td><td>{{.Auth}}</td><td>{{range $i, $h := .Hooks}}{{if $i}}, {{end}}{{$h}}{{end}}</td><td>{{range $i, $o := .Options}}{{if $i}}, {{end}}{{$o}}{{end}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
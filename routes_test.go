@@ -0,0 +1,51 @@
+package api
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-martini/martini"
+)
+
+func TestRoutes(t *testing.T) {
+	a := New(Options{Db: getTestDb(), Martini: getSilentMartini(), JwtKey: "secret"})
+	a.AddIndexRoute(&Widget{}, RouteOptions{Authenticate: APIKeyStrategy(), Query: func() {}, StrictBody: true})
+	a.AddPostRoute(&Widget{}, RouteOptions{Authenticate: true, CheckUpload: func() {}})
+	a.AddRoutesRoute()
+
+	routes := a.Routes()
+	if len(routes) != 7 { // GET, HEAD, OPTIONS and POST for widgets, and GET, HEAD and OPTIONS for _routes
+		t.Fatalf("Expected 7 routes, got %v", routes)
+	}
+	index, post := routes[0], routes[3]
+	if index.Method != "GET" || index.Path != "/api/widgets" || index.Model != reflect.TypeOf(Widget{}) ||
+		index.Auth != "api_key" || !reflect.DeepEqual(index.Hooks, []string{"Query"}) || !reflect.DeepEqual(index.Options, []string{"RequiredScopes", "StrictBody"}) {
+		t.Errorf("Bad index route %+v", index)
+	}
+	if !routes[1].Implicit || routes[1].Method != "HEAD" {
+		t.Errorf("Expected implicit HEAD route, got %+v", routes[1])
+	}
+	if post.Method != "POST" || post.Auth != "jwt" || !reflect.DeepEqual(post.Hooks, []string{"CheckUpload"}) {
+		t.Errorf("Bad post route %+v", post)
+	}
+
+	rec := testApiReq(t, a, "Routes(JSON)", "GET", "/api/_routes", "", nil, 200)
+	listed := []RouteInfo{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &listed); err != nil || len(listed) != 7 || listed[0].ModelName != "api.Widget" {
+		t.Errorf("Bad routes listed (%v): %s", err, rec.Body.String())
+	}
+	rec = testApiReq(t, a, "Routes(HTML)", "GET", "/api/_routes", "", map[string]string{"Accept": "text/html"}, 200)
+	if !strings.Contains(rec.Body.String(), "<code>/api/widgets</code>") {
+		t.Errorf("Bad routes page: %s", rec.Body.String())
+	}
+
+	martini.Env = martini.Prod
+	defer func() { martini.Env = martini.Dev }()
+	prod := New(Options{Db: getTestDb(), Martini: getSilentMartini()})
+	prod.AddRoutesRoute()
+	if len(prod.Routes()) != 0 {
+		t.Errorf("AddRoutesRoute shouldn't add a route in production")
+	}
+}
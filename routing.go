@@ -0,0 +1,74 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-martini/martini"
+)
+
+// addImplicitRoutes adds the routes implied by adding method at path: an
+// OPTIONS route for a new path. martini answers HEAD with a GET route itself,
+// so a GET is only recorded as HEAD too, for the Allow header.
+func (api *apiServer) addImplicitRoutes(method string, path string, newPath bool, options RouteOptions) {
+	if method == "GET" {
+		api.routes = append(api.routes, &route{method: "HEAD", path: path, options: options, implicit: true})
+	}
+	if newPath && method != "OPTIONS" {
+		preflight := api.preflightHandler(path)
+		api.routes = append(api.routes, &route{method: "OPTIONS", path: path, implicit: true, handlers: []martini.Handler{preflight}})
+		api.martini.AddRoute("OPTIONS", path, preflight)
+	}
+}
+
+// matchPath returns true if urlPath matches a martini route pattern. Only
+// :param and trailing ** segments are understood.
+func matchPath(pattern string, urlPath string) bool {
+	_, ok := pathParams(pattern, urlPath)
+	return ok
+}
+
+// pathParams matches urlPath against a martini route pattern like matchPath,
+// and returns the values of its :params.
+func pathParams(pattern string, urlPath string) (martini.Params, bool) {
+	params := martini.Params{}
+	patterns := strings.Split(strings.Trim(pattern, "/"), "/")
+	parts := strings.Split(strings.Trim(urlPath, "/"), "/")
+	for i, p := range patterns {
+		if p == "**" {
+			return params, true
+		}
+		if i >= len(parts) {
+			return nil, false
+		}
+		if strings.HasPrefix(p, ":") {
+			if parts[i] == "" {
+				return nil, false
+			}
+			params[p[1:]] = parts[i]
+		} else if p != parts[i] {
+			return nil, false
+		}
+	}
+	if len(parts) != len(patterns) {
+		return nil, false
+	}
+	return params, true
+}
+
+// methodNotAllowed is the NotFound handler of martini and Handler() if
+// Options.MethodNotAllowed is set. A request for a path with
+// routes for other methods gets 405 Method Not Allowed and an Allow header,
+// other requests a 404.
+func (api *apiServer) methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	for _, rt := range api.routes {
+		if matchPath(rt.path, r.URL.Path) {
+			log.WithFields(log.Fields{"path": r.URL.Path, "method": r.Method}).Info("Method not allowed")
+			w.Header().Set("Allow", strings.Join(api.pathMethods(rt.path), ", "))
+			writeJSONError(w, 405, "Method Not Allowed")
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
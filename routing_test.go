@@ -0,0 +1,97 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/go-martini/martini"
+)
+
+func TestImplicitRoutes(t *testing.T) {
+	a := New(Options{Db: getTestDb(), Martini: getSilentMartini(), MethodNotAllowed: true})
+	a.AddDefaultRoutes(&Widget{}, RouteOptions{Prefix: "/department/:dept_id"})
+
+	rec := testApiReq(t, a, "Options(Index)", "OPTIONS", "/api/department/1/widgets", "", nil, 204)
+	if rec.Header().Get("Allow") != "GET, HEAD, OPTIONS, POST" {
+		t.Errorf("Bad Allow header: %v", rec.Header())
+	}
+	rec = testApiReq(t, a, "Options(Item)", "OPTIONS", "/api/department/1/widgets/1", "", nil, 204)
+	if rec.Header().Get("Allow") != "DELETE, GET, HEAD, OPTIONS, PATCH" {
+		t.Errorf("Bad Allow header: %v", rec.Header())
+	}
+
+	// martini answers HEAD with the GET route. net/http drops the body, which
+	// the recorder doesn't.
+	get := testApiReq(t, a, "Get", "GET", "/api/department/1/widgets/1", "", nil, 200)
+	head := testApiReq(t, a, "Head", "HEAD", "/api/department/1/widgets/1", "", nil, 200)
+	if head.Header().Get("Content-Type") != get.Header().Get("Content-Type") {
+		t.Errorf("HEAD should have GET's headers: %v", head.Header())
+	}
+	testApiReq(t, a, "Head(Not found)", "HEAD", "/api/department/1/widgets/4242", "", nil, 404)
+
+	rec = testApiReq(t, a, "MethodNotAllowed", "PUT", "/api/department/1/widgets/1", "", nil, 405)
+	if rec.Header().Get("Allow") != "DELETE, GET, HEAD, OPTIONS, PATCH" {
+		t.Errorf("405 without Allow header: %v", rec.Header())
+	}
+	testApiReq(t, a, "NotFound", "GET", "/api/department/1/gadgets", "", nil, 404)
+}
+
+// Without Options.MethodNotAllowed martini's NotFound handler is left alone.
+func TestMethodNotAllowedOptIn(t *testing.T) {
+	m := getSilentMartini()
+	m.NotFound(func(w http.ResponseWriter) { w.WriteHeader(418) })
+	a := New(Options{Db: getTestDb(), Martini: m})
+	a.AddIndexRoute(&Widget{})
+	testApiReq(t, a, "NotFound(Own handler)", "PUT", "/api/widgets", "", nil, 418)
+}
+
+// Handler() routes requests itself, so martini's middleware never runs.
+func TestHandlerWithoutMartini(t *testing.T) {
+	m := getSilentMartini()
+	m.Use(func(w http.ResponseWriter) { w.WriteHeader(418) })
+	a := New(Options{Db: getTestDb(), Martini: m, MethodNotAllowed: true})
+	a.AddDefaultRoutes(&Widget{}, RouteOptions{Prefix: "/department/:dept_id"})
+
+	for _, c := range []struct {
+		method, path string
+		code         int
+	}{
+		{"GET", "/api/department/1/widgets", 200},
+		{"GET", "/api/department/1/widgets/1", 200},
+		{"HEAD", "/api/department/1/widgets/1", 200},
+		{"GET", "/api/department/1/widgets/4242", 404},
+		{"OPTIONS", "/api/department/1/widgets/1", 204},
+		{"PUT", "/api/department/1/widgets/1", 405},
+		{"GET", "/api/department/1/gadgets", 404},
+	} {
+		r, _ := http.NewRequest(c.method, c.path, nil)
+		w := httptest.NewRecorder()
+		a.Handler().ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Errorf("%s %s should return %d, got %d %s", c.method, c.path, c.code, w.Code, w.Body.String())
+		}
+	}
+	testApiReq(t, a, "Martini middleware", "GET", "/api/department/1/widgets/1", "", nil, 418)
+}
+
+func TestPathParams(t *testing.T) {
+	for _, c := range []struct {
+		pattern, path string
+		params        martini.Params
+	}{
+		{"/api/widgets/:id", "/api/widgets/7", martini.Params{"id": "7"}},
+		{"/api/d/:dept_id/widgets/:id", "/api/d/2/widgets/7/", martini.Params{"dept_id": "2", "id": "7"}},
+		{"/api/widgets", "/api/widgets", martini.Params{}},
+		{"/api/files/**", "/api/files/a/b", martini.Params{}},
+		{"/api/widgets/:id", "/api/widgets", nil},
+		{"/api/widgets/:id", "/api/widgets/7/parts", nil},
+		{"/api/widgets", "/api/gadgets", nil},
+	} {
+		params, ok := pathParams(c.pattern, c.path)
+		if ok != (c.params != nil) || !reflect.DeepEqual(params, c.params) {
+			t.Errorf("pathParams(%q, %q) = %v, %v, want %v", c.pattern, c.path, params, ok, c.params)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-martini/martini"
+)
+
+// JSONSchemaDialect is the JSON Schema draft followed by Schema().
+const JSONSchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// schemaPatterns holds the compiled pattern= options, by pattern, so they
+// are compiled once when the schema is built and not for every request.
+var schemaPatterns sync.Map
+
+// compiledPattern returns pattern compiled, from schemaPatterns if it has
+// been compiled before.
+func compiledPattern(pattern string) (*regexp.Regexp, error) {
+	if re, ok := schemaPatterns.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	schemaPatterns.Store(pattern, re)
+	return re, nil
+}
+
+// applyAPITag adds the validation options in f's comma separated api tag to
+// its schema s, returning true if the field is required. The options are:
+//
+//	required          the field must be present in a POST body
+//	readonly          the field is set by the server
+//	min=1,max=100     minimum and maximum of a number, length of a string or
+//	                  number of items of an array
+//	enum=red|green    the allowed values
+//	format=email      one of email, uri, uuid, date or date-time
+//	pattern=^[a-z]+$  a regular expression strings must match. As it may
+//	                  contain commas it must be the last option.
+//
+// eg. `api:"required,max=50,pattern=^[A-Z]"`. Other options (eg. owner) are
+// ignored.
+func applyAPITag(f reflect.StructField, s map[string]interface{}) bool {
+	required := false
+	t := f.Type
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	kind := expected(t)
+	tag := f.Tag.Get("api")
+	for tag != "" {
+		option := tag
+		if strings.HasPrefix(tag, "pattern=") {
+			tag = ""
+		} else if i := strings.Index(tag, ","); i >= 0 {
+			option, tag = tag[:i], tag[i+1:]
+		} else {
+			tag = ""
+		}
+		name, value := strings.TrimSpace(option), ""
+		if i := strings.Index(option, "="); i >= 0 {
+			name, value = strings.TrimSpace(option[:i]), option[i+1:]
+		}
+		switch name {
+		case "required":
+			required = true
+		case "readonly":
+			s["readOnly"] = true
+		case "min", "max":
+			n, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				panic(fmt.Sprintf("Bad %s=%q in api tag of %s", name, value, f.Name))
+			}
+			keyword := map[string]string{"string": "Length", "array": "Items"}[kind]
+			if keyword == "" {
+				keyword = map[string]string{"min": "minimum", "max": "maximum"}[name]
+			} else {
+				keyword = name + keyword
+			}
+			s[keyword] = n
+		case "enum":
+			values := []interface{}{}
+			for _, v := range strings.Split(value, "|") {
+				if kind == "number" || kind == "integer" {
+					n, err := strconv.ParseFloat(v, 64)
+					if err != nil {
+						panic(fmt.Sprintf("Bad enum value %q in api tag of %s", v, f.Name))
+					}
+					values = append(values, n)
+				} else {
+					values = append(values, v)
+				}
+			}
+			s["enum"] = values
+		case "format":
+			s["format"] = value
+		case "pattern":
+			if _, err := compiledPattern(value); err != nil {
+				panic(fmt.Sprintf("Bad pattern in api tag of %s: %v", f.Name, err))
+			}
+			s["pattern"] = value
+		}
+	}
+	return required
+}
+
+// modelSchema returns the JSON Schema for model type t.
+func modelSchema(t reflect.Type) map[string]interface{} {
+	b := newSchemaBuilder("#/$defs/")
+	b.root = t
+	s := b.structSchema(t)
+	s["$schema"] = JSONSchemaDialect
+	s["title"] = t.Name()
+	if len(b.defs) > 0 {
+		s["$defs"] = b.defs
+	}
+	return s
+}
+
+// Schema implements API interface for Schema().
+func (api *apiServer) Schema(modelPtr interface{}) map[string]interface{} {
+	return modelSchema(reflect.TypeOf(modelPtr).Elem())
+}
+
+// schemaValidator checks a decoded JSON document against a schema returned
+// by modelSchema, recording every problem by its JSON pointer.
+type schemaValidator struct {
+	root    map[string]interface{}
+	partial bool // Don't check required, for PATCH bodies
+	errors  map[string]string
+}
+
+// schemaErrors returns the problems found validating body against schema,
+// keyed by JSON pointer. If partial is set required fields may be missing.
+func schemaErrors(body []byte, schema map[string]interface{}, partial bool) map[string]string {
+	v := schemaValidator{root: schema, partial: partial, errors: map[string]string{}}
+	var doc interface{}
+	dec := json.NewDecoder(strings.NewReader(string(body)))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		v.errors["/"] = err.Error()
+		return v.errors
+	}
+	v.validate(doc, schema, "")
+	return v.errors
+}
+
+// resolve returns the schema referred to by a $ref made by modelSchema.
+func (v *schemaValidator) resolve(ref string) map[string]interface{} {
+	if ref == "#" {
+		return v.root
+	}
+	defs, _ := v.root["$defs"].(map[string]interface{})
+	s, _ := defs[strings.TrimPrefix(ref, "#/$defs/")].(map[string]interface{})
+	return s
+}
+
+// jsonType returns the JSON Schema type of a value decoded with UseNumber.
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
+
+// typeAllowed returns true if a value of JSON type have is allowed by the
+// schema type keyword types.
+func typeAllowed(have string, types []string) bool {
+	for _, t := range types {
+		if t == have || (t == "number" && have == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// validFormat returns true if s is in format, or format isn't known.
+func validFormat(format string, s string) bool {
+	switch format {
+	case "email":
+		a, err := mail.ParseAddress(s)
+		return err == nil && a.Address == s
+	case "uri":
+		u, err := url.Parse(s)
+		return err == nil && u.IsAbs()
+	case "uuid":
+		return uuidPattern.MatchString(s)
+	case "date":
+		_, err := time.Parse("2006-01-02", s)
+		return err == nil
+	case "date-time":
+		_, err := time.Parse(time.RFC3339, s)
+		return err == nil
+	}
+	return true
+}
+
+// number returns a schema keyword's numeric value.
+func number(value interface{}) float64 {
+	switch n := value.(type) {
+	case float64:
+		return n
+	case int:
+		return float64(n)
+	}
+	return 0
+}
+
+// fmtNumber formats a schema keyword's numeric value for a message.
+func fmtNumber(value interface{}) string {
+	return strconv.FormatFloat(number(value), 'f', -1, 64)
+}
+
+// validate checks value at path against schema s.
+func (v *schemaValidator) validate(value interface{}, s map[string]interface{}, path string) {
+	if ref, ok := s["$ref"].(string); ok {
+		if target := v.resolve(ref); target != nil {
+			v.validate(value, target, path)
+		}
+	}
+	have := jsonType(value)
+	switch t := s["type"].(type) {
+	case string:
+		if !typeAllowed(have, []string{t}) {
+			v.errors[pointerPath(path)] = "expected " + t
+			return
+		}
+	case []string:
+		if !typeAllowed(have, t) {
+			v.errors[pointerPath(path)] = "expected " + strings.Join(t, " or ")
+			return
+		}
+	}
+	if enum, ok := s["enum"].([]interface{}); ok {
+		found := false
+		names := make([]string, 0, len(enum))
+		for _, e := range enum {
+			names = append(names, fmt.Sprint(e))
+			if n, ok := value.(json.Number); ok {
+				f, _ := n.Float64()
+				found = found || e == f
+			} else {
+				found = found || e == value
+			}
+		}
+		if !found {
+			v.errors[pointerPath(path)] = "must be one of " + strings.Join(names, ", ")
+			return
+		}
+	}
+	switch val := value.(type) {
+	case json.Number:
+		f, _ := val.Float64()
+		if min, ok := s["minimum"]; ok && f < number(min) {
+			v.errors[pointerPath(path)] = "must be at least " + fmtNumber(min)
+		}
+		if max, ok := s["maximum"]; ok && f > number(max) {
+			v.errors[pointerPath(path)] = "must be at most " + fmtNumber(max)
+		}
+	case string:
+		n := float64(utf8.RuneCountInString(val))
+		if min, ok := s["minLength"]; ok && n < number(min) {
+			v.errors[pointerPath(path)] = "must be at least " + fmtNumber(min) + " characters"
+		}
+		if max, ok := s["maxLength"]; ok && n > number(max) {
+			v.errors[pointerPath(path)] = "must be at most " + fmtNumber(max) + " characters"
+		}
+		if pattern, ok := s["pattern"].(string); ok {
+			if re, err := compiledPattern(pattern); err == nil && !re.MatchString(val) {
+				v.errors[pointerPath(path)] = "must match " + pattern
+			}
+		}
+		if format, ok := s["format"].(string); ok && !validFormat(format, val) {
+			v.errors[pointerPath(path)] = "must be a valid " + format
+		}
+	case []interface{}:
+		n := float64(len(val))
+		if min, ok := s["minItems"]; ok && n < number(min) {
+			v.errors[pointerPath(path)] = "must have at least " + fmtNumber(min) + " items"
+		}
+		if max, ok := s["maxItems"]; ok && n > number(max) {
+			v.errors[pointerPath(path)] = "must have at most " + fmtNumber(max) + " items"
+		}
+		if items, ok := s["items"].(map[string]interface{}); ok {
+			for i, item := range val {
+				v.validate(item, items, path+"/"+strconv.Itoa(i))
+			}
+		}
+	case map[string]interface{}:
+		properties, _ := s["properties"].(map[string]interface{})
+		additional, _ := s["additionalProperties"].(map[string]interface{})
+		for key, item := range val {
+			if p, ok := properties[key].(map[string]interface{}); ok {
+				v.validate(item, p, path+"/"+pointerToken(key))
+			} else if additional != nil {
+				v.validate(item, additional, path+"/"+pointerToken(key))
+			}
+		}
+		if required, ok := s["required"].([]string); ok && !v.partial {
+			for _, key := range required {
+				if _, ok := val[key]; !ok {
+					v.errors[path+"/"+pointerToken(key)] = "required"
+				}
+			}
+		}
+	}
+}
+
+// bodyDecoder returns the function decoding the body of a POST or PATCH to
+// itemType, checking it as set by options.StrictBody and options.ValidateSchema.
+func (api *apiServer) bodyDecoder(method string, itemType reflect.Type, options RouteOptions) bodyDecoder {
+	checks := []bodyCheck{}
+	if options.StrictBody {
+		checks = append(checks, func(body []byte) map[string]string {
+			return strictErrors(body, reflect.PtrTo(itemType))
+		})
+	}
+	if options.ValidateSchema {
+		schema := modelSchema(itemType)
+		partial := method == "PATCH"
+		checks = append(checks, func(body []byte) map[string]string {
+			return schemaErrors(body, schema, partial)
+		})
+	}
+	if len(checks) == 0 {
+		return decodeBody
+	}
+	return func(w http.ResponseWriter, r *http.Request, c martini.Context, v interface{}) bool {
+		return decodeCheckedBody(w, r, c, v, checks)
+	}
+}
+
+// schemaModel returns the model type of the routes using name (the model's
+// plural camel name or UriModelName).
+func (api *apiServer) schemaModel(name string) (reflect.Type, bool) {
+	for _, r := range api.routes {
+		if r.model != nil && (pluralCamelNameType(r.model) == name || r.options.UriModelName == name) {
+			return r.model, true
+		}
+	}
+	return nil, false
+}
+
+// schemaNames returns the names AddSchemaRoute serves schemas for.
+func (api *apiServer) schemaNames() []string {
+	seen := map[string]bool{}
+	for _, r := range api.routes {
+		if r.model != nil {
+			seen[pluralCamelNameType(r.model)] = true
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// AddSchemaRoute implements API interface for AddSchemaRoute(). The route is
+// governed by the "get" entry of any RouteOptions.Policy.
+func (api *apiServer) AddSchemaRoute(options ...RouteOptions) {
+	readOptions := withScopes(applyPolicy(nil, ACTION_GET, getOptions(options, ROUTE_READ)), "schemas:read")
+	path := uriPrefix(api.options) + "/_schema/:name"
+	log.WithFields(log.Fields{"path": path}).Info("Adding schema route")
+	api.addRoute("GET", path, "", nil, readOptions, api.handlerList(
+		api.bindRequestHandler("GET", nil),
+		api.getAuthenticateHandler(readOptions.Authenticate),
+		scopeHandler(readOptions.RequiredScopes),
+		api.impersonationStep(readOptions),
+		api.tenantMemberStep(readOptions),
+		requirementHandler(readOptions.requirement),
+		readOptions.Authorize,
+		func(params martini.Params, w http.ResponseWriter) []byte {
+			t, ok := api.schemaModel(params["name"])
+			if !ok {
+				writeJSONError(w, 404, fmt.Sprintf("No model is called %s. Try one of %s", params["name"], strings.Join(api.schemaNames(), ", ")))
+				return nil
+			}
+			j, _ := json.Marshal(modelSchema(t))
+			w.Header().Set("Content-Type", "application/schema+json")
+			return j
+		}))
+}
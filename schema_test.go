@@ -0,0 +1,97 @@
+package api
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+type SchemaWidget struct {
+	ID       uint            `gorm:"primary_key" json:"id"`
+	Name     string          `json:"name" api:"required,min=3,max=10"`
+	Colour   string          `json:"colour" api:"enum=red|green"`
+	Size     int             `json:"size" api:"min=1,max=5"`
+	Email    string          `json:"email" api:"format=email"`
+	Code     string          `json:"code" api:"readonly,pattern=^[A-Z]{2,3}$"`
+	Tags     []string        `json:"tags" api:"max=2" sql:"-"`
+	Children []*SchemaWidget `json:"children" sql:"-"`
+}
+
+func TestModelSchema(t *testing.T) {
+	j, _ := json.Marshal(modelSchema(reflect.TypeOf(SchemaWidget{})))
+	expected := `{"$schema":"https://json-schema.org/draft/2020-12/schema","properties":{` +
+		`"children":{"items":{"$ref":"#"},"type":"array"},` +
+		`"code":{"pattern":"^[A-Z]{2,3}$","readOnly":true,"type":"string"},` +
+		`"colour":{"enum":["red","green"],"type":"string"},` +
+		`"email":{"format":"email","type":"string"},` +
+		`"id":{"format":"int64","minimum":0,"readOnly":true,"type":"integer"},` +
+		`"name":{"maxLength":10,"minLength":3,"type":"string"},` +
+		`"size":{"format":"int64","maximum":5,"minimum":1,"type":"integer"},` +
+		`"tags":{"items":{"type":"string"},"maxItems":2,"type":"array"}},` +
+		`"required":["name"],"title":"SchemaWidget","type":"object"}`
+	if string(j) != expected {
+		t.Errorf("Bad schema:\n%s\nexpected:\n%s", j, expected)
+	}
+}
+
+func TestSchemaErrors(t *testing.T) {
+	schema := modelSchema(reflect.TypeOf(SchemaWidget{}))
+	for body, expected := range map[string]map[string]string{
+		`{"name":"Good","colour":"red","size":3,"email":"a@example.com","code":"AB","tags":["x"]}`: {},
+		`{"colour":"blue","size":6,"email":"nope","code":"abc","tags":["x","y","z"]}`: {
+			"/name": "required", "/colour": "must be one of red, green", "/size": "must be at most 5",
+			"/email": "must be a valid email", "/code": "must match ^[A-Z]{2,3}$", "/tags": "must have at most 2 items"},
+		`{"name":"No","size":1.5}`:                                {"/name": "must be at least 3 characters", "/size": "expected integer"},
+		`{"name":"Parent","children":[{"name":"Child","id":-1}]}`: {"/children/0/id": "must be at least 0"},
+		`{"name":"Nulls","children":[null]}`:                      {"/children/0": "expected object"},
+	} {
+		errs := schemaErrors([]byte(body), schema, false)
+		if !reflect.DeepEqual(errs, expected) {
+			t.Errorf("Validating %s: expected %v, got %v", body, expected, errs)
+		}
+	}
+	if errs := schemaErrors([]byte(`{"size":2}`), schema, true); len(errs) != 0 {
+		t.Errorf("Partial bodies don't need required fields, got %v", errs)
+	}
+}
+
+func TestValidateSchema(t *testing.T) {
+	db := getTestDb()
+	db.DropTable(&SchemaWidget{})
+	db.CreateTable(&SchemaWidget{})
+	a := New(Options{Db: db, Martini: getSilentMartini()})
+	a.AddDefaultRoutes(&SchemaWidget{}, RouteOptions{ValidateSchema: true, StrictBody: true})
+	a.AddSchemaRoute()
+
+	testApiReq(t, a, "Schema(Valid)", "POST", "/api/schema_widgets", `{"name":"Valid"}`, nil, 200)
+	body := testApiReq(t, a, "Schema(Invalid)", "POST", "/api/schema_widgets", `{"size":9,"nmae":"x"}`, nil, 422).Body.String()
+	result := map[string]map[string]string{}
+	json.Unmarshal([]byte(body), &result)
+	if !reflect.DeepEqual(result["errors"], map[string]string{"/name": "required", "/size": "must be at most 5", "/nmae": "unknown field"}) {
+		t.Errorf("Bad schema errors: %s", body)
+	}
+	testApiReq(t, a, "Schema(Patch partial)", "PATCH", "/api/schema_widgets/1", `{"size":2}`, nil, 200)
+	testApiReq(t, a, "Schema(Patch invalid)", "PATCH", "/api/schema_widgets/1", `{"name":"x"}`, nil, 422)
+
+	rec := testApiReq(t, a, "Schema(Route)", "GET", "/api/_schema/schema_widgets", "", nil, 200)
+	served := map[string]interface{}{}
+	json.Unmarshal(rec.Body.Bytes(), &served)
+	if served["title"] != "SchemaWidget" || rec.Header().Get("Content-Type") != "application/schema+json" {
+		t.Errorf("Bad schema served: %s", rec.Body.String())
+	}
+	testApiReq(t, a, "Schema(Unknown)", "GET", "/api/_schema/gadgets", "", nil, 404)
+}
+
+func TestCompiledPattern(t *testing.T) {
+	modelSchema(reflect.TypeOf(SchemaWidget{}))
+	if _, ok := schemaPatterns.Load("^[A-Z]{2,3}$"); !ok {
+		t.Errorf("The Code pattern should be compiled when the schema is built")
+	}
+	first, _ := compiledPattern("^[a-z]+$")
+	if second, _ := compiledPattern("^[a-z]+$"); first != second {
+		t.Errorf("A pattern should only be compiled once")
+	}
+	if _, err := compiledPattern("("); err == nil {
+		t.Errorf("A bad pattern should fail to compile")
+	}
+}
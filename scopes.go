@@ -0,0 +1,133 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-martini/martini"
+)
+
+// TokenScopes is mapped into the request context when the request was
+// authenticated with a scoped token (see GetScopedToken) or an API key with
+// scopes. Requests without TokenScopes are not restricted by scope.
+type TokenScopes []string
+
+// Has returns true if scope was granted.
+func (s TokenScopes) Has(scope string) bool {
+	for _, granted := range s {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+var tokenScopesType = reflect.TypeOf(TokenScopes(nil))
+
+// scopeClaim is the JWT claim holding a token's space separated scopes.
+const scopeClaim = "scope"
+
+// mapTokenScopes maps the scopes of token into c, if it is scoped.
+func mapTokenScopes(token *jwt.Token, c martini.Context) {
+	if scope, ok := token.Claims[scopeClaim].(string); ok {
+		c.Map(TokenScopes(strings.Fields(scope)))
+	}
+}
+
+// requestScopes returns the scopes the request was authenticated with, and
+// false if it isn't restricted by scope.
+func requestScopes(c martini.Context) (TokenScopes, bool) {
+	v := c.Get(tokenScopesType)
+	if !v.IsValid() {
+		return nil, false
+	}
+	return v.Interface().(TokenScopes), true
+}
+
+// defaultScopes returns the scopes required by action on modelP, eg.
+// "widgets:read" for index and get, and "widgets:write" otherwise.
+func defaultScopes(modelP interface{}, action string) []string {
+	access := "write"
+	if action == ACTION_INDEX || action == ACTION_GET {
+		access = "read"
+	}
+	return []string{pluralCamelName(modelP) + ":" + access}
+}
+
+// withScopes returns options requiring scopes, unless RequiredScopes is set.
+func withScopes(options RouteOptions, scopes ...string) RouteOptions {
+	if options.RequiredScopes == nil {
+		options.RequiredScopes = scopes
+	}
+	return options
+}
+
+// applyScopes returns options with the default scopes for action on modelP,
+// unless RequiredScopes is set.
+func applyScopes(modelP interface{}, action string, options RouteOptions) RouteOptions {
+	return withScopes(options, defaultScopes(modelP, action)...)
+}
+
+// writeInsufficientScope writes a 403 as described by RFC 6750.
+func writeInsufficientScope(w http.ResponseWriter, required []string) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, strings.Join(required, " ")))
+	writeJSONError(w, 403, "insufficient_scope")
+}
+
+// scopeHandler returns a handler which checks a scoped request was granted
+// every required scope, or nil if none are required.
+func scopeHandler(required []string) martini.Handler {
+	if len(required) == 0 {
+		return nil
+	}
+	return func(w http.ResponseWriter, c martini.Context) {
+		scopes, scoped := requestScopes(c)
+		if !scoped {
+			return
+		}
+		for _, scope := range required {
+			if !scopes.Has(scope) {
+				log.WithFields(log.Fields{"required": required, "granted": scopes}).Warn("Insufficient scope")
+				writeInsufficientScope(w, required)
+				return
+			}
+		}
+	}
+}
+
+// getScopedTokenHandler returns the handler for <login path>/scoped, which
+// gives the logged in user a token restricted to the posted scopes. Scoped
+// credentials can't mint tokens, so a token can't outlive the one it was
+// narrowed from.
+func (api *apiServer) getScopedTokenHandler() func(*JsonBody, http.ResponseWriter, martini.Context) []byte {
+	return func(j *JsonBody, w http.ResponseWriter, c martini.Context) []byte {
+		if _, scoped := requestScopes(c); scoped {
+			writeInsufficientScope(w, nil)
+			return nil
+		}
+		id, ok := tokenUserID(c)
+		if !ok {
+			writeJSONError(w, 401, "Only a token can be narrowed")
+			return nil
+		}
+		list, _ := (*j)["scopes"].([]interface{})
+		scopes := make([]string, 0, len(list))
+		for _, s := range list {
+			scope, ok := s.(string)
+			if !ok || scope == "" || strings.ContainsAny(scope, " \"") {
+				writeJSONError(w, 422, fmt.Sprintf("Invalid scope %v", s))
+				return nil
+			}
+			scopes = append(scopes, scope)
+		}
+		if len(scopes) == 0 {
+			writeJSONError(w, 422, "scopes must list at least one scope")
+			return nil
+		}
+		return []byte("{\"token\":\"" + api.GetScopedToken(id, scopes) + "\"}")
+	}
+}
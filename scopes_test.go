@@ -0,0 +1,37 @@
+package api
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestScopedTokens(t *testing.T) {
+	db := getTestDb()
+	db.DropTable(&WidgetClone{})
+	db.CreateTable(&WidgetClone{})
+	a := New(Options{JwtKey: "RandomString", Db: db, Martini: getSilentMartini()})
+	a.SetAuth(&User{}, "/auth")
+	a.AddDefaultRoutes(&Widget{}, RouteOptions{Authenticate: true})
+	a.AddIndexRoute(&WidgetClone{}, RouteOptions{Authenticate: true, RequiredScopes: []string{"reports"}})
+
+	full := "?access_token=" + a.GetJWTToken(1)
+	readOnly := "?access_token=" + a.GetScopedToken(1, []string{"widgets:read"})
+
+	testApiReq(t, a, "Scoped(Full token)", "POST", "/api/widgets"+full, `{"name":"Scoped"}`, nil, 200)
+	testApiReq(t, a, "Scoped(Read)", "GET", "/api/widgets"+readOnly, "", nil, 200)
+	rec := testApiReq(t, a, "Scoped(Write)", "POST", "/api/widgets"+readOnly, `{"name":"Nope"}`, nil, 403)
+	if !strings.Contains(rec.Body.String(), "insufficient_scope") || !strings.Contains(rec.Header().Get("WWW-Authenticate"), `scope="widgets:write"`) {
+		t.Errorf("Expected insufficient_scope: %s %v", rec.Body.String(), rec.Header())
+	}
+	testApiReq(t, a, "Scoped(Explicit scope)", "GET", "/api/widget_clones"+readOnly, "", nil, 403)
+	testApiReq(t, a, "Scoped(Explicit scope, full token)", "GET", "/api/widget_clones"+full, "", nil, 200)
+
+	// Mint a narrowed token through the endpoint.
+	testApiReq(t, a, "Mint(No token)", "POST", "/auth/scoped", `{"scopes":["reports"]}`, nil, 401)
+	testApiReq(t, a, "Mint(No scopes)", "POST", "/auth/scoped"+full, `{"scopes":[]}`, nil, 422)
+	body := testApiReq(t, a, "Mint", "POST", "/auth/scoped"+full, `{"scopes":["reports"]}`, nil, 200).Body.String()
+	reports := "?access_token=" + getToken(body)
+	testApiReq(t, a, "Minted(Granted)", "GET", "/api/widget_clones"+reports, "", nil, 200)
+	testApiReq(t, a, "Minted(Not granted)", "GET", "/api/widgets"+reports, "", nil, 403)
+	testApiReq(t, a, "Mint(From scoped token)", "POST", "/auth/scoped"+reports, `{"scopes":["widgets:write"]}`, nil, 403)
+}
@@ -0,0 +1,226 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-martini/martini"
+)
+
+// AuthStrategy is one way of authenticating a request. Strategies can be
+// combined with AnyOf, or used alone as RouteOptions.Authenticate.
+type AuthStrategy interface {
+	// Name is recorded in the request context as AuthMethod when this
+	// strategy succeeds.
+	Name() string
+	// Challenge is this strategy's entry in the WWW-Authenticate header of a
+	// 401 response. eg. `Bearer realm="api"`.
+	Challenge() string
+	// Authenticate returns the logged in user, or an error if the request
+	// has no valid credentials for this strategy. It may map extra values into
+	// the context (eg. APIKeyStrategy maps the *APIKey).
+	Authenticate(a API, r *http.Request, c martini.Context) (LoginModel, error)
+}
+
+// AuthMethod is mapped into the request context by AnyOf. It contains the
+// Name() of the strategy which authenticated the request.
+type AuthMethod string
+
+// ErrNoLoginModel is returned by the builtin strategies if SetAuth hasn't been called.
+var ErrNoLoginModel = errors.New("No LoginModel. Call SetAuth() first")
+
+// AnyOf returns a middleware handler which tries each strategy in turn. The
+// first to succeed has its LoginModel and AuthMethod mapped into the request
+// context. If none succeed we return a single 401 Unauthorized, with a
+// WWW-Authenticate challenge for every strategy.
+func AnyOf(strategies ...AuthStrategy) martini.Handler {
+	challenges := make([]string, 0, len(strategies))
+	for _, s := range strategies {
+		challenges = append(challenges, s.Challenge())
+	}
+	challenge := strings.Join(challenges, ", ")
+	return func(w http.ResponseWriter, r *http.Request, c martini.Context, a API) {
+		for _, s := range strategies {
+			user, err := s.Authenticate(a, r, c)
+			if err == nil {
+				c.Map(user)
+				c.Map(AuthMethod(s.Name()))
+				return
+			}
+			log.WithFields(log.Fields{"strategy": s.Name(), "error": err}).Debug("Auth: strategy failed")
+		}
+		log.WithFields(log.Fields{"path": r.URL.Path}).Warn("Auth: no strategy authenticated request")
+		w.Header().Set("WWW-Authenticate", challenge)
+		w.WriteHeader(401)
+		fmt.Fprintf(w, "Unauthorized")
+	}
+}
+
+// loginModelById looks up the user with the LoginModel passed to SetAuth.
+func (api *apiServer) loginModelById(id uint) (LoginModel, error) {
+	if api.loginModel == nil {
+		log.Error("Authentication needs a LoginModel. Call SetAuth() first")
+		return nil, ErrNoLoginModel
+	}
+	guser, err := api.loginModel.GetById(id)
+	if err != nil {
+		log.WithFields(log.Fields{"id": id}).Warn("Cannot find logged in user")
+		return nil, err
+	}
+	return guser.(LoginModel), nil
+}
+
+type jwtStrategy struct{}
+
+// JWTStrategy authenticates with a token from GetJWTToken, passed as a Bearer
+// Authorization header or access_token parameter. This is the strategy used
+// by RouteOptions{Authenticate: true}.
+func JWTStrategy() AuthStrategy { return jwtStrategy{} }
+
+func (jwtStrategy) Name() string      { return "jwt" }
+func (jwtStrategy) Challenge() string { return `Bearer realm="api"` }
+func (jwtStrategy) Authenticate(a API, r *http.Request, c martini.Context) (LoginModel, error) {
+	api := a.(*apiServer)
+	token, err := jwt.ParseFromRequest(r, api.jwtKeyFunc)
+	if err != nil || token == nil || !token.Valid {
+		return nil, fmt.Errorf("JWT token did not validate: %v", err)
+	}
+	user, err := api.loginModelFromToken(token)
+	if err == nil {
+		err = api.mapImpersonator(token, c)
+	}
+	if err == nil {
+		mapTokenScopes(token, c)
+		c.Map(token)
+	}
+	return user, err
+}
+
+type apiKeyStrategy struct{}
+
+// APIKeyStrategy authenticates with a key created by the routes added by
+// AddAPIKeyRoutes. See APIKeyAuth.
+func APIKeyStrategy() AuthStrategy { return apiKeyStrategy{} }
+
+func (apiKeyStrategy) Name() string      { return "api_key" }
+func (apiKeyStrategy) Challenge() string { return `ApiKey realm="api"` }
+func (apiKeyStrategy) Authenticate(a API, r *http.Request, c martini.Context) (LoginModel, error) {
+	api := a.(*apiServer)
+	apiKey, err := api.findAPIKey(api.apiKeyFromRequest(r))
+	if err != nil {
+		return nil, err
+	}
+	user, err := api.loginModelById(apiKey.OwnerID)
+	if err != nil {
+		return nil, err
+	}
+	c.Map(apiKey)
+	if scopes := apiKey.ScopeList(); len(scopes) > 0 {
+		c.Map(TokenScopes(scopes))
+	}
+	return user, nil
+}
+
+type basicStrategy struct {
+	usernameField string
+}
+
+// BasicStrategy authenticates with HTTP Basic credentials. They are checked
+// by the LoginModel's CheckLoginDetails, as though they had been posted to the
+// login route as {usernameField: username, "password": password}, and
+// throttled in the same way by Options.LoginThrottle. Users with two factor
+// authentication on can't use Basic credentials, as there is nowhere to give
+// a code. usernameField defaults to "name".
+func BasicStrategy(usernameField string) AuthStrategy {
+	if usernameField == "" {
+		usernameField = "name"
+	}
+	return basicStrategy{usernameField}
+}
+
+func (basicStrategy) Name() string      { return "basic" }
+func (basicStrategy) Challenge() string { return `Basic realm="api", charset="UTF-8"` }
+func (s basicStrategy) Authenticate(a API, r *http.Request, c martini.Context) (LoginModel, error) {
+	api := a.(*apiServer)
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, errors.New("No basic auth credentials")
+	}
+	if api.loginModel == nil {
+		return nil, ErrNoLoginModel
+	}
+	details := map[string]interface{}{s.usernameField: username, "password": password}
+	id, err := api.checkLogin(details, username, clientIP(r))
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := api.twoFactorUser(id); ok {
+		return nil, errors.New("Basic auth refused for a user with two factor authentication")
+	}
+	return api.loginModelById(id)
+}
+
+type cookieStrategy struct{}
+
+// CookieStrategy authenticates with the signed session cookie set by the login
+// route when Options.SessionCookie is set.
+func CookieStrategy() AuthStrategy { return cookieStrategy{} }
+
+func (cookieStrategy) Name() string      { return "cookie" }
+func (cookieStrategy) Challenge() string { return `Cookie realm="api"` }
+func (cookieStrategy) Authenticate(a API, r *http.Request, c martini.Context) (LoginModel, error) {
+	api := a.(*apiServer)
+	cookie, err := r.Cookie(api.sessionCookieName())
+	if err != nil {
+		return nil, err
+	}
+	token, err := jwt.Parse(cookie.Value, api.jwtKeyFunc)
+	if err != nil || token == nil || !token.Valid {
+		return nil, fmt.Errorf("Session cookie did not validate: %v", err)
+	}
+	user, err := api.loginModelFromToken(token)
+	if err == nil {
+		err = api.mapImpersonator(token, c)
+	}
+	if err == nil {
+		mapTokenScopes(token, c)
+		c.Map(token)
+	}
+	return user, err
+}
+
+// sessionCookieName returns the name of the session cookie. Defaults to "session".
+func (api *apiServer) sessionCookieName() string {
+	if api.options.SessionCookie == "" {
+		return "session"
+	}
+	return api.options.SessionCookie
+}
+
+// setSessionCookie sets a session cookie containing the signed token.
+func (api *apiServer) setSessionCookie(w http.ResponseWriter, token string) {
+	timeout := api.jwtExpiry()
+	http.SetCookie(w, &http.Cookie{
+		Name:     api.sessionCookieName(),
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(timeout.Seconds()),
+		HttpOnly: true,
+		Secure:   api.options.SessionCookieSecure,
+		SameSite: api.sessionCookieSameSite(),
+	})
+}
+
+// sessionCookieSameSite returns the SameSite attribute of the session cookie.
+// Defaults to Lax, so other sites can't make authenticated requests with it
+// except by top level navigation.
+func (api *apiServer) sessionCookieSameSite() http.SameSite {
+	if api.options.SessionCookieSameSite == 0 {
+		return http.SameSiteLaxMode
+	}
+	return api.options.SessionCookieSameSite
+}
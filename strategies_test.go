@@ -0,0 +1,55 @@
+package api
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// Check AnyOf accepts each strategy, records which one succeeded, and sends a
+// single challenge for all of them on failure.
+func TestAnyOf(t *testing.T) {
+	a := getTestApi()
+	a.AddIndexRoute(&Widget{}, RouteOptions{
+		UriModelName: "any_of_widgets",
+		Authenticate: AnyOf(JWTStrategy(), BasicStrategy(""), CookieStrategy()),
+		EditResult:   func(req *Request, method AuthMethod) { req.Result = method }})
+	a.AddIndexRoute(&Widget{}, RouteOptions{UriModelName: "basic_widgets", Authenticate: BasicStrategy("")})
+
+	token := getToken(testReq(t, "Login", "POST", "/auth", `{"name": "admin", "password": "password"}`, 200))
+	basic := "Basic " + base64.StdEncoding.EncodeToString([]byte("admin:password"))
+	wrongBasic := "Basic " + base64.StdEncoding.EncodeToString([]byte("admin:wrongpassword"))
+
+	rec := testReqHeaders(t, "AnyOf(No credentials)", "GET", "/api/any_of_widgets", "", nil, 401)
+	challenge := rec.Header().Get("WWW-Authenticate")
+	for _, scheme := range []string{"Bearer", "Basic", "Cookie"} {
+		if !strings.Contains(challenge, scheme) {
+			t.Errorf("WWW-Authenticate header %q doesn't offer %s", challenge, scheme)
+		}
+	}
+	testReqHeaders(t, "AnyOf(Wrong basic)", "GET", "/api/any_of_widgets", "", map[string]string{"Authorization": wrongBasic}, 401)
+
+	checkMethod := func(name string, headers map[string]string, expected string) {
+		body := testReqHeaders(t, name, "GET", "/api/any_of_widgets", "", headers, 200).Body.String()
+		if body != `"`+expected+`"` {
+			t.Errorf("%s authenticated with %s, expected %s", name, body, expected)
+		}
+	}
+	checkMethod("AnyOf(JWT)", map[string]string{"Authorization": "Bearer " + token}, "jwt")
+	checkMethod("AnyOf(Basic)", map[string]string{"Authorization": basic}, "basic")
+	checkMethod("AnyOf(Cookie)", map[string]string{"Cookie": "session=" + token}, "cookie")
+
+	testReqHeaders(t, "Strategy(Basic)", "GET", "/api/basic_widgets", "", map[string]string{"Authorization": basic}, 200)
+	testReqHeaders(t, "Strategy(Basic, JWT token)", "GET", "/api/basic_widgets", "", map[string]string{"Authorization": "Bearer " + token}, 401)
+}
+
+// The session cookie is HttpOnly and SameSite=Lax unless configured otherwise.
+func TestSessionCookie(t *testing.T) {
+	a := New(Options{JwtKey: "RandomString", Db: getTestDb(), Martini: getSilentMartini(), SessionCookie: "session"})
+	a.SetAuth(&User{}, "/auth")
+	rec := testApiReq(t, a, "Login(Cookie)", "POST", "/auth", `{"name": "admin", "password": "password"}`, nil, 200)
+	cookie := rec.Header().Get("Set-Cookie")
+	if !strings.Contains(cookie, "HttpOnly") || !strings.Contains(cookie, "SameSite=Lax") {
+		t.Errorf("Session cookie should be HttpOnly and SameSite=Lax: %s", cookie)
+	}
+}
@@ -0,0 +1,294 @@
+package api
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-martini/martini"
+)
+
+var (
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// strictChecker walks a JSON document alongside the Go type it will be
+// decoded into, recording every unknown field, duplicate key and type
+// mismatch by its JSON pointer.
+type strictChecker struct {
+	dec    *json.Decoder
+	errors map[string]string
+}
+
+// strictErrors returns the problems found decoding body into a value of type
+// t, keyed by JSON pointer, eg. {"/items/3/price": "expected number"}.
+func strictErrors(body []byte, t reflect.Type) map[string]string {
+	s := strictChecker{dec: json.NewDecoder(bytes.NewReader(body)), errors: map[string]string{}}
+	s.dec.UseNumber()
+	if err := s.value(t, ""); err != nil {
+		s.errors[""] = err.Error()
+	}
+	return s.errors
+}
+
+// pointerToken escapes a JSON pointer reference token.
+func pointerToken(s string) string {
+	return strings.Replace(strings.Replace(s, "~", "~0", -1), "/", "~1", -1)
+}
+
+// pointerPath returns path, or "/" for the document itself.
+func pointerPath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+// expected returns the JSON type name expected for t.
+func expected(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "string"
+	case reflect.Struct, reflect.Map:
+		return "object"
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 && t.Kind() == reflect.Slice {
+			return "string"
+		}
+		return "array"
+	}
+	return t.Kind().String()
+}
+
+// mismatch records that the value at path isn't of the type expected for t.
+func (s *strictChecker) mismatch(t reflect.Type, path string) {
+	s.errors[pointerPath(path)] = "expected " + expected(t)
+}
+
+// skip consumes the rest of a value whose first token has been read.
+func (s *strictChecker) skip(tok json.Token) error {
+	if d, ok := tok.(json.Delim); ok && (d == '{' || d == '[') {
+		for depth := 1; depth > 0; {
+			tok, err := s.dec.Token()
+			if err != nil {
+				return err
+			}
+			if d, ok := tok.(json.Delim); ok {
+				if d == '{' || d == '[' {
+					depth++
+				} else {
+					depth--
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// value checks the next value in the document against t.
+func (s *strictChecker) value(t reflect.Type, path string) error {
+	tok, err := s.dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		return nil // null is allowed for anything
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	// Types which decode themselves (eg. time.Time) are left to decode.
+	pt := reflect.PtrTo(t)
+	if pt.Implements(jsonUnmarshalerType) || (pt.Implements(textUnmarshalerType) && t.Kind() != reflect.Map) {
+		return s.skip(tok)
+	}
+	switch t.Kind() {
+	case reflect.Interface:
+		return s.skip(tok)
+	case reflect.Struct:
+		if tok != json.Delim('{') {
+			s.mismatch(t, path)
+			return s.skip(tok)
+		}
+		return s.object(path, func(key string) (reflect.Type, string, bool) {
+			f, ok := structField(t, key)
+			return f.Type, f.Name, ok
+		})
+	case reflect.Map:
+		if tok != json.Delim('{') {
+			s.mismatch(t, path)
+			return s.skip(tok)
+		}
+		return s.object(path, func(key string) (reflect.Type, string, bool) {
+			return t.Elem(), key, true
+		})
+	case reflect.Slice, reflect.Array:
+		if expected(t) == "string" {
+			if _, ok := tok.(string); !ok {
+				s.mismatch(t, path)
+			}
+			return s.skip(tok)
+		}
+		if tok != json.Delim('[') {
+			s.mismatch(t, path)
+			return s.skip(tok)
+		}
+		for i := 0; s.dec.More(); i++ {
+			if err := s.value(t.Elem(), path+"/"+strconv.Itoa(i)); err != nil {
+				return err
+			}
+		}
+		_, err := s.dec.Token()
+		return err
+	}
+	ok := false
+	switch v := tok.(type) {
+	case bool:
+		ok = t.Kind() == reflect.Bool
+	case string:
+		ok = t.Kind() == reflect.String
+	case json.Number:
+		switch expected(t) {
+		case "integer":
+			_, err := strconv.ParseInt(string(v), 10, 64)
+			_, uerr := strconv.ParseUint(string(v), 10, 64)
+			ok = err == nil || uerr == nil
+		case "number":
+			ok = true
+		}
+	}
+	if !ok {
+		s.mismatch(t, path)
+	}
+	return s.skip(tok)
+}
+
+// object checks the members of an object whose opening brace has been read.
+// field returns the type of a key's value, an identity for spotting
+// duplicates, and false if the key is unknown.
+func (s *strictChecker) object(path string, field func(key string) (reflect.Type, string, bool)) error {
+	seen := map[string]bool{}
+	for s.dec.More() {
+		tok, err := s.dec.Token()
+		if err != nil {
+			return err
+		}
+		key := tok.(string)
+		keyPath := path + "/" + pointerToken(key)
+		t, id, ok := field(key)
+		if !ok {
+			s.errors[keyPath] = "unknown field"
+			t = reflect.TypeOf((*interface{})(nil)).Elem()
+		} else if seen[id] {
+			s.errors[keyPath] = "duplicate key"
+		}
+		seen[id] = true
+		if err := s.value(t, keyPath); err != nil {
+			return err
+		}
+	}
+	_, err := s.dec.Token()
+	return err
+}
+
+// structField returns the field of t which encoding/json would decode key
+// into, preferring an exact match to a case insensitive one.
+func structField(t reflect.Type, key string) (reflect.StructField, bool) {
+	var fold reflect.StructField
+	found := false
+	for _, f := range jsonFields(t) {
+		name := jsonName(f)
+		if name == key {
+			return f, true
+		}
+		if !found && strings.EqualFold(name, key) {
+			fold, found = f, true
+		}
+	}
+	return fold, found
+}
+
+// jsonFields returns the fields of t decoded by encoding/json, including
+// those promoted from embedded structs.
+func jsonFields(t reflect.Type) []reflect.StructField {
+	fields := []reflect.StructField{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && ft.Kind() == reflect.Struct && strings.Split(tag, ",")[0] == "" {
+			fields = append(fields, jsonFields(ft)...)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// jsonName returns the key encoding/json uses for f.
+func jsonName(f reflect.StructField) string {
+	if name := strings.Split(f.Tag.Get("json"), ",")[0]; name != "" {
+		return name
+	}
+	return f.Name
+}
+
+// bodyCheck returns the problems found in a JSON body, keyed by JSON pointer.
+type bodyCheck func(body []byte) map[string]string
+
+// decodeCheckedBody is decodeBody for routes with RouteOptions.StrictBody or
+// RouteOptions.ValidateSchema. It writes a 422 listing every problem found in
+// the body by checks, by JSON pointer, and returns false if there are any.
+//
+// Unlike decodeBody it buffers the whole body, as each check walks it before
+// it is decoded into v. The buffer is bounded by the route's MaxBodyBytes, as
+// reading stops with a 413 there.
+func decodeCheckedBody(w http.ResponseWriter, r *http.Request, c martini.Context, v interface{}, checks []bodyCheck) bool {
+	var raw json.RawMessage
+	if !decodeBody(w, r, c, &raw) {
+		return false
+	}
+	errs := map[string]string{}
+	for _, check := range checks {
+		for path, problem := range check(raw) {
+			if _, ok := errs[path]; !ok {
+				errs[path] = problem
+			}
+		}
+	}
+	if len(errs) > 0 {
+		log.WithFields(log.Fields{"errors": errs}).Warn("Body check failed")
+		j, _ := json.Marshal(map[string]interface{}{"errors": errs})
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(422)
+		w.Write(j)
+		return false
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		writeJSONError(w, 422, err.Error())
+		return false
+	}
+	return true
+}
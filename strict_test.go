@@ -0,0 +1,68 @@
+package api
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type strictItem struct {
+	Price    float64 `json:"price"`
+	Quantity int     `json:"quantity"`
+}
+
+type strictOrder struct {
+	Name    string            `json:"name"`
+	Paid    bool              `json:"paid"`
+	Items   []strictItem      `json:"items"`
+	Tags    map[string]string `json:"tags"`
+	Due     *time.Time        `json:"due"`
+	Secret  string            `json:"-"`
+	Unnamed string
+}
+
+func TestStrictErrors(t *testing.T) {
+	for body, expected := range map[string]map[string]string{
+		`{"name":"ok","paid":true,"items":[{"price":1.5,"quantity":2}],"tags":{"a/b":"c"},"due":"2015-01-01T00:00:00Z","Unnamed":"x"}`: {},
+		`{"NAME":"Case insensitive","due":null}`:                        {},
+		`{"nmae":"Typo"}`:                                               {"/nmae": "unknown field"},
+		`{"Secret":"Ignored field"}`:                                    {"/Secret": "unknown field"},
+		`{"name":"One","name":"Two"}`:                                   {"/name": "duplicate key"},
+		`{"name":1,"paid":"yes"}`:                                       {"/name": "expected string", "/paid": "expected boolean"},
+		`{"items":[{"price":1},{},{},{"price":"free","quantity":1.5}]}`: {"/items/3/price": "expected number", "/items/3/quantity": "expected integer"},
+		`{"items":{"price":1},"tags":{"x":{"nested":true}}}`:            {"/items": "expected array", "/tags/x": "expected string"},
+		`[1,2]`: {"/": "expected object"},
+	} {
+		errs := strictErrors([]byte(body), reflect.TypeOf(&strictOrder{}))
+		if !reflect.DeepEqual(errs, expected) {
+			t.Errorf("Strict check of %s: expected %v, got %v", body, expected, errs)
+		}
+	}
+}
+
+// StrictWidget keeps the rows posted by TestStrictBody out of the widgets
+// table, which other tests count.
+type StrictWidget struct {
+	ID   uint   `gorm:"primary_key" json:"id"`
+	Name string `json:"name"`
+}
+
+func TestStrictBody(t *testing.T) {
+	db := getTestDb()
+	db.DropTable(&StrictWidget{})
+	db.CreateTable(&StrictWidget{})
+	db.Create(&StrictWidget{ID: 1, Name: "Widget 1"})
+	a := New(Options{Db: db, Martini: getSilentMartini()})
+	a.AddDefaultRoutes(&StrictWidget{}, RouteOptions{StrictBody: true})
+
+	testApiReq(t, a, "Strict(Valid)", "POST", "/api/strict_widgets", `{"name":"Strict"}`, nil, 200)
+	body := testApiReq(t, a, "Strict(Post)", "POST", "/api/strict_widgets", `{"nmae":"Typo","id":"3"}`, nil, 422).Body.String()
+	result := map[string]map[string]string{}
+	json.Unmarshal([]byte(body), &result)
+	if !reflect.DeepEqual(result["errors"], map[string]string{"/nmae": "unknown field", "/id": "expected integer"}) {
+		t.Errorf("Bad strict errors: %s", body)
+	}
+	testApiReq(t, a, "Strict(Patch)", "PATCH", "/api/strict_widgets/1", `{"name":"A","name":"B"}`, nil, 422)
+	testApiReq(t, a, "Strict(Patch valid)", "PATCH", "/api/strict_widgets/1", `{"name":"Widget 1"}`, nil, 200)
+}
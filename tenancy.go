@@ -0,0 +1,234 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-martini/martini"
+	"github.com/serenize/snaker"
+)
+
+// Tenancy isolates customers sharing a database. Set it as Options.Tenancy.
+// A tenant ID is resolved for every request from the first of these sources
+// which is configured and present:
+//
+//   - Claim: a claim of a valid JWT token in the request
+//   - Subdomain: the first label of the request's Host, unless the Host is an
+//     IP address, has only two labels, or the label is in ReservedSubdomains
+//   - Header: a request header (eg. "X-Tenant")
+//
+// Every model with a field whose column is Column is then tenant scoped. Its
+// routes refuse requests without a tenant, only find rows of the request's
+// tenant, stamp the tenant on created rows, and refuse to change it on PATCH.
+// Models without the column (eg. a table of tenants) are not scoped.
+//
+// Header and Subdomain are chosen by the client. On authenticated routes the
+// logged in user must implement TenantMember and belong to the request's
+// tenant, or the request is refused. Unauthenticated routes can't check, so
+// Header and Subdomain should only be used for them where the client is
+// trusted.
+//
+// The package's own tables (API keys, audit entries and webhook
+// subscriptions) are always tenant scoped, by their tenant column.
+type Tenancy struct {
+	Claim     string
+	Subdomain bool
+	Header    string
+
+	// Column holding the tenant ID. Defaults to tenant_id.
+	Column string
+	// First labels which aren't tenants, eg. "api". Defaults to "www".
+	ReservedSubdomains []string
+}
+
+// A LoginModel implementing TenantMember has its tenant added to new JWT
+// tokens as the Tenancy.Claim claim, and may only use authenticated routes for
+// requests of that tenant.
+type TenantMember interface {
+	TenantID() string
+}
+
+// column returns the name of the tenant column.
+func (t *Tenancy) column() string {
+	if t.Column == "" {
+		return "tenant_id"
+	}
+	return t.Column
+}
+
+// resolveTenant returns the tenant ID for the request, or "" if none can be found.
+func (api *apiServer) resolveTenant(r *http.Request) string {
+	tenancy := api.options.Tenancy
+	if tenancy.Claim != "" {
+		token, err := jwt.ParseFromRequest(r, api.jwtKeyFunc)
+		if err == nil && token != nil && token.Valid {
+			if tenant := claimString(token.Claims[tenancy.Claim]); tenant != "" {
+				return tenant
+			}
+		}
+	}
+	if tenancy.Subdomain {
+		if tenant := tenancy.subdomainTenant(r.Host); tenant != "" {
+			return tenant
+		}
+	}
+	if tenancy.Header != "" {
+		return r.Header.Get(tenancy.Header)
+	}
+	return ""
+}
+
+// subdomainTenant returns the first label of host, or "" if host is an IP
+// address, has no subdomain, or the label is reserved.
+func (t *Tenancy) subdomainTenant(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if net.ParseIP(strings.Trim(host, "[]")) != nil {
+		return ""
+	}
+	labels := strings.Split(host, ".")
+	if len(labels) <= 2 {
+		return ""
+	}
+	reserved := t.ReservedSubdomains
+	if reserved == nil {
+		reserved = []string{"www"}
+	}
+	for _, r := range reserved {
+		if strings.EqualFold(labels[0], r) {
+			return ""
+		}
+	}
+	return labels[0]
+}
+
+// claimString converts a JWT claim (a string or number) to a string.
+func claimString(claim interface{}) string {
+	switch c := claim.(type) {
+	case string:
+		return c
+	case float64:
+		return strconv.FormatFloat(c, 'f', -1, 64)
+	}
+	return ""
+}
+
+// tenantField returns the tenant field of itemType, if tenancy is enabled and
+// itemType has one.
+func (api *apiServer) tenantField(itemType reflect.Type) (reflect.StructField, bool) {
+	if api.options.Tenancy == nil || itemType == nil || itemType.Kind() != reflect.Struct {
+		return reflect.StructField{}, false
+	}
+	column := api.options.Tenancy.column()
+	for i := 0; i < itemType.NumField(); i++ {
+		field := itemType.Field(i)
+		if snaker.CamelToSnake(field.Name) == column {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// tenantQuery returns the where clause scoping itemType's table to a tenant.
+func (api *apiServer) tenantQuery(itemType reflect.Type) string {
+	return fmt.Sprintf("%s.%s = ?", pluralCamelNameType(itemType), api.options.Tenancy.column())
+}
+
+// tenantValue converts tenant to the type of field.
+func tenantValue(field reflect.StructField, tenant string) (reflect.Value, error) {
+	switch field.Type.Kind() {
+	case reflect.String:
+		return reflect.ValueOf(tenant).Convert(field.Type), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(tenant, 10, 64)
+		return reflect.ValueOf(i).Convert(field.Type), err
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(tenant, 10, 64)
+		return reflect.ValueOf(u).Convert(field.Type), err
+	}
+	return reflect.Value{}, fmt.Errorf("Unsupported tenant field type %v", field.Type)
+}
+
+// stampTenant sets the tenant field of item (a struct pointer) to the request's tenant.
+func stampTenant(field reflect.StructField, item interface{}, tenant string) error {
+	v, err := tenantValue(field, tenant)
+	if err != nil {
+		return err
+	}
+	reflect.ValueOf(item).Elem().FieldByIndex(field.Index).Set(v)
+	return nil
+}
+
+// sameTenant returns true if the tenant field of item (a struct pointer) is tenant.
+func sameTenant(field reflect.StructField, item interface{}, tenant string) bool {
+	v, err := tenantValue(field, tenant)
+	if err != nil {
+		return false
+	}
+	return reflect.ValueOf(item).Elem().FieldByIndex(field.Index).Interface() == v.Interface()
+}
+
+// writeNoTenant responds to a request for a tenant scoped model without a tenant.
+func writeNoTenant(w http.ResponseWriter, r *http.Request) {
+	log.WithFields(log.Fields{"path": r.URL.Path}).Warn("Tenancy: no tenant for request")
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(400)
+	w.Write([]byte(`{"error":"No tenant"}`))
+}
+
+// writeNotMember responds to a request by a user who isn't a member of its tenant.
+func writeNotMember(w http.ResponseWriter, r *http.Request, tenant string) {
+	log.WithFields(log.Fields{"path": r.URL.Path, "tenant": tenant}).Warn("Tenancy: user isn't a member of the tenant")
+	writeJSONError(w, 403, "Not a member of this tenant")
+}
+
+// isTenantMember returns true if user implements TenantMember and belongs to tenant.
+func isTenantMember(user interface{}, tenant string) bool {
+	member, ok := user.(TenantMember)
+	return ok && member.TenantID() == tenant
+}
+
+// tenantMemberStep returns a handler refusing requests whose logged in user
+// isn't a member of the request's tenant, or nil if tenancy is off or the
+// route isn't authenticated. It follows authentication, so an impersonated
+// request is checked against the user being impersonated.
+func (api *apiServer) tenantMemberStep(options RouteOptions) martini.Handler {
+	if api.options.Tenancy == nil || api.getAuthenticateHandler(options.Authenticate) == nil {
+		return nil
+	}
+	return func(req *Request, w http.ResponseWriter, r *http.Request, c martini.Context) {
+		user := c.Get(loginModelType)
+		if req.Tenant == "" || !user.IsValid() {
+			return
+		}
+		if !isTenantMember(user.Interface(), req.Tenant) {
+			writeNotMember(w, r, req.Tenant)
+		}
+	}
+}
+
+// ownTenantColumn holds the tenant of rows in the package's own tables.
+const ownTenantColumn = "tenant"
+
+// ownTenantHandler returns a handler scoping req.DB to the request's tenant,
+// for routes on the package's own tables, or nil if tenancy is off. Requests
+// without a tenant are refused.
+func (api *apiServer) ownTenantHandler() martini.Handler {
+	if api.options.Tenancy == nil {
+		return nil
+	}
+	return func(req *Request, w http.ResponseWriter, r *http.Request) {
+		if req.Tenant == "" {
+			writeNoTenant(w, r)
+			return
+		}
+		req.DB = req.DB.Where(ownTenantColumn+" = ?", req.Tenant)
+	}
+}
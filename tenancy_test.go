@@ -0,0 +1,148 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+type TenantWidget struct {
+	ID       uint   `gorm:"primary_key" json:"id"`
+	TenantID string `json:"tenant_id"`
+	Name     string `json:"name"`
+}
+
+func TestTenancy(t *testing.T) {
+	db := getTestDb()
+	db.DropTable(&TenantWidget{})
+	db.CreateTable(&TenantWidget{})
+	acme := TenantWidget{TenantID: "acme", Name: "Acme's"}
+	globex := TenantWidget{TenantID: "globex", Name: "Globex's"}
+	db.Create(&acme)
+	db.Create(&globex)
+
+	a := New(Options{Db: db, Martini: getSilentMartini(), Tenancy: &Tenancy{Subdomain: true, Header: "X-Tenant"}})
+	a.AddDefaultRoutes(&TenantWidget{})
+	a.AddDefaultRoutes(&Widget{})
+	asAcme := map[string]string{"X-Tenant": "acme"}
+
+	testApiReq(t, a, "Tenancy(No tenant)", "GET", "/api/tenant_widgets", "", nil, 400)
+	testApiReq(t, a, "Tenancy(Unscoped model)", "GET", "/api/widgets", "", nil, 200)
+
+	body := testApiReq(t, a, "Tenancy(Index)", "GET", "/api/tenant_widgets", "", asAcme, 200).Body.String()
+	widgets := []TenantWidget{}
+	json.Unmarshal([]byte(body), &widgets)
+	if len(widgets) != 1 || widgets[0].ID != acme.ID {
+		t.Errorf("Index not scoped to tenant: %s", body)
+	}
+	body = testApiReq(t, a, "Tenancy(Subdomain)", "GET", "http://globex.example.com/api/tenant_widgets", "", nil, 200).Body.String()
+	widgets = []TenantWidget{}
+	json.Unmarshal([]byte(body), &widgets)
+	if len(widgets) != 1 || widgets[0].ID != globex.ID {
+		t.Errorf("Index not scoped to subdomain tenant: %s", body)
+	}
+
+	other := fmt.Sprintf("/api/tenant_widgets/%d", globex.ID)
+	own := fmt.Sprintf("/api/tenant_widgets/%d", acme.ID)
+	testApiReq(t, a, "Tenancy(Get other)", "GET", other, "", asAcme, 404)
+	testApiReq(t, a, "Tenancy(Patch other)", "PATCH", other, `{"name":"Mine now"}`, asAcme, 404)
+	testApiReq(t, a, "Tenancy(Delete other)", "DELETE", other, "", asAcme, 404)
+	testApiReq(t, a, "Tenancy(Change tenant)", "PATCH", own, `{"tenant_id":"globex"}`, asAcme, 403)
+	testApiReq(t, a, "Tenancy(Patch own)", "PATCH", own, `{"name":"Still Acme's"}`, asAcme, 200)
+
+	body = testApiReq(t, a, "Tenancy(Create)", "POST", "/api/tenant_widgets", `{"name":"New","tenant_id":"globex"}`, asAcme, 200).Body.String()
+	created := TenantWidget{}
+	json.Unmarshal([]byte(body), &created)
+	if created.TenantID != "acme" {
+		t.Errorf("Create didn't stamp tenant: %s", body)
+	}
+}
+
+type TenantUser struct {
+	ID       uint   `gorm:"primary_key" json:"id"`
+	Name     string `json:"name"`
+	Password string `json:"-"`
+	Tenant   string `json:"tenant"`
+}
+
+func (_ *TenantUser) CheckLoginDetails(j *map[string]interface{}) (uint, error) {
+	user := TenantUser{}
+	if getTestDb().Where("name = ? AND password = ?", (*j)["name"], (*j)["password"]).Find(&user).RecordNotFound() {
+		return 0, errors.New("Not authenticated")
+	}
+	return user.ID, nil
+}
+
+func (_ *TenantUser) GetById(id uint) (interface{}, error) {
+	user := TenantUser{}
+	if getTestDb().Where("id = ?", id).Find(&user).RecordNotFound() {
+		return &user, errors.New("User not found")
+	}
+	return &user, nil
+}
+
+func (u *TenantUser) TenantID() string { return u.Tenant }
+
+func (u *TenantUser) Roles() []string { return []string{"admin"} }
+
+// Authenticated users can only use their own tenant, whatever tenant the
+// client asks for, and the package's own tables are tenant scoped too.
+func TestSubdomainTenant(t *testing.T) {
+	tenancy := &Tenancy{Subdomain: true}
+	reserved := &Tenancy{Subdomain: true, ReservedSubdomains: []string{"api", "www"}}
+	for _, c := range []struct {
+		tenancy  *Tenancy
+		host     string
+		expected string
+	}{
+		{tenancy, "acme.example.com", "acme"},
+		{tenancy, "acme.example.com:3000", "acme"},
+		{tenancy, "example.com", ""},
+		{tenancy, "10.0.0.5", ""},
+		{tenancy, "10.0.0.5:3000", ""},
+		{tenancy, "[::1]:3000", ""},
+		{tenancy, "www.example.com", ""},
+		{tenancy, "WWW.example.com", ""},
+		{reserved, "api.example.com", ""},
+		{reserved, "acme.example.com", "acme"},
+	} {
+		if tenant := c.tenancy.subdomainTenant(c.host); tenant != c.expected {
+			t.Errorf("Tenant of %s should be %q, got %q", c.host, c.expected, tenant)
+		}
+	}
+}
+
+func TestTenantMembership(t *testing.T) {
+	db := getTestDb()
+	db.DropTable(&TenantUser{})
+	db.CreateTable(&TenantUser{})
+	db.Create(&TenantUser{Name: "wile", Password: "pass", Tenant: "acme"})
+	db.Create(&TenantUser{Name: "hank", Password: "pass", Tenant: "globex"})
+
+	a := New(Options{JwtKey: "RandomString", Db: db, Martini: getSilentMartini(), Tenancy: &Tenancy{Header: "X-Tenant"}})
+	a.SetAuth(&TenantUser{}, "/auth")
+	a.AddIndexRoute(&TenantWidget{}, RouteOptions{UriModelName: "member_widgets", Authenticate: true})
+	a.AddAPIKeyRoutes("/api/api_keys")
+
+	asAcme, asGlobex := map[string]string{"X-Tenant": "acme"}, map[string]string{"X-Tenant": "globex"}
+	wileq := "?access_token=" + getToken(testApiReq(t, a, "Login(wile)", "POST", "/auth", `{"name":"wile","password":"pass"}`, nil, 200).Body.String())
+	hankq := "?access_token=" + getToken(testApiReq(t, a, "Login(hank)", "POST", "/auth", `{"name":"hank","password":"pass"}`, nil, 200).Body.String())
+
+	testApiReq(t, a, "Member(Own tenant)", "GET", "/api/member_widgets"+wileq, "", asAcme, 200)
+	testApiReq(t, a, "Member(Other tenant)", "GET", "/api/member_widgets"+wileq, "", asGlobex, 403)
+
+	testApiReq(t, a, "Member(Create key)", "POST", "/api/api_keys"+wileq, `{"owner_id":1,"name":"acme"}`, asAcme, 200)
+	testApiReq(t, a, "Member(Key, other tenant)", "GET", "/api/api_keys"+wileq, "", asGlobex, 403)
+	body := testApiReq(t, a, "Member(Other tenant's keys)", "GET", "/api/api_keys"+hankq, "", asGlobex, 200).Body.String()
+	keys := []APIKey{}
+	json.Unmarshal([]byte(body), &keys)
+	if len(keys) != 0 {
+		t.Errorf("globex can see acme's API keys: %s", body)
+	}
+	body = testApiReq(t, a, "Member(Own keys)", "GET", "/api/api_keys"+wileq, "", asAcme, 200).Body.String()
+	json.Unmarshal([]byte(body), &keys)
+	if len(keys) != 1 || keys[0].Tenant != "acme" {
+		t.Errorf("Expected acme's API key: %s", body)
+	}
+}
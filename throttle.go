@@ -0,0 +1,222 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// LimiterEntry records recent login failures for a username or client IP.
+type LimiterEntry struct {
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+// LimiterStore stores LimiterEntries for LoginThrottle. Implement it to share
+// login throttling between several servers.
+type LimiterStore interface {
+	// Get returns the entry for key, or a zero entry if there is none.
+	Get(key string) (LimiterEntry, error)
+	Set(key string, entry LimiterEntry) error
+	Delete(key string) error
+}
+
+// MemoryLimiterStore is a LimiterStore for a single server.
+type MemoryLimiterStore struct {
+	mutex   sync.Mutex
+	entries map[string]LimiterEntry
+}
+
+// NewMemoryLimiterStore returns an empty MemoryLimiterStore.
+func NewMemoryLimiterStore() *MemoryLimiterStore {
+	return &MemoryLimiterStore{entries: make(map[string]LimiterEntry)}
+}
+
+func (s *MemoryLimiterStore) Get(key string) (LimiterEntry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.entries[key], nil
+}
+
+func (s *MemoryLimiterStore) Set(key string, entry LimiterEntry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.entries[key] = entry
+	return nil
+}
+
+func (s *MemoryLimiterStore) Delete(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+// LockoutEvent is passed to LoginThrottle.OnLockout when a username or client
+// IP is locked out.
+type LockoutEvent struct {
+	Username string
+	IP       string
+	Key      string // The username or IP key which was locked out
+	Failures int
+	Until    time.Time
+}
+
+// LoginThrottle slows down password guessing at the route added by SetAuth.
+// Set it as Options.LoginThrottle. After a number of free failures, each
+// failed login for a username or client IP locks it out for twice as long as
+// the last, up to MaxDelay. Locked out logins get 429 Too Many Requests with a
+// Retry-After header. A successful login clears the username's failures.
+type LoginThrottle struct {
+	Store LimiterStore // Defaults to a MemoryLimiterStore
+
+	UsernameFreeAttempts int           // Failures allowed per username before lockout. Defaults to 5.
+	IPFreeAttempts       int           // Failures allowed per client IP before lockout. Defaults to 20.
+	BaseDelay            time.Duration // First lockout. Defaults to 1 second.
+	MaxDelay             time.Duration // Longest lockout. Defaults to 15 minutes.
+	ResetAfter           time.Duration // Failures are forgotten after this long. Defaults to 1 hour.
+
+	// UsernameField is the login body key holding the username. Defaults to "name".
+	UsernameField string
+
+	// OnLockout is called whenever a username or IP is locked out.
+	OnLockout func(event LockoutEvent)
+
+	once sync.Once
+}
+
+// init sets defaults.
+func (t *LoginThrottle) init() {
+	t.once.Do(func() {
+		if t.Store == nil {
+			t.Store = NewMemoryLimiterStore()
+		}
+		if t.UsernameFreeAttempts == 0 {
+			t.UsernameFreeAttempts = 5
+		}
+		if t.IPFreeAttempts == 0 {
+			t.IPFreeAttempts = 20
+		}
+		if t.BaseDelay == 0 {
+			t.BaseDelay = time.Second
+		}
+		if t.MaxDelay == 0 {
+			t.MaxDelay = 15 * time.Minute
+		}
+		if t.ResetAfter == 0 {
+			t.ResetAfter = time.Hour
+		}
+		if t.UsernameField == "" {
+			t.UsernameField = "name"
+		}
+	})
+}
+
+func usernameKey(username string) string { return "user:" + username }
+func ipKey(ip string) string             { return "ip:" + ip }
+
+// get returns the entry for key, forgetting it if it is stale.
+func (t *LoginThrottle) get(key string) LimiterEntry {
+	entry, err := t.Store.Get(key)
+	if err != nil {
+		log.WithFields(log.Fields{"key": key, "error": err}).Error("LoginThrottle: can't read store")
+		return LimiterEntry{}
+	}
+	if entry.Failures > 0 && time.Since(entry.LastFailure) > t.ResetAfter {
+		return LimiterEntry{}
+	}
+	return entry
+}
+
+// retryAfter returns how long the login must wait, or 0 if it may proceed.
+func (t *LoginThrottle) retryAfter(username string, ip string) time.Duration {
+	t.init()
+	wait := time.Duration(0)
+	for _, key := range []string{usernameKey(username), ipKey(ip)} {
+		if d := time.Until(t.get(key).LockedUntil); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// delay returns the lockout after failures, given free attempts.
+func (t *LoginThrottle) delay(failures int, free int) time.Duration {
+	if failures < free {
+		return 0
+	}
+	exp := float64(failures - free)
+	d := time.Duration(float64(t.BaseDelay) * math.Pow(2, exp))
+	if d > t.MaxDelay || d <= 0 {
+		return t.MaxDelay
+	}
+	return d
+}
+
+// recordFailure records a failed login for username and ip.
+func (t *LoginThrottle) recordFailure(username string, ip string) {
+	t.init()
+	now := time.Now()
+	for _, k := range []struct {
+		key  string
+		free int
+	}{{usernameKey(username), t.UsernameFreeAttempts}, {ipKey(ip), t.IPFreeAttempts}} {
+		entry := t.get(k.key)
+		entry.Failures++
+		entry.LastFailure = now
+		if d := t.delay(entry.Failures, k.free); d > 0 {
+			entry.LockedUntil = now.Add(d)
+			event := LockoutEvent{Username: username, IP: ip, Key: k.key, Failures: entry.Failures, Until: entry.LockedUntil}
+			log.WithFields(log.Fields{"key": k.key, "failures": entry.Failures, "until": entry.LockedUntil}).Warn("Login locked out")
+			if t.OnLockout != nil {
+				t.OnLockout(event)
+			}
+		}
+		if err := t.Store.Set(k.key, entry); err != nil {
+			log.WithFields(log.Fields{"key": k.key, "error": err}).Error("LoginThrottle: can't write store")
+		}
+	}
+}
+
+// recordSuccess clears the failures for username.
+func (t *LoginThrottle) recordSuccess(username string) {
+	t.init()
+	t.Unlock(username, "")
+}
+
+// Unlock clears the failures and any lockout for username and/or ip. Pass ""
+// to leave one alone.
+func (t *LoginThrottle) Unlock(username string, ip string) error {
+	t.init()
+	if username != "" {
+		if err := t.Store.Delete(usernameKey(username)); err != nil {
+			return err
+		}
+	}
+	if ip != "" {
+		return t.Store.Delete(ipKey(ip))
+	}
+	return nil
+}
+
+// throttled checks whether a login may proceed. If not it writes a 429
+// response and returns true.
+func (t *LoginThrottle) throttled(w http.ResponseWriter, username string, ip string) bool {
+	wait := t.retryAfter(username, ip)
+	if wait <= 0 {
+		return false
+	}
+	seconds := int(math.Ceil(wait.Seconds()))
+	log.WithFields(log.Fields{"username": username, "ip": ip, "retry_after": seconds}).Warn("Login throttled")
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(429)
+	w.Write([]byte(fmt.Sprintf(`{"error":"Too many failed logins. Retry after %d seconds"}`, seconds)))
+	return true
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestLoginThrottle(t *testing.T) {
+	lockouts := []LockoutEvent{}
+	throttle := &LoginThrottle{UsernameFreeAttempts: 3, IPFreeAttempts: 5, BaseDelay: time.Minute,
+		OnLockout: func(e LockoutEvent) { lockouts = append(lockouts, e) }}
+	a := New(Options{JwtKey: "RandomString", Db: getTestDb(), Martini: getSilentMartini(), LoginThrottle: throttle})
+	a.SetAuth(&User{}, "/auth")
+
+	wrong := `{"name": "admin", "password": "wrongpassword"}`
+	right := `{"name": "admin", "password": "password"}`
+	for i := 0; i < 3; i++ {
+		testApiReq(t, a, "Throttle(Free attempt)", "POST", "/auth", wrong, nil, 403)
+	}
+	rec := testApiReq(t, a, "Throttle(Locked out)", "POST", "/auth", right, nil, 429)
+	if rec.Header().Get("Retry-After") == "" {
+		t.Errorf("429 response has no Retry-After header")
+	}
+	if len(lockouts) != 1 || lockouts[0].Username != "admin" || lockouts[0].Key != "user:admin" {
+		t.Errorf("Lockout not reported correctly: %v", lockouts)
+	}
+
+	throttle.Unlock("admin", "")
+	testApiReq(t, a, "Throttle(Unlocked)", "POST", "/auth", right, nil, 200)
+
+	// Failures spread over usernames still lock out the client IP.
+	testApiReq(t, a, "Throttle(IP attempt)", "POST", "/auth", `{"name": "a", "password": "guess"}`, nil, 403)
+	testApiReq(t, a, "Throttle(IP attempt)", "POST", "/auth", `{"name": "b", "password": "guess"}`, nil, 403)
+	testApiReq(t, a, "Throttle(IP locked out)", "POST", "/auth", `{"name": "c", "password": "guess"}`, nil, 429)
+}
+
+// Basic credentials are throttled like logins.
+func TestLoginThrottleBasic(t *testing.T) {
+	throttle := &LoginThrottle{UsernameFreeAttempts: 2, BaseDelay: time.Minute}
+	a := New(Options{JwtKey: "RandomString", Db: getTestDb(), Martini: getSilentMartini(), LoginThrottle: throttle})
+	a.SetAuth(&User{}, "/auth")
+	a.AddIndexRoute(&Widget{}, RouteOptions{UriModelName: "throttled_basic_widgets", Authenticate: BasicStrategy("")})
+	defer throttle.Unlock("admin", "")
+
+	basic := func(password string) map[string]string {
+		return map[string]string{"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte("admin:"+password))}
+	}
+	testApiReq(t, a, "ThrottleBasic(Right)", "GET", "/api/throttled_basic_widgets", "", basic("password"), 200)
+	for i := 0; i < 2; i++ {
+		testApiReq(t, a, "ThrottleBasic(Wrong)", "GET", "/api/throttled_basic_widgets", "", basic("guess"), 401)
+	}
+	testApiReq(t, a, "ThrottleBasic(Locked out)", "GET", "/api/throttled_basic_widgets", "", basic("password"), 401)
+	testApiReq(t, a, "ThrottleBasic(Login locked out)", "POST", "/auth", `{"name": "admin", "password": "password"}`, nil, 429)
+}
+
+// Check the exponential backoff.
+func TestLoginThrottleDelay(t *testing.T) {
+	throttle := &LoginThrottle{BaseDelay: time.Second, MaxDelay: time.Minute}
+	throttle.init()
+	for failures, expected := range map[int]time.Duration{2: 0, 3: time.Second, 4: 2 * time.Second, 6: 8 * time.Second, 100: time.Minute} {
+		if d := throttle.delay(failures, 3); d != expected {
+			t.Errorf("Delay after %d failures should be %v, got %v", failures, expected, d)
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+var tsIdentifier = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*$`)
+
+// tsReserved are the words which can't name a parameter of the generated
+// functions: TypeScript's reserved words, and the generated parameters.
+var tsReserved = map[string]bool{
+	"break": true, "case": true, "catch": true, "class": true, "const": true, "continue": true,
+	"debugger": true, "default": true, "delete": true, "do": true, "else": true, "enum": true,
+	"export": true, "extends": true, "false": true, "finally": true, "for": true, "function": true,
+	"if": true, "import": true, "in": true, "instanceof": true, "new": true, "null": true,
+	"return": true, "super": true, "switch": true, "this": true, "throw": true, "true": true,
+	"try": true, "typeof": true, "var": true, "void": true, "while": true, "with": true,
+	"id": true, "query": true, "item": true, "fields": true,
+}
+
+// tsArgName converts a snake_case name to a TypeScript parameter name, eg.
+// "user_id" gives "userID".
+func tsArgName(name string) string {
+	arg := unexport(goName(name))
+	if tsReserved[arg] {
+		arg += "Param"
+	}
+	return arg
+}
+
+// tsTypes writes TypeScript declarations for the types used by models.
+type tsTypes struct {
+	decls   map[string]string // Declarations of interfaces, by name
+	pending []reflect.Type
+}
+
+// typeName returns the TypeScript type for t, queueing any interfaces it
+// needs declared.
+func (g *tsTypes) typeName(t reflect.Type) string {
+	if t == timeType {
+		return "string"
+	}
+	pt := reflect.PtrTo(t)
+	if t.Kind() != reflect.Ptr && (pt.Implements(jsonMarshalerType) || pt.Implements(jsonUnmarshalerType)) {
+		return "unknown"
+	}
+	if t.Kind() != reflect.Ptr && (pt.Implements(textMarshalerType) || pt.Implements(textUnmarshalerType)) {
+		return "string"
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.typeName(t.Elem()) + " | null"
+	case reflect.Slice, reflect.Array:
+		if expected(t) == "string" {
+			return "string"
+		}
+		elem := g.typeName(t.Elem())
+		if strings.Contains(elem, "|") {
+			elem = "(" + elem + ")"
+		}
+		if t.Kind() == reflect.Slice {
+			return elem + "[] | null"
+		}
+		return elem + "[]"
+	case reflect.Map:
+		return "Record<string, " + g.typeName(t.Elem()) + "> | null"
+	case reflect.Interface:
+		return "unknown"
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.interfaceBody(t, false)
+		}
+		if _, ok := g.decls[t.Name()]; !ok {
+			g.decls[t.Name()] = "" // Placeholder for recursive types
+			g.pending = append(g.pending, t)
+		}
+		return t.Name()
+	case reflect.Bool:
+		return "boolean"
+	case reflect.String:
+		return "string"
+	}
+	if expected(t) == "integer" || expected(t) == "number" {
+		return "number"
+	}
+	return "unknown"
+}
+
+// tsProperty returns the name of a property, quoted if needed.
+func tsProperty(name string) string {
+	if tsIdentifier.MatchString(name) {
+		return name
+	}
+	return fmt.Sprintf("%q", name)
+}
+
+// interfaceBody returns an object type with the fields of t. Fields which
+// the server may leave out (omitempty) are optional, and fields set by the
+// server are readonly. If input is set it is instead the type of a body
+// sent to the server: read only fields are left out, and only required
+// fields (see applyAPITag) aren't optional.
+func (g *tsTypes) interfaceBody(t reflect.Type, input bool) string {
+	var b bytes.Buffer
+	b.WriteString("{\n")
+	for _, f := range jsonFields(t) {
+		s := map[string]interface{}{}
+		required := applyAPITag(f, s)
+		readOnly := readOnlyField(f) || s["readOnly"] == true
+		optional := strings.Contains(f.Tag.Get("json"), ",omitempty")
+		typ := g.typeName(f.Type)
+		if strings.Contains(f.Tag.Get("json"), ",string") {
+			typ = "string"
+		}
+		prefix := ""
+		if input {
+			if readOnly {
+				continue
+			}
+			optional = !required
+		} else if readOnly {
+			prefix = "readonly "
+		}
+		mark := ""
+		if optional {
+			mark = "?"
+		}
+		fmt.Fprintf(&b, "  %s%s%s: %s;\n", prefix, tsProperty(jsonName(f)), mark, typ)
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+// declare declares every queued interface.
+func (g *tsTypes) declare() {
+	for len(g.pending) > 0 {
+		t := g.pending[0]
+		g.pending = g.pending[1:]
+		g.decls[t.Name()] = fmt.Sprintf("/** %s mirrors the server's %s type. */\nexport interface %s %s",
+			t.Name(), t.String(), t.Name(), g.interfaceBody(t, false))
+	}
+}
+
+// tsService is a clientService as the TypeScript client template uses it.
+type tsService struct {
+	Name    string // Property of the client, eg. "widgets"
+	Path    string
+	Model   string
+	Input   string // Type of the body of a create or patch, eg. "WidgetInput"
+	IDType  string
+	Params  string // Parameters for the path, eg. "userID: string, "
+	PathExp string // Template literal for the path, eg. "`/api/users/${enc(userID)}/widgets`"
+	Actions map[string]bool
+}
+
+// tsPathExpression returns a template literal building path from its parameters.
+func tsPathExpression(path string) string {
+	parts := strings.Split(path, "/")
+	for i, segment := range parts {
+		if strings.HasPrefix(segment, ":") {
+			parts[i] = "${enc(" + tsArgName(segment[1:]) + ")}"
+		}
+	}
+	return "`" + strings.Join(parts, "/") + "`"
+}
+
+// TypeScript implements API interface for TypeScript().
+func (api *apiServer) TypeScript() ([]byte, []byte) {
+	types := &tsTypes{decls: map[string]string{}}
+	services := []*tsService{}
+	inputs := map[string]string{}
+	for _, cs := range api.clientServices() {
+		s := &tsService{Name: unexport(cs.Name), Path: cs.Path, Model: types.typeName(cs.Model), IDType: "string",
+			PathExp: tsPathExpression(cs.Path), Actions: cs.Actions}
+		if cs.IDType != nil && types.typeName(cs.IDType) == "number" {
+			s.IDType = "number"
+		}
+		for _, p := range cs.Params {
+			s.Params += tsArgName(p) + ": string, "
+		}
+		if cs.Actions[ACTION_CREATE] || cs.Actions[ACTION_UPDATE] {
+			s.Input = s.Model + "Input"
+			inputs[s.Input] = fmt.Sprintf("/** %s is the body sent to create a %s, or with its fields optional to change one. */\nexport interface %s %s",
+				s.Input, s.Model, s.Input, types.interfaceBody(cs.Model, true))
+		}
+		services = append(services, s)
+	}
+	types.declare()
+
+	decls := []string{}
+	for _, d := range types.decls {
+		decls = append(decls, d)
+	}
+	for _, d := range inputs {
+		decls = append(decls, d)
+	}
+	sort.Strings(decls)
+	// The client only imports the types it uses.
+	used := map[string]bool{}
+	for _, s := range services {
+		used[s.Model] = true
+		if s.Input != "" {
+			used[s.Input] = true
+		}
+	}
+	names := []string{}
+	for name := range used {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var declarations, client bytes.Buffer
+	declarations.WriteString("// Code generated by go-martini-api. DO NOT EDIT.\n")
+	for _, d := range decls {
+		declarations.WriteString("\n" + d + "\n")
+	}
+	tsClientTemplate.Execute(&client, map[string]interface{}{
+		"Types":        names,
+		"Services":     services,
+		"LoginPath":    api.loginPath,
+		"APIKeyHeader": api.apiKeyHeader(),
+	})
+	return declarations.Bytes(), client.Bytes()
+}
+
+var tsClientTemplate = template.Must(template.New("client").Parse(`// Code generated by go-martini-api. DO NOT EDIT.
+{{if .Types}}
+import type { {{range $i, $t := .Types}}{{if $i}}, {{end}}{{$t}}{{end}} } from "./models";
+{{end}}
+/** ApiError is thrown for responses with a status of 400 or more. */
+export class ApiError extends Error {
+  readonly status: number;
+  /** Problems with the request body, by field or JSON pointer. */
+  readonly errors?: Record<string, string>;
+  /** Seconds to wait before retrying, for a 429. */
+  readonly retryAfter?: number;
+
+  constructor(status: number, message: string, errors?: Record<string, string>, retryAfter?: number) {
+    super(message);
+    this.status = status;
+    this.errors = errors;
+    this.retryAfter = retryAfter;
+  }
+}
+
+/** Query parameters added to a list request. */
+export type Query = Record<string, string | number | boolean>;
+
+export interface ClientOptions {
+  /** Where the API is, eg. "https://example.com". Defaults to the page's origin. */
+  baseUrl?: string;
+  /** A token saved from an earlier login. */
+  token?: string | null;
+  /** Called when login, refresh or logout changes the token, eg. to save it. */
+  onToken?: (token: string | null) => void;
+  /** Sent in the {{.APIKeyHeader}} header if set. */
+  apiKey?: string;
+  fetch?: typeof fetch;
+}
+
+/** The body of a successful login. */
+export interface LoginResult {
+  token?: string;
+  /** Set for users with two factor authentication on. Pass mfa_token to verify(). */
+  mfa_required?: boolean;
+  mfa_token?: string;
+}
+
+const enc = (value: string | number) => encodeURIComponent(String(value));
+
+export class Client {
+  baseUrl: string;
+  token: string | null;
+  private options: ClientOptions;
+
+  constructor(options: ClientOptions = {}) {
+    this.options = options;
+    this.baseUrl = (options.baseUrl || "").replace(/\/$/, "");
+    this.token = options.token || null;
+  }
+
+  /** setToken sets the token sent as "Authorization: Bearer <token>". */
+  setToken(token: string | null) {
+    this.token = token;
+    if (this.options.onToken) {
+      this.options.onToken(token);
+    }
+  }
+
+  /** request makes a request, returning the decoded JSON response. */
+  async request<T>(method: string, path: string, body?: unknown, query?: Query): Promise<T> {
+    let url = this.baseUrl + path;
+    if (query) {
+      const params = new URLSearchParams();
+      for (const k of Object.keys(query)) {
+        params.append(k, String(query[k]));
+      }
+      url += "?" + params.toString();
+    }
+    const headers: Record<string, string> = { Accept: "application/json" };
+    if (body !== undefined) {
+      headers["Content-Type"] = "application/json";
+    }
+    if (this.token) {
+      headers["Authorization"] = "Bearer " + this.token;
+    }
+    if (this.options.apiKey) {
+      headers[{{printf "%q" .APIKeyHeader}}] = this.options.apiKey;
+    }
+    const doFetch = this.options.fetch || fetch;
+    const response = await doFetch(url, {
+      method,
+      headers,
+      body: body === undefined ? undefined : JSON.stringify(body),
+    });
+    const text = await response.text();
+    if (!response.ok) {
+      let message = text;
+      let errors: Record<string, string> | undefined;
+      try {
+        const decoded = JSON.parse(text);
+        message = decoded.error || message;
+        errors = decoded.errors;
+      } catch (e) {
+        // Not JSON, eg. "Unauthorized"
+      }
+      const retryAfter = Number(response.headers.get("Retry-After")) || undefined;
+      throw new ApiError(response.status, message || response.statusText, errors, retryAfter);
+    }
+    return (text ? JSON.parse(text) : undefined) as T;
+  }
+{{if .LoginPath}}
+  /** login logs in with details, eg. {name, password}, keeping the token for later requests. */
+  async login(details: Record<string, unknown>): Promise<LoginResult> {
+    const result = await this.request<LoginResult>("POST", {{printf "%q" .LoginPath}}, details);
+    if (result.token) {
+      this.setToken(result.token);
+    }
+    return result;
+  }
+
+  /** verify finishes logging in a user with two factor authentication on. */
+  async verify(mfaToken: string, code: string): Promise<void> {
+    const result = await this.request<LoginResult>("POST", {{printf "%q" (print .LoginPath "/verify")}}, { mfa_token: mfaToken, code });
+    this.setToken(result.token || null);
+  }
+
+  /** refresh replaces the token with a new one, before it expires. */
+  async refresh(): Promise<void> {
+    const result = await this.request<LoginResult>("POST", {{printf "%q" (print .LoginPath "/refresh")}});
+    this.setToken(result.token || null);
+  }
+
+  /** logout forgets the token. */
+  logout() {
+    this.setToken(null);
+  }
+{{end}}{{range .Services}}
+  /** The routes at {{.Path}}. */
+  readonly {{.Name}} = {
+{{- if .Actions.index}}
+    list: ({{.Params}}query?: Query) => this.request<{{.Model}}[]>("GET", {{.PathExp}}, undefined, query),
+{{- end}}{{if .Actions.get}}
+    get: ({{.Params}}id: {{.IDType}}) => this.request<{{.Model}}>("GET", {{.PathExp}} + "/" + enc(id)),
+{{- end}}{{if .Actions.create}}
+    create: ({{.Params}}item: {{.Input}}) => this.request<{{.Model}}>("POST", {{.PathExp}}, item),
+{{- end}}{{if .Actions.update}}
+    patch: ({{.Params}}id: {{.IDType}}, fields: Partial<{{.Input}}>) => this.request<{{.Model}}>("PATCH", {{.PathExp}} + "/" + enc(id), fields),
+{{- end}}{{if .Actions.delete}}
+    delete: ({{.Params}}id: {{.IDType}}) => this.request<{{.Model}}>("DELETE", {{.PathExp}} + "/" + enc(id)),
+{{- end}}
+  };
+{{end}}}
+`))
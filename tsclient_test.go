@@ -0,0 +1,50 @@
+package api
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTypeScript(t *testing.T) {
+	widget := reflect.TypeOf(SchemaWidget{})
+	part := reflect.TypeOf(ClientWidget{})
+	a := &apiServer{options: &Options{}, loginPath: "/auth", routes: []*route{
+		{method: "GET", path: "/api/schema_widgets", action: ACTION_INDEX, model: widget},
+		{method: "GET", path: "/api/schema_widgets/:id", action: ACTION_GET, model: widget},
+		{method: "POST", path: "/api/schema_widgets", action: ACTION_CREATE, model: widget},
+		{method: "PATCH", path: "/api/schema_widgets/:id", action: ACTION_UPDATE, model: widget},
+		{method: "DELETE", path: "/api/schema_widgets/:id", action: ACTION_DELETE, model: widget},
+		{method: "GET", path: "/api/users/:user_id/client_widgets", action: ACTION_INDEX, model: part},
+	}}
+	declarations, client := a.TypeScript()
+
+	for _, expected := range []string{
+		"export interface SchemaWidget {\n  readonly id: number;\n  name: string;\n  colour: string;\n",
+		"  readonly code: string;\n  tags: string[] | null;\n  children: (SchemaWidget | null)[] | null;\n}",
+		"export interface SchemaWidgetInput {\n  name: string;\n  colour?: string;\n",
+		"export interface ClientWidget {\n  readonly id: number;\n  name: string;\n  parts: ClientPart[] | null;\n" +
+			"  labels?: Record<string, string> | null;\n  parent: ClientWidget | null;\n  readonly updated_at: string;\n}",
+		"export interface ClientPart {\n  name: string;\n}",
+	} {
+		if !strings.Contains(string(declarations), expected) {
+			t.Errorf("Declarations should contain:\n%s\ngot:\n%s", expected, declarations)
+		}
+	}
+	if strings.Contains(string(declarations), "SchemaWidgetInput {\n  id") {
+		t.Errorf("Inputs shouldn't have read only fields:\n%s", declarations)
+	}
+
+	for _, expected := range []string{
+		`import type { ClientWidget, SchemaWidget, SchemaWidgetInput } from "./models";`,
+		"list: (query?: Query) => this.request<SchemaWidget[]>(\"GET\", `/api/schema_widgets`, undefined, query),",
+		"patch: (id: number, fields: Partial<SchemaWidgetInput>) => this.request<SchemaWidget>(\"PATCH\", `/api/schema_widgets` + \"/\" + enc(id), fields),",
+		"readonly usersClientWidgets = {",
+		"list: (userID: string, query?: Query) => this.request<ClientWidget[]>(\"GET\", `/api/users/${enc(userID)}/client_widgets`, undefined, query),",
+		`const result = await this.request<LoginResult>("POST", "/auth/refresh");`,
+	} {
+		if !strings.Contains(string(client), expected) {
+			t.Errorf("Client should contain:\n%s\ngot:\n%s", expected, client)
+		}
+	}
+}
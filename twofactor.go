@@ -0,0 +1,417 @@
+package api
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-martini/martini"
+)
+
+// TwoFactorModel is implemented by users returned by LoginModel.GetById who
+// can turn on two factor authentication. Once TwoFactorSecret returns a
+// secret, logging in at the SetAuth route returns a short lived mfa_token
+// instead of a token. POST it to <login path>/verify with a TOTP code (or a
+// recovery code) to get the real token.
+type TwoFactorModel interface {
+	// TwoFactorSecret returns the user's base32 TOTP secret, or "" if two
+	// factor authentication is off.
+	TwoFactorSecret() string
+	// EnableTwoFactor stores secret and the sha256 hashes of the user's
+	// single use recovery codes, replacing any old ones.
+	EnableTwoFactor(secret string, recoveryCodeHashes []string) error
+	// UseRecoveryCode removes codeHash from the user's recovery codes,
+	// returning false if it wasn't there.
+	UseRecoveryCode(codeHash string) (bool, error)
+}
+
+const (
+	totpPeriod        = 30
+	totpDigits        = 6
+	totpSkew          = 1 // Steps either side of now to accept, for clock drift.
+	recoveryCodeCount = 10
+
+	mfaPending = "pending"
+	mfaEnroll  = "enroll"
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTOTPSecret returns a random 160 bit secret, base32 encoded.
+func newTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// totpCode returns the RFC 6238 code for secret at time step counter.
+func totpCode(secret string, counter int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.Replace(strings.TrimRight(secret, "="), " ", "", -1)))
+	if err != nil {
+		return "", err
+	}
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000), nil
+}
+
+// totpStep returns the time step containing t.
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// verifyTOTP returns the time step matching code, or false if it doesn't
+// match any step within totpSkew of now.
+func verifyTOTP(secret string, code string, now time.Time) (int64, bool) {
+	code = strings.Replace(code, " ", "", -1)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	step := totpStep(now)
+	for i := int64(-totpSkew); i <= totpSkew; i++ {
+		expected, err := totpCode(secret, step+i)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step + i, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI returns the otpauth URI for authenticator apps to scan.
+func totpURI(issuer string, account string, secret string) string {
+	return fmt.Sprintf("otpauth://totp/%s:%s?secret=%s&issuer=%s&algorithm=SHA1&digits=%d&period=%d",
+		url.PathEscape(issuer), url.PathEscape(account), secret, url.QueryEscape(issuer), totpDigits, totpPeriod)
+}
+
+// newRecoveryCodes returns recoveryCodeCount random codes, and their hashes.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := hex.EncodeToString(b)
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashRecoveryCode(code)
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode returns the hash stored for a recovery code, ignoring
+// case and dashes.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.Replace(strings.Replace(code, "-", "", -1), " ", "", -1))
+	return hashAPIKey(code)
+}
+
+// totpReplay remembers the last time step used by each user, so a TOTP code
+// can't be used twice. It is per server.
+type totpReplay struct {
+	mutex sync.Mutex
+	used  map[uint]int64
+}
+
+// use records step for id, returning false if it, or a later step, was
+// already used.
+func (t *totpReplay) use(id uint, step int64) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.used == nil {
+		t.used = make(map[uint]int64)
+	}
+	if last, ok := t.used[id]; ok && step <= last {
+		return false
+	}
+	t.used[id] = step
+	return true
+}
+
+// twoFactorUser returns the user with id if they have two factor
+// authentication turned on.
+func (api *apiServer) twoFactorUser(id uint) (TwoFactorModel, bool) {
+	user, err := api.loginModelById(id)
+	if err != nil {
+		return nil, false
+	}
+	tf, ok := user.(TwoFactorModel)
+	if !ok || tf.TwoFactorSecret() == "" {
+		return nil, false
+	}
+	return tf, true
+}
+
+// twoFactorIssuer returns the issuer shown by authenticator apps.
+func (api *apiServer) twoFactorIssuer() string {
+	if api.options.TwoFactorIssuer == "" {
+		return "api"
+	}
+	return api.options.TwoFactorIssuer
+}
+
+// parseMFAToken returns the claims of a valid mfa_token or enroll_token of
+// kind.
+func (api *apiServer) parseMFAToken(tokenString string, kind string) (map[string]interface{}, error) {
+	token, err := jwt.Parse(tokenString, api.jwtKeyFunc)
+	if err != nil || token == nil || !token.Valid {
+		return nil, fmt.Errorf("Invalid or expired token")
+	}
+	if token.Claims["mfa"] != kind {
+		return nil, fmt.Errorf("Wrong kind of token")
+	}
+	if _, ok := token.Claims["id"].(float64); !ok {
+		return nil, fmt.Errorf("JWT token has no id")
+	}
+	return token.Claims, nil
+}
+
+// writeJSONError writes {"error": message} with code.
+func writeJSONError(w http.ResponseWriter, code int, message string) {
+	j, _ := json.Marshal(map[string]string{"error": message})
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	w.Write(j)
+}
+
+// enrollCipher returns the cipher sealing the secrets in enroll tokens. Its
+// key is derived from the JwtKey, so any server sharing it can open them.
+func (api *apiServer) enrollCipher() (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte("enroll_token:" + api.options.JwtKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealTOTPSecret encrypts the pending secret of user id for an enroll_token,
+// as the claims of a token can be read by anybody who has it.
+func (api *apiServer) sealTOTPSecret(secret string, id uint) (string, error) {
+	aead, err := api.enrollCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(secret), []byte(fmt.Sprint(id)))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// openTOTPSecret returns the secret sealed by sealTOTPSecret for user id.
+func (api *apiServer) openTOTPSecret(sealed string, id uint) (string, error) {
+	aead, err := api.enrollCipher()
+	if err != nil {
+		return "", err
+	}
+	b, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil || len(b) < aead.NonceSize() {
+		return "", fmt.Errorf("Malformed secret")
+	}
+	secret, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], []byte(fmt.Sprint(id)))
+	return string(secret), err
+}
+
+// getVerifyHandler returns the handler for <login path>/verify, which swaps
+// an mfa_token and a code or recovery_code for a token. Failures are
+// throttled like logins by Options.LoginThrottle, or by a default
+// LoginThrottle if it isn't set.
+func (api *apiServer) getVerifyHandler() func(*JsonBody, http.ResponseWriter, *http.Request) []byte {
+	throttle := api.mfaThrottle
+	return func(j *JsonBody, w http.ResponseWriter, r *http.Request) []byte {
+		msi := map[string]interface{}(*j)
+		tokenString, _ := msi["mfa_token"].(string)
+		claims, err := api.parseMFAToken(tokenString, mfaPending)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Warn("Two factor verify failed")
+			writeJSONError(w, 401, err.Error())
+			return nil
+		}
+		id := uint(claims["id"].(float64))
+		username, ip := fmt.Sprintf("mfa:%d", id), clientIP(r)
+		if throttle.throttled(w, username, ip) {
+			return nil
+		}
+		user, ok := api.twoFactorUser(id)
+		if !ok {
+			writeJSONError(w, 401, "Two factor authentication is not enabled")
+			return nil
+		}
+		verified := false
+		if code, _ := msi["code"].(string); code != "" {
+			step, ok := verifyTOTP(user.TwoFactorSecret(), code, time.Now())
+			verified = ok && api.totpReplay.use(id, step)
+		} else if code, _ := msi["recovery_code"].(string); code != "" {
+			verified, err = user.UseRecoveryCode(hashRecoveryCode(code))
+			if err != nil {
+				log.WithFields(log.Fields{"error": err}).Error("Can't use recovery code")
+				writeJSONError(w, 500, "Can't use recovery code")
+				return nil
+			}
+		}
+		if !verified {
+			log.WithFields(log.Fields{"id": id}).Warn("Two factor code failed")
+			throttle.recordFailure(username, ip)
+			writeJSONError(w, 403, "Two factor code failed")
+			return nil
+		}
+		throttle.recordSuccess(username)
+		token := api.GetJWTToken(id)
+		if api.options.SessionCookie != "" {
+			api.setSessionCookie(w, token)
+		}
+		return []byte("{\"token\":\"" + token + "\"}")
+	}
+}
+
+// AddTwoFactorRoutes implements API interface for AddTwoFactorRoutes()
+func (api *apiServer) AddTwoFactorRoutes(path string, options ...RouteOptions) {
+	routeOptions := withScopes(applyPolicy(nil, ACTION_CREATE, getOptions(options, ROUTE_WRITE)), "two_factor:write")
+	if routeOptions.Authenticate == nil {
+		routeOptions.Authenticate = true
+	}
+	log.WithFields(log.Fields{"path": path}).Info("Adding two factor routes")
+
+	// currentUser returns the logged in TwoFactorModel and their id, or
+	// writes an error.
+	currentUser := func(w http.ResponseWriter, c martini.Context) (TwoFactorModel, uint, bool) {
+		user := ownershipUser(w, c)
+		if user == nil {
+			return nil, 0, false
+		}
+		tf, ok := user.(TwoFactorModel)
+		if !ok {
+			log.WithFields(log.Fields{"type": fmt.Sprintf("%T", user)}).Error("LoginModel doesn't implement TwoFactorModel")
+			writeJSONError(w, 500, "Two factor authentication is not supported")
+			return nil, 0, false
+		}
+		id, ok := userID(user)
+		if !ok {
+			writeNoUserID(w, user)
+			return nil, 0, false
+		}
+		return tf, id, true
+	}
+
+	api.addRoute("POST", path+"/enroll", "", nil, routeOptions, api.handlerList(
+		api.bindRequestHandler("POST", nil),
+		api.getAuthenticateHandler(routeOptions.Authenticate),
+		scopeHandler(routeOptions.RequiredScopes),
+		impersonationHandler(true),
+		api.tenantMemberStep(routeOptions),
+		requirementHandler(routeOptions.requirement),
+		routeOptions.Authorize,
+		func(req *Request, w http.ResponseWriter, c martini.Context) {
+			user, id, ok := currentUser(w, c)
+			if !ok {
+				return
+			}
+			if user.TwoFactorSecret() != "" {
+				writeJSONError(w, 409, "Two factor authentication is already enabled")
+				return
+			}
+			secret, err := newTOTPSecret()
+			if err != nil {
+				writeJSONError(w, 500, "Can't create secret")
+				return
+			}
+			account := fmt.Sprint(id)
+			if s, ok := user.(fmt.Stringer); ok {
+				account = s.String()
+			}
+			sealed, err := api.sealTOTPSecret(secret, id)
+			if err != nil {
+				log.WithFields(log.Fields{"error": err}).Error("Can't seal two factor secret")
+				writeJSONError(w, 500, "Can't create secret")
+				return
+			}
+			enrollToken := api.signToken(map[string]interface{}{"id": id, "mfa": mfaEnroll, "sealed_secret": sealed}, 10*time.Minute)
+			req.Result = map[string]string{
+				"secret":       secret,
+				"otpauth_uri":  totpURI(api.twoFactorIssuer(), account, secret),
+				"enroll_token": enrollToken,
+			}
+		},
+		sendResult))
+
+	api.addRoute("POST", path+"/confirm", "", nil, routeOptions, api.handlerList(
+		api.bindRequestHandler("POST", nil),
+		api.getAuthenticateHandler(routeOptions.Authenticate),
+		scopeHandler(routeOptions.RequiredScopes),
+		impersonationHandler(true),
+		api.tenantMemberStep(routeOptions),
+		requirementHandler(routeOptions.requirement),
+		routeOptions.Authorize,
+		ParseJsonBody,
+		func(j *JsonBody, req *Request, w http.ResponseWriter, r *http.Request, c martini.Context) {
+			user, id, ok := currentUser(w, c)
+			if !ok {
+				return
+			}
+			username, ip := fmt.Sprintf("mfa:%d", id), clientIP(r)
+			if api.mfaThrottle.throttled(w, username, ip) {
+				return
+			}
+			tokenString, _ := (*j)["enroll_token"].(string)
+			claims, err := api.parseMFAToken(tokenString, mfaEnroll)
+			if err != nil || uint(claims["id"].(float64)) != id {
+				writeJSONError(w, 403, "Invalid or expired enroll_token")
+				return
+			}
+			sealed, _ := claims["sealed_secret"].(string)
+			secret, err := api.openTOTPSecret(sealed, id)
+			if err != nil {
+				writeJSONError(w, 403, "Invalid or expired enroll_token")
+				return
+			}
+			code, _ := (*j)["code"].(string)
+			step, ok := verifyTOTP(secret, code, time.Now())
+			if !ok || !api.totpReplay.use(id, step) {
+				api.mfaThrottle.recordFailure(username, ip)
+				writeJSONError(w, 403, "Two factor code failed")
+				return
+			}
+			api.mfaThrottle.recordSuccess(username)
+			codes, hashes, err := newRecoveryCodes()
+			if err == nil {
+				err = user.EnableTwoFactor(secret, hashes)
+			}
+			if err != nil {
+				log.WithFields(log.Fields{"error": err}).Error("Can't enable two factor authentication")
+				writeJSONError(w, 500, "Can't enable two factor authentication")
+				return
+			}
+			log.WithFields(log.Fields{"id": id}).Info("Two factor authentication enabled")
+			req.Result = map[string][]string{"recovery_codes": codes}
+		},
+		sendResult))
+}
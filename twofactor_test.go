@@ -0,0 +1,152 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type MFAUser struct {
+	ID            uint   `gorm:"primary_key" json:"id"`
+	Name          string `json:"name"`
+	Password      string `json:"-"`
+	TOTPSecret    string `json:"-"`
+	RecoveryCodes string `json:"-"`
+}
+
+func (_ *MFAUser) CheckLoginDetails(j *map[string]interface{}) (uint, error) {
+	user := MFAUser{}
+	if getTestDb().Where("name = ? AND password = ?", (*j)["name"], (*j)["password"]).Find(&user).RecordNotFound() {
+		return 0, errors.New("Not authenticated")
+	}
+	return user.ID, nil
+}
+
+func (_ *MFAUser) GetById(id uint) (interface{}, error) {
+	user := MFAUser{}
+	if getTestDb().Where("id = ?", id).Find(&user).RecordNotFound() {
+		return &user, errors.New("User not found")
+	}
+	return &user, nil
+}
+
+func (u *MFAUser) TwoFactorSecret() string { return u.TOTPSecret }
+
+func (u *MFAUser) EnableTwoFactor(secret string, recoveryCodeHashes []string) error {
+	u.TOTPSecret = secret
+	u.RecoveryCodes = strings.Join(recoveryCodeHashes, ",")
+	return getTestDb().Save(u).Error
+}
+
+func (u *MFAUser) UseRecoveryCode(codeHash string) (bool, error) {
+	codes := strings.Split(u.RecoveryCodes, ",")
+	for i, c := range codes {
+		if c == codeHash {
+			u.RecoveryCodes = strings.Join(append(codes[:i], codes[i+1:]...), ",")
+			return true, getTestDb().Save(u).Error
+		}
+	}
+	return false, nil
+}
+
+// Check codes against the SHA1 test vectors from RFC 6238.
+func TestTOTPCode(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	for unix, expected := range map[int64]string{59: "287082", 1111111109: "081804", 1234567890: "005924", 2000000000: "279037"} {
+		if code, err := totpCode(secret, totpStep(time.Unix(unix, 0))); err != nil || code != expected {
+			t.Errorf("TOTP at %d: expected %s, got %s (%v)", unix, expected, code, err)
+		}
+	}
+	code, _ := totpCode(secret, totpStep(time.Unix(59, 0)))
+	if _, ok := verifyTOTP(secret, code, time.Unix(59+totpPeriod, 0)); !ok {
+		t.Errorf("TOTP code from the previous step wasn't accepted")
+	}
+	if _, ok := verifyTOTP(secret, code, time.Unix(59+3*totpPeriod, 0)); ok {
+		t.Errorf("Stale TOTP code was accepted")
+	}
+}
+
+// Secrets sealed for one user can't be opened for another.
+func TestSealTOTPSecret(t *testing.T) {
+	api := &apiServer{options: &Options{JwtKey: "RandomString"}}
+	sealed, err := api.sealTOTPSecret("JBSWY3DPEHPK3PXP", 1)
+	if err != nil || strings.Contains(sealed, "JBSWY3DPEHPK3PXP") {
+		t.Fatalf("Bad sealed secret %q: %v", sealed, err)
+	}
+	if secret, err := api.openTOTPSecret(sealed, 1); err != nil || secret != "JBSWY3DPEHPK3PXP" {
+		t.Errorf("Opened %q: %v", secret, err)
+	}
+	if _, err := api.openTOTPSecret(sealed, 2); err == nil {
+		t.Errorf("Secret sealed for user 1 was opened for user 2")
+	}
+	if _, err := api.openTOTPSecret("nonsense", 1); err == nil {
+		t.Errorf("Opened a nonsense secret")
+	}
+}
+
+func TestTwoFactor(t *testing.T) {
+	db := getTestDb()
+	db.DropTable(&MFAUser{})
+	db.CreateTable(&MFAUser{})
+	user := MFAUser{Name: "mfa", Password: "pass"}
+	db.Create(&user)
+
+	a := New(Options{JwtKey: "RandomString", Db: db, Martini: getSilentMartini()})
+	a.SetAuth(&MFAUser{}, "/auth")
+	a.AddTwoFactorRoutes("/2fa")
+	a.AddDefaultRoutes(&Widget{}, RouteOptions{Authenticate: true})
+	a.AddIndexRoute(&Widget{}, RouteOptions{UriModelName: "mfa_basic_widgets", Authenticate: BasicStrategy("")})
+	login := `{"name":"mfa","password":"pass"}`
+	basic := map[string]string{"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte("mfa:pass"))}
+	testApiReq(t, a, "Basic(No 2FA)", "GET", "/api/mfa_basic_widgets", "", basic, 200)
+
+	// Before enrolling, logging in gives a token straight away.
+	body := testApiReq(t, a, "Login(No 2FA)", "POST", "/auth", login, nil, 200).Body.String()
+	tokenq := "?access_token=" + getToken(body)
+	testApiReq(t, a, "Enroll(No token)", "POST", "/2fa/enroll", "", nil, 401)
+	body = testApiReq(t, a, "Enroll", "POST", "/2fa/enroll"+tokenq, "", nil, 200).Body.String()
+	enrollment := map[string]string{}
+	json.Unmarshal([]byte(body), &enrollment)
+	secret := enrollment["secret"]
+	if !strings.HasPrefix(enrollment["otpauth_uri"], "otpauth://totp/api:") || !strings.Contains(enrollment["otpauth_uri"], "secret="+secret) {
+		t.Errorf("Bad otpauth_uri: %s", body)
+	}
+	claims, _ := base64.RawURLEncoding.DecodeString(strings.Split(enrollment["enroll_token"]+"..", ".")[1])
+	if len(claims) == 0 || strings.Contains(string(claims), secret) {
+		t.Errorf("enroll_token claims should hide the secret: %s", claims)
+	}
+	now := totpStep(time.Now())
+	code, _ := totpCode(secret, now)
+	testApiReq(t, a, "Confirm(Wrong code)", "POST", "/2fa/confirm"+tokenq, `{"enroll_token":"`+enrollment["enroll_token"]+`","code":"000000x"}`, nil, 403)
+	body = testApiReq(t, a, "Confirm", "POST", "/2fa/confirm"+tokenq, `{"enroll_token":"`+enrollment["enroll_token"]+`","code":"`+code+`"}`, nil, 200).Body.String()
+	recovery := map[string][]string{}
+	json.Unmarshal([]byte(body), &recovery)
+	if len(recovery["recovery_codes"]) != recoveryCodeCount {
+		t.Fatalf("Expected %d recovery codes: %s", recoveryCodeCount, body)
+	}
+	testApiReq(t, a, "Enroll(Already enabled)", "POST", "/2fa/enroll"+tokenq, "", nil, 409)
+	testApiReq(t, a, "Basic(2FA)", "GET", "/api/mfa_basic_widgets", "", basic, 401)
+
+	// Now logging in gives an mfa_token, which can't be used as a token.
+	pending := map[string]interface{}{}
+	body = testApiReq(t, a, "Login(2FA)", "POST", "/auth", login, nil, 200).Body.String()
+	json.Unmarshal([]byte(body), &pending)
+	mfaToken, _ := pending["mfa_token"].(string)
+	if pending["mfa_required"] != true || mfaToken == "" || pending["token"] != nil {
+		t.Fatalf("Expected an mfa_token: %s", body)
+	}
+	testApiReq(t, a, "Widgets(mfa_token)", "GET", "/api/widgets?access_token="+mfaToken, "", nil, 401)
+
+	testApiReq(t, a, "Verify(Bad mfa_token)", "POST", "/auth/verify", `{"mfa_token":"nonsense","code":"`+code+`"}`, nil, 401)
+	testApiReq(t, a, "Verify(Reused code)", "POST", "/auth/verify", `{"mfa_token":"`+mfaToken+`","code":"`+code+`"}`, nil, 403)
+	code, _ = totpCode(secret, now+1)
+	body = testApiReq(t, a, "Verify", "POST", "/auth/verify", `{"mfa_token":"`+mfaToken+`","code":"`+code+`"}`, nil, 200).Body.String()
+	testApiReq(t, a, "Widgets(Verified token)", "GET", "/api/widgets?access_token="+getToken(body), "", nil, 200)
+
+	recoveryCode := recovery["recovery_codes"][0]
+	testApiReq(t, a, "Verify(Recovery code)", "POST", "/auth/verify", `{"mfa_token":"`+mfaToken+`","recovery_code":"`+strings.ToUpper(recoveryCode)+`"}`, nil, 200)
+	testApiReq(t, a, "Verify(Used recovery code)", "POST", "/auth/verify", `{"mfa_token":"`+mfaToken+`","recovery_code":"`+recoveryCode+`"}`, nil, 403)
+}
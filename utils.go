@@ -2,9 +2,7 @@ package api
 
 import (
 	"fmt"
-	log "github.com/Sirupsen/logrus"
-	"io"
-	"io/ioutil"
+	"net"
 	"net/http"
 	"reflect"
 	"strings"
@@ -47,23 +45,27 @@ func pluralCamelNameType(typ reflect.Type) string {
 	return t3
 }
 
-// httpBody returns the uploaded http body. On io failure we just return
-// an empty array.
-func httpBody(r *http.Request) []byte {
-	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
-	if err != nil || r.Body.Close() != nil {
-		log.WithFields(log.Fields{"error": err}).Warn("Can't read request body")
-		return []byte("")
+// getID takes a structure pointer which should have a field called ID.
+// It returns that structures value, or an error if sp isn't a structure
+// pointer with an ID field.
+func getID(sp interface{}) (interface{}, error) {
+	pv := reflect.ValueOf(sp)
+	if pv.Kind() != reflect.Ptr || pv.IsNil() || pv.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("getID expected a structure pointer, got %T", sp)
+	}
+	id := pv.Elem().FieldByName("ID")
+	if !id.IsValid() {
+		return nil, fmt.Errorf("getID: %T has no ID field", sp)
 	}
-	return body
+	return id.Interface(), nil
 }
 
-// getID takes a structure pointer which should have a field called ID.
-// It returns that structures value.
-func getID(sp interface{}) (interface{}, error) {
-	sv := reflect.ValueOf(sp).Elem()
-	if sv.Kind() != reflect.Struct {
-		return nil, fmt.Errorf("getID expected a structure")
+// clientIP returns the IP address of the client making request r. Headers such
+// as X-Forwarded-For are ignored, as clients can set them to anything.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
 	}
-	return sv.FieldByName("ID").Interface(), nil
+	return host
 }
@@ -0,0 +1,576 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/inject"
+	"github.com/go-martini/martini"
+	"github.com/jinzhu/gorm"
+)
+
+// Webhooks POSTs the changes made by the default model routes to the URLs
+// subscribed with the routes added by AddWebhookRoutes. Set Options.Webhooks
+// to turn it on.
+//
+// Each delivery is the JSON of the created, updated or deleted item as the
+// model's GET route would send it, after its AfterReadHook and EditResult. It
+// is sent once the change is committed, with these headers:
+//
+//	X-Webhook-Event: created, updated or deleted
+//	X-Webhook-Model: the plural camel name of the model, eg. user_types
+//	X-Webhook-Delivery: the id of the WebhookDelivery
+//	X-Webhook-Signature: sha256=<hex HMAC-SHA256 of the body with the subscription's secret>
+//
+// Events only go to subscriptions in the request's tenant. If the model's GET
+// route has Ownership, its events only go to subscriptions made by the item's
+// owner, by an admin, or by a superuser.
+//
+// Deliveries which don't get a 2xx response are retried with exponential
+// backoff. Retries are only kept in memory: a delivery still pending when the
+// server stops stays pending in the webhook_deliveries table, and is never
+// retried.
+type Webhooks struct {
+	// Used to make deliveries. Defaults to a client with a 10 second timeout.
+	Client *http.Client
+	// Attempts made before a delivery fails. Defaults to 5.
+	MaxAttempts int
+	// Wait before the first retry, doubled for each retry after. Defaults to
+	// 1 second.
+	Backoff time.Duration
+	// Deliveries made at once. Defaults to 4.
+	Workers int
+}
+
+// The events sent by Webhooks.
+const (
+	WEBHOOK_CREATED = "created"
+	WEBHOOK_UPDATED = "updated"
+	WEBHOOK_DELETED = "deleted"
+)
+
+// webhookEvents maps each write action to its event.
+var webhookEvents = map[string]string{
+	ACTION_CREATE: WEBHOOK_CREATED,
+	ACTION_UPDATE: WEBHOOK_UPDATED,
+	ACTION_DELETE: WEBHOOK_DELETED,
+}
+
+// WebhookSignatureHeader holds the signature of a webhook delivery. See
+// VerifyWebhookSignature.
+const WebhookSignatureHeader = "X-Webhook-Signature"
+
+// WebhookSubscription is a URL which is sent the events it is interested in.
+// Subscriptions are stored in the webhook_subscriptions table.
+type WebhookSubscription struct {
+	ID        uint      `gorm:"primary_key" json:"id"`
+	URL       string    `json:"url"`
+	Model     string    `json:"model" sql:"index"`            // plural camel name of the model, or "" for all
+	Events    string    `json:"events"`                       // space separated list of events, or "" for all
+	Secret    string    `json:"-"`                            // signs deliveries. Returned once, when the subscription is created
+	Tenant    string    `json:"tenant,omitempty" sql:"index"` // only this tenant's events are sent, if Options.Tenancy is set
+	OwnerID   uint      `json:"owner_id" sql:"index"`         // the user who made it
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Matches returns true if the subscription wants event for model.
+func (s *WebhookSubscription) Matches(model string, event string) bool {
+	if s.Model != "" && s.Model != model {
+		return false
+	}
+	if s.Events == "" {
+		return true
+	}
+	for _, e := range strings.Fields(s.Events) {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery records the sending of an event to a subscription.
+// Deliveries are stored in the webhook_deliveries table.
+type WebhookDelivery struct {
+	ID             uint      `gorm:"primary_key" json:"id"`
+	SubscriptionID uint      `json:"subscription_id" sql:"index"`
+	Event          string    `json:"event"`
+	Model          string    `json:"model"`
+	ItemID         string    `json:"item_id"`
+	Payload        string    `json:"payload" sql:"type:text"`
+	State          string    `json:"state"` // One of the DELIVERY_ constants
+	Attempts       int       `json:"attempts"`
+	StatusCode     int       `json:"status_code"` // of the last attempt, or 0 if there was no response
+	Error          string    `json:"error"`       // of the last attempt
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// The states of a WebhookDelivery.
+const (
+	DELIVERY_PENDING   = "pending"
+	DELIVERY_DELIVERED = "delivered"
+	DELIVERY_FAILED    = "failed"
+)
+
+// webhookUpload is the body accepted when creating a subscription.
+type webhookUpload struct {
+	URL    string   `json:"url"`
+	Model  string   `json:"model"`
+	Events []string `json:"events"`
+}
+
+// webhookResult is returned when a subscription is created. It is the only
+// time the secret is available.
+type webhookResult struct {
+	WebhookSubscription
+	Secret string `json:"secret"`
+}
+
+// WebhookSignature returns the X-Webhook-Signature of body for secret.
+func WebhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhookSignature returns true if signature, from the
+// X-Webhook-Signature header, was made from body with secret. Receivers
+// should check it before trusting a delivery.
+func VerifyWebhookSignature(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(WebhookSignature(secret, body)), []byte(signature))
+}
+
+// webhookDispatcher sends deliveries in the background.
+type webhookDispatcher struct {
+	db      *gorm.DB
+	config  Webhooks
+	workers chan struct{}  // limits deliveries made at once
+	pending sync.WaitGroup // events being dispatched and deliveries not yet delivered or failed
+}
+
+// newWebhookDispatcher returns a dispatcher for config, with defaults filled in.
+func newWebhookDispatcher(db *gorm.DB, config Webhooks) *webhookDispatcher {
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 5
+	}
+	if config.Backoff <= 0 {
+		config.Backoff = time.Second
+	}
+	if config.Workers <= 0 {
+		config.Workers = 4
+	}
+	for _, table := range []interface{}{&WebhookSubscription{}, &WebhookDelivery{}} {
+		if err := db.AutoMigrate(table).Error; err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("Can't create webhook tables")
+		}
+	}
+	return &webhookDispatcher{db: db, config: config, workers: make(chan struct{}, config.Workers)}
+}
+
+// webhookScope limits the subscriptions an event is sent to.
+type webhookScope struct {
+	tenant string
+	// sees returns true if the subscription may be sent the item. nil if
+	// every subscription in the tenant may.
+	sees func(s *WebhookSubscription) bool
+}
+
+// emitWebhook sends the event for action on item, changed by req, to every
+// matching subscription. The payload is built at once, and the rest is done
+// in the background.
+func (api *apiServer) emitWebhook(req *Request, c martini.Context, action string, item interface{}) {
+	event, ok := webhookEvents[action]
+	if !ok {
+		return
+	}
+	payload, ok := api.webhookPayload(req, c, item)
+	if !ok {
+		return
+	}
+	id, _ := getID(item)
+	delivery := WebhookDelivery{Event: event, Model: pluralCamelName(item), ItemID: fmt.Sprint(id),
+		Payload: string(payload), State: DELIVERY_PENDING}
+	scope := webhookScope{tenant: req.Tenant}
+	if route := api.readRoute(reflect.TypeOf(item).Elem()); route != nil && route.options.Ownership != nil {
+		scope.sees = api.ownerSees(route.options.Ownership, item)
+	}
+	api.webhooks.emit(delivery, scope)
+}
+
+// ownerSees returns a function deciding whether the owner of a subscription
+// may see item, as the GET route's ownership would: admins and superusers see
+// every item, and other users only the items they own.
+func (api *apiServer) ownerSees(ownership *Ownership, item interface{}) func(s *WebhookSubscription) bool {
+	owner, owned := itemOwner(item)
+	return func(s *WebhookSubscription) bool {
+		user, err := api.loginModelById(s.OwnerID)
+		if err != nil {
+			return false
+		}
+		if userHasRole(user, []string{"admin"}) || ownership.isSuperuser(user) {
+			return true
+		}
+		id, ok := ownership.userID(user)
+		return owned && ok && id == owner
+	}
+}
+
+// payloadWriter is the ResponseWriter given to the hooks building a webhook
+// payload. Anything they write means the item mustn't be sent.
+type payloadWriter struct {
+	header  http.Header
+	written bool
+}
+
+func (w *payloadWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *payloadWriter) Write(b []byte) (int, error) {
+	w.written = true
+	return len(b), nil
+}
+
+func (w *payloadWriter) WriteHeader(int) {
+	w.written = true
+}
+
+// webhookPayload returns the JSON of item as the GET route of its model would
+// send it, calling its AfterReadHook and the route's EditResult on a copy.
+// Returns false if either refuses the item.
+func (api *apiServer) webhookPayload(req *Request, c martini.Context, item interface{}) ([]byte, bool) {
+	w := &payloadWriter{header: http.Header{}}
+	read := *req
+	read.Method = "GET"
+	read.Writer = w
+	read.Result = deepCopy(item)
+	fields := log.Fields{"model": pluralCamelName(item)}
+	if h, ok := read.Result.(AfterReadHook); ok {
+		if err := h.APIAfterRead(&read); err != nil {
+			log.WithFields(fields).Warn("AfterRead refused webhook payload: ", err)
+			return nil, false
+		}
+	}
+	if editResult := api.readEditResult(reflect.TypeOf(item).Elem()); editResult != nil {
+		injector := inject.New()
+		injector.SetParent(c)
+		injector.Map(&read)
+		injector.MapTo(w, (*http.ResponseWriter)(nil))
+		if _, err := injector.Invoke(martiniHandler(editResult)); err != nil || w.written {
+			log.WithFields(fields).Warn("EditResult refused webhook payload: ", err)
+			return nil, false
+		}
+	}
+	payload, err := json.Marshal(read.Result)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Can't marshal webhook payload")
+		return nil, false
+	}
+	return payload, true
+}
+
+// readRoute returns the GET route of model, or nil if it has none.
+func (api *apiServer) readRoute(model reflect.Type) *route {
+	for _, r := range api.routes {
+		if r.model == model && r.action == ACTION_GET {
+			return r
+		}
+	}
+	return nil
+}
+
+// readEditResult returns the EditResult of the GET route of model, if any.
+func (api *apiServer) readEditResult(model reflect.Type) martini.Handler {
+	if r := api.readRoute(model); r != nil {
+		return r.options.EditResult
+	}
+	return nil
+}
+
+// itemOwner returns the value of item's `api:"owner"` field, or false if it
+// has none or it is nil.
+func itemOwner(item interface{}) (uint, bool) {
+	v := reflect.ValueOf(item).Elem()
+	field, ok := ownerField(v.Type())
+	if !ok {
+		return 0, false
+	}
+	owner := v.FieldByIndex(field.Index)
+	if owner.Kind() == reflect.Ptr {
+		if owner.IsNil() {
+			return 0, false
+		}
+		owner = owner.Elem()
+	}
+	switch owner.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return uint(owner.Int()), owner.Int() >= 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return uint(owner.Uint()), true
+	}
+	return 0, false
+}
+
+// emit sends template to every subscription in scope which wants it. It
+// returns at once: subscriptions are looked up and deliveries made in the
+// background.
+func (d *webhookDispatcher) emit(template WebhookDelivery, scope webhookScope) {
+	d.pending.Add(1)
+	go d.dispatch(template, scope)
+}
+
+// dispatch creates a delivery of template for each matching subscription and
+// makes its first attempt. Only the subscriptions in scope for the model are
+// loaded.
+func (d *webhookDispatcher) dispatch(template WebhookDelivery, scope webhookScope) {
+	defer d.pending.Done()
+	db := d.db.Where("tenant = ? AND (model = ? OR model = '')", scope.tenant, template.Model)
+	subscriptions := []WebhookSubscription{}
+	if err := db.Find(&subscriptions).Error; err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Can't load webhook subscriptions")
+		return
+	}
+	for i := range subscriptions {
+		s := &subscriptions[i]
+		if !s.Matches(template.Model, template.Event) || (scope.sees != nil && !scope.sees(s)) {
+			continue
+		}
+		delivery := template
+		delivery.SubscriptionID = s.ID
+		if err := d.db.Create(&delivery).Error; err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("Can't create webhook delivery")
+			continue
+		}
+		d.pending.Add(1)
+		go d.attempt(&delivery, s)
+	}
+}
+
+// attempt makes one attempt at delivery, and schedules a retry if it fails.
+func (d *webhookDispatcher) attempt(delivery *WebhookDelivery, s *WebhookSubscription) {
+	d.workers <- struct{}{}
+	delivery.StatusCode, delivery.Error = d.post(delivery, s)
+	<-d.workers
+	delivery.Attempts++
+	switch {
+	case delivery.Error == "":
+		delivery.State = DELIVERY_DELIVERED
+	case delivery.Attempts >= d.config.MaxAttempts:
+		delivery.State = DELIVERY_FAILED
+	}
+	fields := log.Fields{"delivery": delivery.ID, "url": s.URL, "attempts": delivery.Attempts, "state": delivery.State}
+	if err := d.db.Save(delivery).Error; err != nil {
+		log.WithFields(fields).Error("Can't save webhook delivery: ", err)
+	}
+	if delivery.State != DELIVERY_PENDING {
+		log.WithFields(fields).Info("Webhook delivery finished")
+		d.pending.Done()
+		return
+	}
+	backoff := d.config.Backoff << uint(delivery.Attempts-1)
+	log.WithFields(fields).Warn("Webhook delivery failed, retrying in ", backoff, ": ", delivery.Error)
+	time.AfterFunc(backoff, func() { d.attempt(delivery, s) })
+}
+
+// post sends delivery to s, returning the response's status code and an
+// error message unless it was a 2xx.
+func (d *webhookDispatcher) post(delivery *WebhookDelivery, s *WebhookSubscription) (int, string) {
+	body := []byte(delivery.Payload)
+	r, err := http.NewRequest("POST", s.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err.Error()
+	}
+	r.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	r.Header.Set("X-Webhook-Event", delivery.Event)
+	r.Header.Set("X-Webhook-Model", delivery.Model)
+	r.Header.Set("X-Webhook-Delivery", fmt.Sprint(delivery.ID))
+	r.Header.Set(WebhookSignatureHeader, WebhookSignature(s.Secret, body))
+	resp, err := d.config.Client.Do(r)
+	if err != nil {
+		return 0, err.Error()
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, resp.Status
+	}
+	return resp.StatusCode, ""
+}
+
+// wait blocks until every event emitted so far has been delivered, or has
+// failed.
+func (d *webhookDispatcher) wait() {
+	d.pending.Wait()
+}
+
+// parseWebhookUpload binds the body of a create request to req.Uploaded.
+func parseWebhookUpload(req *Request, w http.ResponseWriter, r *http.Request, c martini.Context) {
+	upload := webhookUpload{}
+	if !decodeBody(w, r, c, &upload) {
+		return
+	}
+	errs := map[string]string{}
+	if u, err := url.Parse(upload.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs["url"] = "must be an http or https URL"
+	}
+	for _, e := range upload.Events {
+		if e != WEBHOOK_CREATED && e != WEBHOOK_UPDATED && e != WEBHOOK_DELETED {
+			errs["events"] = "must be created, updated or deleted"
+		}
+	}
+	if len(errs) > 0 {
+		j, _ := json.Marshal(errs)
+		w.WriteHeader(422)
+		w.Write([]byte(fmt.Sprintf(`{"errors":%s}`, j)))
+		return
+	}
+	req.Uploaded = &upload
+}
+
+// subscriptionOwner returns the id of the logged in user, who owns the
+// subscriptions they make, or 0 if there is none. It writes a 500 and
+// returns false if the user has no id.
+func subscriptionOwner(w http.ResponseWriter, c martini.Context) (uint, bool) {
+	user := c.Get(loginModelType)
+	if !user.IsValid() {
+		return 0, true
+	}
+	id, ok := userID(user.Interface())
+	if !ok {
+		writeNoUserID(w, user.Interface())
+	}
+	return id, ok
+}
+
+// ownSubscriptionHandler scopes req.DB to the subscriptions made by the
+// logged in user.
+func ownSubscriptionHandler(req *Request, w http.ResponseWriter, c martini.Context) {
+	if owner, ok := subscriptionOwner(w, c); ok {
+		req.DB = req.DB.Where("owner_id = ?", owner)
+	}
+}
+
+// createWebhookHandler stores a new subscription with a random secret.
+func (api *apiServer) createWebhookHandler() martini.Handler {
+	return func(req *Request, w http.ResponseWriter, c martini.Context) {
+		owner, ok := subscriptionOwner(w, c)
+		if !ok {
+			return
+		}
+		upload := req.Uploaded.(*webhookUpload)
+		s := WebhookSubscription{URL: upload.URL, Model: upload.Model, Events: strings.Join(upload.Events, " "),
+			Tenant: req.Tenant, OwnerID: owner}
+		secret, err := newAPIKeySecret()
+		if err == nil {
+			s.Secret = secret
+			err = api.db.Create(&s).Error
+		}
+		if err != nil {
+			log.Warn("Error creating webhook subscription: ", err)
+			w.WriteHeader(500)
+			return
+		}
+		req.Result = &webhookResult{WebhookSubscription: s, Secret: secret}
+	}
+}
+
+// AddWebhookRoutes implements API interface for AddWebhookRoutes().
+func (api *apiServer) AddWebhookRoutes(path string, options ...RouteOptions) {
+	if api.webhooks == nil {
+		panic("Set Options.Webhooks to send webhooks before calling AddWebhookRoutes()")
+	}
+	readOptions := adminOptions(withScopes(applyPolicy(nil, ACTION_INDEX, getOptions(options, ROUTE_READ)), "webhooks:read"))
+	createOptions := adminOptions(withScopes(applyPolicy(nil, ACTION_CREATE, getOptions(options, ROUTE_WRITE)), "webhooks:write"))
+	deleteOptions := adminOptions(withScopes(applyPolicy(nil, ACTION_DELETE, getOptions(options, ROUTE_DELETE)), "webhooks:write"))
+	subscriptionType := reflect.TypeOf(WebhookSubscription{})
+	log.WithFields(log.Fields{"path": path}).Info("Adding webhook routes")
+
+	api.addRoute("GET", path, "", nil, readOptions, api.handlerList(
+		api.bindRequestHandler("GET", nil),
+		api.ownTenantHandler(),
+		api.getAuthenticateHandler(readOptions.Authenticate),
+		scopeHandler(readOptions.RequiredScopes),
+		api.impersonationStep(readOptions),
+		api.tenantMemberStep(readOptions),
+		ownSubscriptionHandler,
+		requirementHandler(readOptions.requirement),
+		readOptions.Authorize,
+		readOptions.Query,
+		func(req *Request) {
+			subscriptions := []WebhookSubscription{}
+			req.DB.Order("id").Find(&subscriptions)
+			req.Result = &subscriptions
+		},
+		readOptions.EditResult,
+		sendResult))
+
+	api.addRoute("POST", path, "", nil, createOptions, api.handlerList(
+		api.bindRequestHandler("POST", nil),
+		api.ownTenantHandler(),
+		api.getAuthenticateHandler(createOptions.Authenticate),
+		scopeHandler(createOptions.RequiredScopes),
+		api.impersonationStep(createOptions),
+		api.tenantMemberStep(createOptions),
+		requirementHandler(createOptions.requirement),
+		createOptions.Authorize,
+		parseWebhookUpload,
+		createOptions.CheckUpload,
+		api.createWebhookHandler(),
+		createOptions.EditResult,
+		sendResult))
+
+	api.addRoute("DELETE", path+"/:id", "", nil, deleteOptions, api.handlerList(
+		api.bindRequestHandler("DELETE", nil),
+		api.ownTenantHandler(),
+		api.getAuthenticateHandler(deleteOptions.Authenticate),
+		scopeHandler(deleteOptions.RequiredScopes),
+		api.impersonationStep(deleteOptions),
+		api.tenantMemberStep(deleteOptions),
+		ownSubscriptionHandler,
+		requirementHandler(deleteOptions.requirement),
+		deleteOptions.Authorize,
+		deleteOptions.Query,
+		getItemHandler(subscriptionType),
+		func(req *Request, w http.ResponseWriter) {
+			if err := api.db.Delete(req.Result).Error; err != nil {
+				log.Warn("Error deleting webhook subscription: ", err)
+				w.WriteHeader(500)
+			}
+		},
+		deleteOptions.EditResult,
+		sendResult))
+
+	api.addRoute("GET", path+"/:id/deliveries", "", nil, readOptions, api.handlerList(
+		api.bindRequestHandler("GET", nil),
+		api.ownTenantHandler(),
+		api.getAuthenticateHandler(readOptions.Authenticate),
+		scopeHandler(readOptions.RequiredScopes),
+		api.impersonationStep(readOptions),
+		api.tenantMemberStep(readOptions),
+		ownSubscriptionHandler,
+		requirementHandler(readOptions.requirement),
+		readOptions.Authorize,
+		readOptions.Query,
+		getItemHandler(subscriptionType),
+		func(req *Request) {
+			deliveries := []WebhookDelivery{}
+			withContext(api.db, req.Context()).Where("subscription_id = ?", req.Result.(*WebhookSubscription).ID).Order("id desc").Limit(100).Find(&deliveries)
+			req.Result = &deliveries
+		},
+		readOptions.EditResult,
+		sendResult))
+}
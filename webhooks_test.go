@@ -0,0 +1,250 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type WebhookWidget struct {
+	ID     uint   `gorm:"primary_key" json:"id"`
+	Name   string `json:"name"`
+	Secret string `json:"secret"`
+}
+
+// webhookReceiver is a local server recording the deliveries made to it, by
+// path. The first attempt at each update sent to /flaky fails.
+type webhookReceiver struct {
+	*httptest.Server
+	sync.Mutex
+	received map[string][]receivedWebhook
+	failed   map[string]bool
+}
+
+type receivedWebhook struct {
+	event     string
+	body      []byte
+	signature string
+}
+
+func newWebhookReceiver() *webhookReceiver {
+	rec := &webhookReceiver{received: map[string][]receivedWebhook{}, failed: map[string]bool{}}
+	rec.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		rec.Lock()
+		defer rec.Unlock()
+		event := r.Header.Get("X-Webhook-Event")
+		if r.URL.Path == "/flaky" && event == WEBHOOK_UPDATED && !rec.failed[string(body)] {
+			rec.failed[string(body)] = true
+			w.WriteHeader(500)
+			return
+		}
+		rec.received[r.URL.Path] = append(rec.received[r.URL.Path], receivedWebhook{event, body, r.Header.Get(WebhookSignatureHeader)})
+	}))
+	return rec
+}
+
+func TestWebhookSignature(t *testing.T) {
+	body := []byte(`{"id":1}`)
+	signature := WebhookSignature("secret", body)
+	if signature != "sha256=03def589620c813f198fd03d7967e292b163ef0435ebf43071ce0e9519763cb7" {
+		t.Errorf("Unexpected signature %s", signature)
+	}
+	if !VerifyWebhookSignature("secret", body, signature) {
+		t.Errorf("Signature should verify")
+	}
+	if VerifyWebhookSignature("other", body, signature) || VerifyWebhookSignature("secret", []byte(`{"id":2}`), signature) {
+		t.Errorf("Signature should only verify with the same secret and body")
+	}
+}
+
+func TestWebhookSubscriptionMatches(t *testing.T) {
+	for _, c := range []struct {
+		s             WebhookSubscription
+		model, event  string
+		expectedMatch bool
+	}{
+		{WebhookSubscription{}, "widgets", WEBHOOK_CREATED, true},
+		{WebhookSubscription{Model: "widgets"}, "widgets", WEBHOOK_DELETED, true},
+		{WebhookSubscription{Model: "widgets"}, "users", WEBHOOK_CREATED, false},
+		{WebhookSubscription{Events: "created deleted"}, "users", WEBHOOK_DELETED, true},
+		{WebhookSubscription{Events: "created deleted"}, "users", WEBHOOK_UPDATED, false},
+	} {
+		if c.s.Matches(c.model, c.event) != c.expectedMatch {
+			t.Errorf("%+v.Matches(%s, %s) should be %v", c.s, c.model, c.event, c.expectedMatch)
+		}
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	rec := newWebhookReceiver()
+	defer rec.Close()
+	db := getTestDb()
+	for _, table := range []interface{}{&WebhookSubscription{}, &WebhookDelivery{}, &WebhookWidget{}} {
+		db.DropTable(table)
+	}
+	db.CreateTable(&WebhookWidget{})
+	a := New(Options{JwtKey: "RandomString", Db: db, Martini: getSilentMartini(),
+		Webhooks: &Webhooks{Backoff: time.Millisecond, MaxAttempts: 3}})
+	a.SetAuth(&User{}, "/auth")
+	hideSecret := func(req *Request) error {
+		if widget, ok := req.Result.(*WebhookWidget); ok {
+			widget.Secret = ""
+		}
+		return nil
+	}
+	a.AddDefaultRoutes(&WebhookWidget{}, RouteOptions{EditResult: hideSecret}, RouteOptions{})
+	a.AddWebhookRoutes("/api/webhooks")
+	dispatcher := a.(*apiServer).webhooks
+
+	adminq := "?access_token=" + getToken(testApiReq(t, a, "Login", "POST", "/auth", `{"name": "admin", "password": "password"}`, nil, 200).Body.String())
+	testApiReq(t, a, "Webhooks(No token)", "GET", "/api/webhooks", "", nil, 401)
+	testApiReq(t, a, "Webhooks(Bad URL)", "POST", "/api/webhooks"+adminq, `{"url":"ftp://example.com"}`, nil, 422)
+	testApiReq(t, a, "Webhooks(Bad event)", "POST", "/api/webhooks"+adminq, `{"url":"http://example.com","events":["exploded"]}`, nil, 422)
+	subscribe := func(body string) webhookResult {
+		s := webhookResult{}
+		json.Unmarshal(testApiReq(t, a, "Webhooks(Subscribe)", "POST", "/api/webhooks"+adminq, body, nil, 200).Body.Bytes(), &s)
+		if s.Secret == "" {
+			t.Errorf("Expected a secret for new subscription %s", body)
+		}
+		return s
+	}
+	flaky := subscribe(fmt.Sprintf(`{"url":%q,"model":"webhook_widgets"}`, rec.URL+"/flaky"))
+	deletes := subscribe(fmt.Sprintf(`{"url":%q,"events":["deleted"]}`, rec.URL+"/deletes"))
+	subscribe(fmt.Sprintf(`{"url":%q,"model":"other_widgets"}`, rec.URL+"/other"))
+	gone := subscribe(`{"url":"http://127.0.0.1:1/gone","model":"webhook_widgets","events":["created"]}`)
+
+	body := testApiReq(t, a, "Webhooks(POST)", "POST", "/api/webhook_widgets", `{"name":"One","secret":"shh"}`, nil, 200).Body.String()
+	widget := WebhookWidget{}
+	json.Unmarshal([]byte(body), &widget)
+	item := fmt.Sprintf("/api/webhook_widgets/%d", widget.ID)
+	testApiReq(t, a, "Webhooks(PATCH)", "PATCH", item, `{"name":"Two"}`, nil, 200)
+	testApiReq(t, a, "Webhooks(DELETE)", "DELETE", item, "", nil, 200)
+	testApiReq(t, a, "Webhooks(Failed PATCH)", "PATCH", item, `{"name":"Three"}`, nil, 404)
+	dispatcher.wait()
+
+	rec.Lock()
+	defer rec.Unlock()
+	check := func(path string, secret string, events ...string) {
+		received := rec.received[path]
+		if len(received) != len(events) {
+			t.Fatalf("%s should receive %v, received %d deliveries", path, events, len(received))
+		}
+		// Events are dispatched concurrently, so may arrive in any order.
+		expected := map[string]bool{}
+		for _, event := range events {
+			expected[event] = true
+		}
+		for i, r := range received {
+			if !expected[r.event] || !VerifyWebhookSignature(secret, r.body, r.signature) {
+				t.Errorf("%s delivery %d should be a signed one of %v, got %s %s", path, i, events, r.event, r.body)
+			}
+			delete(expected, r.event)
+			got := WebhookWidget{}
+			json.Unmarshal(r.body, &got)
+			if got.ID != widget.ID || got.Secret != "" {
+				t.Errorf("%s delivery %d should be of widget %d without its secret, got %s", path, i, widget.ID, r.body)
+			}
+		}
+	}
+	check("/flaky", flaky.Secret, WEBHOOK_CREATED, WEBHOOK_UPDATED, WEBHOOK_DELETED)
+	check("/deletes", deletes.Secret, WEBHOOK_DELETED)
+	check("/other", "")
+
+	deliveries := []WebhookDelivery{}
+	body = testApiReq(t, a, "Webhooks(Deliveries)", "GET", fmt.Sprintf("/api/webhooks/%d/deliveries%s", flaky.ID, adminq), "", nil, 200).Body.String()
+	json.Unmarshal([]byte(body), &deliveries)
+	if len(deliveries) != 3 {
+		t.Errorf("Expected 3 deliveries, got %s", body)
+	}
+	for _, d := range deliveries {
+		attempts := 1
+		if d.Event == WEBHOOK_UPDATED {
+			attempts = 2
+		}
+		if d.Attempts != attempts || d.State != DELIVERY_DELIVERED || d.StatusCode != 200 {
+			t.Errorf("Expected %s to be delivered at attempt %d: %+v", d.Event, attempts, d)
+		}
+	}
+	body = testApiReq(t, a, "Webhooks(Failed deliveries)", "GET", fmt.Sprintf("/api/webhooks/%d/deliveries%s", gone.ID, adminq), "", nil, 200).Body.String()
+	json.Unmarshal([]byte(body), &deliveries)
+	if len(deliveries) != 1 || deliveries[0].Attempts != 3 || deliveries[0].State != DELIVERY_FAILED || deliveries[0].Error == "" {
+		t.Errorf("Expected the delivery to fail after 3 attempts: %s", body)
+	}
+
+	testApiReq(t, a, "Webhooks(Unsubscribe)", "DELETE", fmt.Sprintf("/api/webhooks/%d%s", deletes.ID, adminq), "", nil, 200)
+	subscriptions := []WebhookSubscription{}
+	json.Unmarshal(testApiReq(t, a, "Webhooks(List)", "GET", "/api/webhooks"+adminq, "", nil, 200).Body.Bytes(), &subscriptions)
+	if len(subscriptions) != 3 {
+		t.Errorf("Expected 3 subscriptions after unsubscribing, got %v", subscriptions)
+	}
+	admin := User{}
+	db.Where("name = ?", "admin").First(&admin)
+	for _, s := range subscriptions {
+		if s.OwnerID != admin.ID {
+			t.Errorf("Subscription should be owned by the admin who made it: %+v", s)
+		}
+	}
+}
+
+func TestItemOwner(t *testing.T) {
+	type pointerOwned struct {
+		Owner *uint `api:"owner"`
+	}
+	id := uint(7)
+	for _, c := range []struct {
+		item  interface{}
+		owner uint
+		owned bool
+	}{
+		{&OwnedWidget{UserID: 3}, 3, true},
+		{&pointerOwned{Owner: &id}, 7, true},
+		{&pointerOwned{}, 0, false},
+		{&WebhookWidget{}, 0, false},
+	} {
+		if owner, owned := itemOwner(c.item); owner != c.owner || owned != c.owned {
+			t.Errorf("itemOwner(%+v) should be %d, %v, got %d, %v", c.item, c.owner, c.owned, owner, owned)
+		}
+	}
+}
+
+func TestWebhookOwnership(t *testing.T) {
+	rec := newWebhookReceiver()
+	defer rec.Close()
+	db := getTestDb()
+	for _, table := range []interface{}{&WebhookSubscription{}, &WebhookDelivery{}, &OwnedWidget{}} {
+		db.DropTable(table)
+	}
+	db.CreateTable(&OwnedWidget{})
+	a := New(Options{JwtKey: "RandomString", Db: db, Martini: getSilentMartini(), Webhooks: &Webhooks{}})
+	a.SetAuth(&User{}, "/auth")
+	a.AddDefaultRoutes(&OwnedWidget{}, RouteOptions{Ownership: &Ownership{}})
+
+	admin := User{}
+	db.Where("name = ?", "admin").First(&admin)
+	owner, other := User{Name: "hook_owner", Password: "password"}, User{Name: "hook_other", Password: "password"}
+	db.Create(&owner)
+	db.Create(&other)
+	defer db.Delete(&owner)
+	defer db.Delete(&other)
+	for path, id := range map[string]uint{"/admin": admin.ID, "/owner": owner.ID, "/other": other.ID} {
+		db.Create(&WebhookSubscription{URL: rec.URL + path, Secret: "secret", OwnerID: id})
+	}
+
+	ownerq := "?access_token=" + getToken(testApiReq(t, a, "Login", "POST", "/auth", `{"name": "hook_owner", "password": "password"}`, nil, 200).Body.String())
+	testApiReq(t, a, "WebhookOwnership(POST)", "POST", "/api/owned_widgets"+ownerq, `{"name":"Mine"}`, nil, 200)
+	a.(*apiServer).webhooks.wait()
+
+	rec.Lock()
+	defer rec.Unlock()
+	for path, expected := range map[string]int{"/admin": 1, "/owner": 1, "/other": 0} {
+		if len(rec.received[path]) != expected {
+			t.Errorf("%s should receive %d deliveries, received %d", path, expected, len(rec.received[path]))
+		}
+	}
+}